@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+
+	"github.com/tqbf/sprync/pkg/config"
+)
+
+func configCmd() *cli.Command {
+	return &cli.Command{
+		Name:  "config",
+		Usage: "inspect " + config.FileName,
+		Subcommands: []*cli.Command{
+			{
+				Name:      "show",
+				Usage:     "print the effective settings of targets",
+				ArgsUsage: "[target]",
+				Flags:     syncFlags(),
+				Action:    configShowAction,
+			},
+		},
+	}
+}
+
+func loadConfig(c *cli.Context) (*config.Config, error) {
+	path := c.String("config")
+	if path == "" {
+		var err error
+		path, err = config.Find(".")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config.Load(path)
+}
+
+// namedTarget is a target picked from the config by name.
+type namedTarget struct {
+	config.Target
+	name string
+	dir  string
+}
+
+// targetArgs returns the source and destination of a command,
+// given either as two arguments or as the name of a target.
+// A target's settings fill in the flags not given; pull swaps
+// its source and destination.
+func targetArgs(
+	c *cli.Context, usage string, pull bool,
+) (*namedTarget, string, string, error) {
+	switch c.NArg() {
+	case 2:
+		return nil, c.Args().Get(0), c.Args().Get(1), nil
+	case 1:
+	default:
+		return nil, "", "", fmt.Errorf("usage: %s", usage)
+	}
+
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return nil, "", "", fmt.Errorf("config: %w", err)
+	}
+	name := c.Args().First()
+	t, err := cfg.Target(name)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err := applyTarget(c, *t); err != nil {
+		return nil, "", "", err
+	}
+	nt := &namedTarget{
+		Target: *t,
+		name:   name,
+		dir:    filepath.Dir(cfg.Path),
+	}
+	if pull {
+		return nt, t.Destination, t.Source, nil
+	}
+	return nt, t.Source, t.Destination, nil
+}
+
+// mergeFlags returns t with the flags given on the command line
+// in place of its own settings, and flag defaults for those it
+// leaves out.
+func mergeFlags(c *cli.Context, t config.Target) config.Target {
+	if c.IsSet("exclude") {
+		t.Exclude = excludePatterns(c)
+	}
+	t.Compress = mergeBool(c, "compress", t.Compress)
+	t.Delete = mergeBool(c, "delete", t.Delete)
+	return t
+}
+
+func mergeBool(c *cli.Context, name string, v *bool) *bool {
+	if v == nil || c.IsSet(name) {
+		b := c.Bool(name)
+		return &b
+	}
+	return v
+}
+
+func applyTarget(c *cli.Context, t config.Target) error {
+	set := func(name, value string) error {
+		if c.IsSet(name) || !hasFlag(c, name) {
+			return nil
+		}
+		return c.Set(name, value)
+	}
+	if !c.IsSet("exclude") {
+		for _, e := range t.Exclude {
+			if err := c.Set("exclude", e); err != nil {
+				return err
+			}
+		}
+	}
+	if t.Compress != nil {
+		err := set("compress", strconv.FormatBool(*t.Compress))
+		if err != nil {
+			return err
+		}
+	}
+	if t.Delete != nil {
+		return set("delete", strconv.FormatBool(*t.Delete))
+	}
+	return nil
+}
+
+func hasFlag(c *cli.Context, name string) bool {
+	for _, f := range c.Command.Flags {
+		for _, n := range f.Names() {
+			if n == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runHooks runs fn between the target's pre and post hooks,
+// which a dry run skips.
+func (t *namedTarget) runHooks(
+	c *cli.Context, fn func() error,
+) error {
+	if t == nil || c.Bool("dry-run") {
+		return fn()
+	}
+	if err := t.hooks("pre", t.Hooks.Pre); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return t.hooks("post", t.Hooks.Post)
+}
+
+func (t *namedTarget) hooks(stage string, cmds []string) error {
+	for _, line := range cmds {
+		fmt.Printf("Running %s hook: %s\n", stage, line)
+		cmd := exec.Command("sh", "-c", line)
+		cmd.Dir = t.dir
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Env = append(os.Environ(),
+			"SPRYNC_TARGET="+t.name,
+			"SPRYNC_SOURCE="+t.Source,
+			"SPRYNC_DESTINATION="+t.Destination,
+		)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s hook %q: %w", stage, line, err)
+		}
+	}
+	return nil
+}
+
+func configShowAction(c *cli.Context) error {
+	cfg, err := loadConfig(c)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	names := cfg.Names()
+	if c.NArg() > 0 {
+		if _, err := cfg.Target(c.Args().First()); err != nil {
+			return err
+		}
+		names = []string{c.Args().First()}
+	}
+
+	show := config.Config{Targets: make(map[string]*config.Target)}
+	for _, name := range names {
+		t := mergeFlags(c, *cfg.Targets[name])
+		show.Targets[name] = &t
+	}
+	fmt.Printf("# %s\n", cfg.Path)
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(show); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/protocol"
+	"github.com/tqbf/sprync/pkg/spriteapi"
+)
+
+func deltaCandidates(
+	c *cli.Context,
+	uploads []string,
+	sourceM, targetM pack.Manifest,
+) []string {
+	if !c.Bool("delta") {
+		return nil
+	}
+	threshold := c.Int64("delta-threshold")
+	var out []string
+	for _, p := range uploads {
+		se := sourceM[p]
+		te, ok := targetM[p]
+		if !ok || se.Dir || se.IsSymlink() ||
+			te.Dir || te.IsSymlink() {
+			continue
+		}
+		if se.Size < threshold || te.Size == 0 {
+			continue
+		}
+		out = append(out, p)
+	}
+	return out
+}
+
+// pushDelta patches candidates on the sprite from their remote
+// copies and returns the paths that no longer need a whole-file
+// transfer. With stage set the patched files wait there for a
+// commit.
+func pushDelta(
+	ctx context.Context,
+	c *cli.Context,
+	client *spriteapi.Client,
+	sess *protocol.Session,
+	sprite, localDir, remoteDir string,
+	candidates []string,
+	localM pack.Manifest,
+	stage string,
+) ([]string, error) {
+	sigResult, err := sess.Signature(remoteDir, candidates)
+	if err != nil {
+		return nil, fmt.Errorf("signature: %w", err)
+	}
+	body, err := client.FSRead(ctx, sprite, sigResult.Dest)
+	if err != nil {
+		return nil, fmt.Errorf("download signature: %w", err)
+	}
+	sigs, err := pack.ReadSignatures(body)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]pack.ManifestEntry, 0, len(candidates))
+	for _, p := range candidates {
+		entries = append(entries, localM[p])
+	}
+
+	compress := c.Bool("compress")
+	var literal int64
+	dest := remoteTmpFile(".delta")
+	sent, err := uploadStream(ctx, client, sprite, dest,
+		func(w io.Writer) error {
+			n, err := pack.PackDelta(
+				localDir, entries, sigs, w, compress,
+			)
+			literal = n
+			return err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := unpackOptions(c)
+	opts.Backup = remoteBackup(c)
+	result, err := sess.PatchStaged(remoteDir, dest, stage, opts)
+	if err != nil {
+		return nil, fmt.Errorf("patch: %w", err)
+	}
+	slog.Debug("delta",
+		"files", len(sigs),
+		"literal", literal,
+		"failed", result.Failed,
+	)
+	fmt.Printf(
+		"Patched %d files (%s sent)\n",
+		result.Count, humanBytes(sent),
+	)
+
+	failed := make(map[string]bool, len(result.Failed))
+	for _, p := range result.Failed {
+		failed[p] = true
+	}
+	var patched []string
+	for _, p := range candidates {
+		if _, ok := sigs[p]; ok && !failed[p] {
+			patched = append(patched, p)
+		}
+	}
+	return patched, nil
+}
+
+func without(list, remove []string) []string {
+	drop := make(map[string]bool, len(remove))
+	for _, p := range remove {
+		drop[p] = true
+	}
+	var out []string
+	for _, p := range list {
+		if !drop[p] {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
-	"strings"
 
 	"github.com/urfave/cli/v2"
 
@@ -17,7 +16,7 @@ func diffCmd() *cli.Command {
 		Name:  "diff",
 		Usage: "show what push or pull would do",
 		ArgsUsage: "<localDir|sprite:dir>" +
-			" <sprite:dir>",
+			" <sprite:dir> | <target>",
 		Flags: append(syncFlags(),
 			&cli.StringFlag{
 				Name:  "mode",
@@ -43,27 +42,30 @@ type diffTransfer struct {
 	Path   string `json:"path"`
 	Size   int64  `json:"size"`
 	Reason string `json:"reason"`
+	Link   string `json:"link,omitempty"`
+	Dir    bool   `json:"dir,omitempty"`
+	Mode   string `json:"mode,omitempty"`
+	From   string `json:"from,omitempty"`
 }
 
 type diffSummary struct {
 	TransferCount int   `json:"transfer_count"`
 	TransferBytes int64 `json:"transfer_bytes"`
 	DeleteCount   int   `json:"delete_count"`
+	ChmodCount    int   `json:"chmod_count"`
+	CopyCount     int   `json:"copy_count"`
 }
 
 func diffAction(c *cli.Context) error {
-	if c.NArg() != 2 {
-		return fmt.Errorf(
-			"usage: sprync diff <src> <sprite:dir>",
-		)
+	_, src, dst, err := targetArgs(c,
+		"sprync diff <src> <sprite:dir> | <target>", false,
+	)
+	if err != nil {
+		return err
 	}
 
-	srcSprite, srcDir, srcErr := parseTarget(
-		c.Args().Get(0),
-	)
-	dstSprite, dstDir, err := parseTarget(
-		c.Args().Get(1),
-	)
+	srcSprite, srcDir, srcErr := parseTarget(src)
+	dstSprite, dstDir, err := parseTarget(dst)
 	if err != nil {
 		return err
 	}
@@ -74,9 +76,7 @@ func diffAction(c *cli.Context) error {
 			dstSprite, dstDir,
 		)
 	}
-	return localToSpriteDiff(c,
-		c.Args().Get(0), dstSprite, dstDir,
-	)
+	return localToSpriteDiff(c, src, dstSprite, dstDir)
 }
 
 func localToSpriteDiff(
@@ -97,8 +97,10 @@ func localToSpriteDiff(
 	defer cancel()
 
 	client := newClient(c, token)
-	excludes := c.StringSlice("exclude")
-	deleteOn := c.Bool("delete")
+	remoteOpts, localOpts := targetWalkOptions(c), walkOptions(c)
+	if mode == "pull" {
+		remoteOpts, localOpts = localOpts, remoteOpts
+	}
 
 	sess, err := openSession(ctx, client, sprite)
 	if err != nil {
@@ -106,21 +108,23 @@ func localToSpriteDiff(
 	}
 	defer sess.Close(ctx)
 
-	entries, exists, elapsed, err := sess.Manifest(
-		remoteDir, excludes,
+	remote, err := remoteManifest(
+		c, sess, remoteDir, remoteOpts,
 	)
 	if err != nil {
 		return fmt.Errorf("remote manifest: %w", err)
 	}
 	slog.Debug("remote manifest",
-		"count", len(entries),
-		"exists", exists,
-		"elapsed", elapsed,
+		"count", len(remote.Entries),
+		"exists", remote.Exists,
+		"elapsed", remote.Elapsed,
+		"cache_hits", remote.CacheHits,
+		"cache_misses", remote.CacheMisses,
 	)
 
-	remoteM := entriesToManifest(entries)
+	remoteM := entriesToManifest(remote.Entries)
 
-	localM, err := pack.WalkLocal(localDir, excludes)
+	localM, err := localManifestWith(c, localDir, localOpts)
 	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("walk local: %w", err)
 	}
@@ -132,7 +136,7 @@ func localToSpriteDiff(
 	if mode == "push" {
 		sourceM, targetM = localM, remoteM
 	} else {
-		if !exists {
+		if !remote.Exists {
 			return fmt.Errorf(
 				"remote directory does not exist",
 			)
@@ -140,7 +144,9 @@ func localToSpriteDiff(
 		sourceM, targetM = remoteM, localM
 	}
 
-	diff := pack.ComputeDiff(sourceM, targetM, deleteOn)
+	diff := pack.ComputeDiffWith(
+		sourceM, targetM, diffOptions(c),
+	)
 	return printDiff(c, diff, sourceM, targetM)
 }
 
@@ -157,8 +163,7 @@ func spriteToSpriteDiff(
 	defer cancel()
 
 	client := newClient(c, token)
-	excludes := c.StringSlice("exclude")
-	deleteOn := c.Bool("delete")
+	opts := walkOptions(c)
 
 	srcSess, err := openSession(ctx, client, srcSprite)
 	if err != nil {
@@ -172,29 +177,29 @@ func spriteToSpriteDiff(
 	}
 	defer dstSess.Close(ctx)
 
-	srcEntries, srcExists, _, err := srcSess.Manifest(
-		srcDir, excludes,
+	src, err := remoteManifest(
+		c, srcSess, srcDir, opts,
 	)
 	if err != nil {
 		return fmt.Errorf("src manifest: %w", err)
 	}
-	if !srcExists {
+	if !src.Exists {
 		return fmt.Errorf(
 			"source %s:%s does not exist",
 			srcSprite, srcDir,
 		)
 	}
-	srcM := entriesToManifest(srcEntries)
+	srcM := entriesToManifest(src.Entries)
 
-	dstEntries, _, _, err := dstSess.Manifest(
-		dstDir, excludes,
+	dst, err := remoteManifest(
+		c, dstSess, dstDir, targetWalkOptions(c),
 	)
 	if err != nil {
 		return fmt.Errorf("dst manifest: %w", err)
 	}
-	dstM := entriesToManifest(dstEntries)
+	dstM := entriesToManifest(dst.Entries)
 
-	diff := pack.ComputeDiff(srcM, dstM, deleteOn)
+	diff := pack.ComputeDiffWith(srcM, dstM, diffOptions(c))
 	return printDiff(c, diff, srcM, dstM)
 }
 
@@ -207,29 +212,14 @@ func printDiff(
 		return printDiffJSON(diff, sourceM, targetM)
 	}
 
-	if len(diff.Uploads) == 0 && len(diff.Deletes) == 0 {
+	if diff.Empty() {
 		fmt.Println("Already in sync.")
 		return nil
 	}
 
-	printChanges(
-		diff.Uploads, diff.Deletes, sourceM, targetM,
-	)
-
-	var b strings.Builder
-	size := transferSize(diff.Uploads, sourceM)
-	fmt.Fprintf(&b, "---\n")
-	fmt.Fprintf(&b,
-		"%d to transfer (%s)",
-		len(diff.Uploads), humanBytes(size),
-	)
-	if len(diff.Deletes) > 0 {
-		fmt.Fprintf(&b,
-			", %d to delete", len(diff.Deletes),
-		)
-	}
-	fmt.Fprintf(&b, "\n")
-	fmt.Print(b.String())
+	printChanges(diff, sourceM, targetM)
+	fmt.Println("---")
+	fmt.Println(summarize(diff, sourceM, targetM))
 	return nil
 }
 
@@ -243,6 +233,8 @@ func printDiffJSON(
 		Summary: diffSummary{
 			TransferCount: len(diff.Uploads),
 			DeleteCount:   len(diff.Deletes),
+			ChmodCount:    len(diff.Chmods),
+			CopyCount:     len(diff.Copies),
 		},
 	}
 	if out.Deletes == nil {
@@ -254,17 +246,36 @@ func printDiffJSON(
 		if _, ok := targetM[p]; ok {
 			reason = "changed"
 		}
-		size := int64(0)
-		if e, ok := sourceM[p]; ok {
-			size = e.Size
-		}
+		e := sourceM[p]
+		size := e.Size
 		out.Transfers = append(out.Transfers, diffTransfer{
 			Path:   p,
 			Size:   size,
 			Reason: reason,
+			Link:   e.Link,
+			Dir:    e.Dir,
 		})
 		out.Summary.TransferBytes += size
 	}
+	for _, p := range diff.Chmods {
+		out.Transfers = append(out.Transfers, diffTransfer{
+			Path:   p,
+			Reason: "mode",
+			Mode:   fmt.Sprintf("%04o", sourceM[p].Mode),
+		})
+	}
+	for _, cp := range diff.Copies {
+		reason := "copy"
+		if cp.Rename {
+			reason = "rename"
+		}
+		out.Transfers = append(out.Transfers, diffTransfer{
+			Path:   cp.To,
+			Size:   sourceM[cp.To].Size,
+			Reason: reason,
+			From:   cp.From,
+		})
+	}
 
 	enc := json.NewEncoder(os.Stdout)
 	enc.SetIndent("", "  ")
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/tqbf/sprync/pkg/paths"
+)
+
+// filterChain collects --include, --exclude and --filter-from
+// rules in the order they appear on the command line.
+type filterChain struct {
+	rules []paths.FilterRule
+	// ordered is set by --include and --filter-from, whose rules
+	// only make sense in order. Until then the chain holds just
+	// --exclude patterns, which keep gitignore semantics.
+	ordered bool
+}
+
+// filterFlag adds to a chain shared with the other filter flags
+// as the command line is parsed, which keeps their order.
+type filterFlag struct {
+	chain   *filterChain
+	include bool
+	file    bool
+}
+
+func (f *filterFlag) Set(v string) error {
+	if f.include || f.file {
+		f.chain.ordered = true
+	}
+	if !f.file {
+		f.chain.rules = append(f.chain.rules, paths.FilterRule{
+			Include: f.include, Pattern: v,
+		})
+		return nil
+	}
+	r, err := os.Open(v)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	rules, err := paths.ParseFilters(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", v, err)
+	}
+	f.chain.rules = append(f.chain.rules, rules...)
+	return nil
+}
+
+func (f *filterFlag) String() string {
+	return ""
+}
+
+type fileListFlag struct {
+	list []string
+}
+
+func (f *fileListFlag) Set(v string) error {
+	r, err := os.Open(v)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	list, err := paths.ParseFileList(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", v, err)
+	}
+	if f.list == nil {
+		f.list = []string{}
+	}
+	f.list = append(f.list, list...)
+	return nil
+}
+
+func (f *fileListFlag) String() string {
+	return strings.Join(f.list, ",")
+}
+
+func filterFlags() []cli.Flag {
+	chain := &filterChain{}
+	return []cli.Flag{
+		&cli.GenericFlag{
+			Name:  "include",
+			Usage: "include pattern, checked in order with --exclude",
+			Value: &filterFlag{chain: chain, include: true},
+		},
+		&cli.GenericFlag{
+			Name:  "exclude",
+			Usage: "exclude pattern, gitignore style without --include",
+			Value: &filterFlag{chain: chain},
+		},
+		&cli.GenericFlag{
+			Name:  "filter-from",
+			Usage: "read \"+ pattern\" and \"- pattern\" rules from file",
+			Value: &filterFlag{chain: chain, file: true},
+		},
+		&cli.GenericFlag{
+			Name:  "files-from",
+			Usage: "sync only the paths listed in file",
+			Value: &fileListFlag{},
+		},
+	}
+}
+
+// filterRules returns the filter chain, first match wins, once
+// --include or --filter-from has made it one. Without them it
+// returns nil and the --exclude patterns go to excludes.
+func filterRules(c *cli.Context) []paths.FilterRule {
+	f, ok := c.Generic("exclude").(*filterFlag)
+	if !ok || !f.chain.ordered {
+		return nil
+	}
+	return f.chain.rules
+}
+
+// excludes returns the --exclude patterns when there is no
+// filter chain. They match with gitignore semantics, so the
+// last to match decides and "!pattern" brings a path back.
+func excludes(c *cli.Context) []string {
+	f, ok := c.Generic("exclude").(*filterFlag)
+	if !ok || f.chain.ordered {
+		return nil
+	}
+	return excludePatterns(c)
+}
+
+// excludePatterns returns the patterns of the exclude rules.
+func excludePatterns(c *cli.Context) []string {
+	f, ok := c.Generic("exclude").(*filterFlag)
+	if !ok {
+		return nil
+	}
+	var out []string
+	for _, r := range f.chain.rules {
+		if !r.Include {
+			out = append(out, r.Pattern)
+		}
+	}
+	return out
+}
+
+// filesFrom returns the --files-from list, or nil without one.
+func filesFrom(c *cli.Context) []string {
+	f, ok := c.Generic("files-from").(*fileListFlag)
+	if !ok || !c.IsSet("files-from") {
+		return nil
+	}
+	return f.list
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/protocol"
+)
+
+const journalVersion = 1
+
+// transferJournal records an interrupted push or pull so that a
+// rerun can reuse what already reached the other side.
+type transferJournal struct {
+	path string
+
+	Version  int               `json:"version"`
+	Remote   string            `json:"remote"`
+	Compress bool              `json:"compress"`
+	Paths    []string          `json:"paths"`
+	Entries  map[string]string `json:"entries"`
+
+	// Size is the packed size of a pull tarball, once packed.
+	Size int64 `json:"size,omitempty"`
+	// Chunks holds the sha256 of each push chunk uploaded.
+	Chunks []string `json:"chunks,omitempty"`
+}
+
+func journalPath(
+	kind, sprite, remoteDir, localDir string,
+) (string, error) {
+	return cacheFile("transfers", kind, sprite, remoteDir, localDir)
+}
+
+// cacheFile names the file under the sprync cache dir sub that
+// belongs to one pairing of a sprite dir and a local dir.
+func cacheFile(
+	sub, kind, sprite, remoteDir, localDir string,
+) (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(localDir)
+	if err != nil {
+		return "", err
+	}
+	key := strings.Join(
+		[]string{kind, sprite, remoteDir, abs}, "\x00",
+	)
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:16]) + ".json"
+	return filepath.Join(base, "sprync", sub, name), nil
+}
+
+// openJournal loads the journal for a transfer. Without a usable
+// cache dir it returns one that is never saved, which disables
+// resuming but not the transfer.
+func openJournal(
+	kind, sprite, remoteDir, localDir string,
+) *transferJournal {
+	path, err := journalPath(kind, sprite, remoteDir, localDir)
+	if err != nil {
+		slog.Debug("transfer journal disabled", "err", err)
+		return &transferJournal{}
+	}
+	j := &transferJournal{path: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return j
+	}
+	var saved transferJournal
+	if json.Unmarshal(data, &saved) != nil ||
+		saved.Version != journalVersion {
+		return j
+	}
+	saved.path = path
+	return &saved
+}
+
+// covers reports whether the journaled transfer can be reused for
+// plan: every planned path must be in it, and every path in it
+// must still match m, so the same tarball is produced again.
+func (j *transferJournal) covers(
+	plan []string, m pack.Manifest, compress bool,
+) bool {
+	if j.Remote == "" || j.Compress != compress {
+		return false
+	}
+	for _, p := range plan {
+		if _, ok := j.Entries[p]; !ok {
+			return false
+		}
+	}
+	for _, p := range j.Paths {
+		e, ok := m[p]
+		if !ok || j.Entries[p] != journalKey(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// reset starts a new transfer of plan. It is saved right away so
+// that a rerun can clean up after it even if nothing completes.
+func (j *transferJournal) reset(
+	plan []string, m pack.Manifest, compress bool,
+) {
+	j.Version = journalVersion
+	j.Remote = remoteTmpPath(compress)
+	j.Compress = compress
+	j.Paths = plan
+	j.Entries = make(map[string]string, len(plan))
+	for _, p := range plan {
+		j.Entries[p] = journalKey(m[p])
+	}
+	j.Size = 0
+	j.Chunks = nil
+	j.save()
+}
+
+func journalKey(e pack.ManifestEntry) string {
+	content := e.Hash
+	switch {
+	case e.Dir:
+		content = "dir"
+	case e.IsSymlink():
+		content = "link:" + e.Link
+	}
+	return fmt.Sprintf("%s:%o:%d", content, e.Mode, e.MTime)
+}
+
+func (j *transferJournal) chunkPath(i int) string {
+	return fmt.Sprintf("%s.%04d", j.Remote, i)
+}
+
+func (j *transferJournal) partPath() string {
+	if j.path == "" {
+		return ""
+	}
+	return strings.TrimSuffix(j.path, ".json") + ".part"
+}
+
+// complete reports whether a pull's part file holds the whole
+// tarball.
+func (j *transferJournal) complete() bool {
+	info, err := os.Stat(j.partPath())
+	return err == nil && info.Size() >= j.Size
+}
+
+func (j *transferJournal) save() {
+	if j.path == "" {
+		return
+	}
+	err := os.MkdirAll(filepath.Dir(j.path), 0755)
+	if err == nil {
+		var data []byte
+		data, err = json.Marshal(j)
+		if err == nil {
+			err = writeFileAtomic(j.path, data)
+		}
+	}
+	if err != nil {
+		slog.Warn("save transfer journal", "err", err)
+	}
+}
+
+// discard removes everything the journal left on the sprite and
+// locally, after the transfer finished or can no longer resume.
+func (j *transferJournal) discard(sess *protocol.Session) {
+	if j.Remote != "" {
+		// The chunk after the last recorded one may have been
+		// partly written when the push was cut off.
+		files := []string{j.Remote}
+		for i := range len(j.Chunks) + 1 {
+			files = append(files, j.chunkPath(i))
+		}
+		if _, err := sess.Discard(files); err != nil {
+			slog.Warn("discard remote temp files", "err", err)
+		}
+	}
+	if j.path != "" {
+		os.Remove(j.partPath())
+		os.Remove(j.path)
+	}
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(
+		filepath.Dir(path), ".sprync-journal-*",
+	)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
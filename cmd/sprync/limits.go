@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/tqbf/sprync/pkg/pack"
+)
+
+func deleteFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:  "max-delete",
+			Usage: "refuse to delete more than N files",
+		},
+		&cli.Float64Flag{
+			Name:  "max-delete-percent",
+			Usage: "refuse to delete more than P% of the target",
+		},
+		&cli.IntFlag{
+			Name:  "confirm-deletes",
+			Value: 100,
+			Usage: "ask before deleting more than N files on a " +
+				"terminal (0: never ask)",
+		},
+		&cli.BoolFlag{
+			Name:    "yes",
+			Aliases: []string{"y"},
+			Usage:   "delete without asking",
+		},
+	}
+}
+
+// checkDeletes stops diff, computed from source against target,
+// from deleting more than the limits allow, and asks before a
+// large delete.
+func checkDeletes(
+	c *cli.Context,
+	diff pack.DiffResult,
+	source, target pack.Manifest,
+	where string,
+) error {
+	err := pack.CheckDeletes(diff, source, target, pack.DeleteLimits{
+		Max:        c.Int("max-delete"),
+		MaxPercent: c.Float64("max-delete-percent"),
+	})
+	if err != nil {
+		return err
+	}
+
+	n, _ := pack.CountDeletes(diff.Deletes, target)
+	limit := c.Int("confirm-deletes")
+	if limit <= 0 || n <= limit || c.Bool("yes") ||
+		!isTerminal(os.Stdin) {
+		return nil
+	}
+	fmt.Printf("Delete %d files in %s? [y/N] ", n, where)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	switch strings.ToLower(strings.TrimSpace(line)) {
+	case "y", "yes":
+		return nil
+	}
+	return fmt.Errorf("not deleting %d files in %s", n, where)
+}
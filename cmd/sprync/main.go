@@ -7,16 +7,20 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/urfave/cli/v2"
 
+	"github.com/tqbf/sprync/pkg/config"
 	"github.com/tqbf/sprync/pkg/embedded"
 	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/paths"
 	"github.com/tqbf/sprync/pkg/protocol"
 	"github.com/tqbf/sprync/pkg/spriteapi"
 	"github.com/tqbf/sprync/pkg/spriteauth"
+	"github.com/tqbf/sprync/pkg/throttle"
 )
 
 const appVersion = "0.1.0"
@@ -45,6 +49,10 @@ func main() {
 				Value: 5 * time.Minute,
 				Usage: "operation timeout",
 			},
+			&cli.StringFlag{
+				Name:  "config",
+				Usage: "config file (default: nearest " + config.FileName + ")",
+			},
 			&cli.BoolFlag{
 				Name:    "verbose",
 				Aliases: []string{"v"},
@@ -55,6 +63,10 @@ func main() {
 			pushCmd(),
 			pullCmd(),
 			diffCmd(),
+			watchCmd(),
+			syncCmd(),
+			configCmd(),
+			undoCmd(),
 			doctorCmd(),
 			{
 				Name:  "version",
@@ -73,25 +85,191 @@ func main() {
 }
 
 func syncFlags() []cli.Flag {
-	return []cli.Flag{
+	flags := []cli.Flag{
 		&cli.BoolFlag{
 			Name:  "delete",
 			Usage: "delete extra files on target",
 		},
+		&cli.BoolFlag{
+			Name:  "delete-excluded",
+			Usage: "also delete excluded files on target",
+		},
+		&cli.StringSliceFlag{
+			Name:  "protect",
+			Usage: "never delete target paths matching pattern",
+		},
 		&cli.BoolFlag{
 			Name:  "dry-run",
 			Usage: "show what would happen",
 		},
-		&cli.StringSliceFlag{
-			Name:  "exclude",
-			Usage: "exclude pattern (repeatable)",
+	}
+	flags = append(flags, deleteFlags()...)
+	flags = append(flags, backupFlags()...)
+	return append(append(flags, filterFlags()...),
+		&cli.BoolFlag{
+			Name:  "no-ignore-files",
+			Usage: "ignore .gitignore and .spryncignore files",
 		},
 		&cli.BoolFlag{
 			Name:  "compress",
 			Value: true,
 			Usage: "gzip tarballs",
 		},
+		&cli.BoolFlag{
+			Name:  "copy-links",
+			Usage: "follow symlinks instead of copying them",
+		},
+		&cli.BoolFlag{
+			Name:  "times",
+			Usage: "preserve modification times",
+		},
+		&cli.BoolFlag{
+			Name:  "checksum",
+			Usage: "rehash every file, ignoring the hash cache",
+		},
+		&cli.BoolFlag{
+			Name:  "delay-updates",
+			Usage: "put files in place only once all have arrived",
+		},
+		&cli.BoolFlag{
+			Name:  "renames",
+			Value: true,
+			Usage: "copy or rename files already on the target",
+		},
+		&cli.BoolFlag{
+			Name:  "delta",
+			Usage: "send only changed blocks of large files",
+		},
+		&cli.Int64Flag{
+			Name:  "delta-threshold",
+			Value: 1 << 20,
+			Usage: "minimum file size in bytes for --delta",
+		},
+		&cli.IntFlag{
+			Name:  "streams",
+			Value: 1,
+			Usage: "number of tarballs to transfer in parallel",
+		},
+		&cli.StringFlag{
+			Name:  "bwlimit",
+			Usage: "cap transfer rate in bytes/s (K, M, G suffixes)",
+			Action: func(_ *cli.Context, v string) error {
+				_, err := throttle.ParseRate(v)
+				return err
+			},
+		},
+		&cli.BoolFlag{
+			Name:  "progress",
+			Value: true,
+			Usage: "show live progress when stderr is a terminal",
+		},
+	)
+}
+
+func walkOptions(c *cli.Context) pack.WalkOptions {
+	opts := pack.WalkOptions{
+		Filters:   filterRules(c),
+		Excludes:  excludes(c),
+		CopyLinks: c.Bool("copy-links"),
+		Checksum:  c.Bool("checksum"),
+		Only:      filesFrom(c),
+	}
+	if !c.Bool("no-ignore-files") {
+		opts.IgnoreFiles = pack.DefaultIgnoreFiles
+	}
+	return opts
+}
+
+// targetWalkOptions are the walk options for the side a transfer
+// changes. --delete-excluded walks it unfiltered, so that what
+// the source excludes shows up there to delete.
+func targetWalkOptions(c *cli.Context) pack.WalkOptions {
+	opts := walkOptions(c)
+	if c.Bool("delete-excluded") {
+		opts.Filters, opts.Excludes, opts.IgnoreFiles = nil, nil, nil
+	}
+	return opts
+}
+
+func deleteOptions(
+	c *cli.Context, backup *pack.Backup,
+) pack.DeleteOptions {
+	opts := walkOptions(c)
+	return pack.DeleteOptions{
+		Backup:  backup,
+		Protect: c.StringSlice("protect"),
+		Exclude: paths.MatchOptions{
+			Filters:     opts.Filters,
+			Excludes:    opts.Excludes,
+			IgnoreFiles: opts.IgnoreFiles,
+		},
+		DeleteExcluded: c.Bool("delete-excluded"),
+	}
+}
+
+func localManifest(
+	c *cli.Context, dir string,
+) (pack.Manifest, error) {
+	return localManifestWith(c, dir, walkOptions(c))
+}
+
+func localManifestWith(
+	c *cli.Context, dir string, opts pack.WalkOptions,
+) (pack.Manifest, error) {
+	bar := newProgress(c, "hashing", 0, 0)
+	defer bar.Done()
+	opts.Progress = bar.Add
+	path, err := pack.CachePath(dir)
+	if err != nil {
+		slog.Debug("hash cache disabled", "err", err)
+		return pack.BuildManifest(dir, opts)
+	}
+	opts.Cache = pack.OpenHashCache(path)
+	m, err := pack.BuildManifest(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.Cache.Save(); err != nil {
+		slog.Warn("save hash cache", "err", err)
 	}
+	return m, nil
+}
+
+func remoteManifest(
+	c *cli.Context,
+	sess *protocol.Session,
+	dir string,
+	opts pack.WalkOptions,
+) (*protocol.ManifestResult, error) {
+	bar := newProgress(c, "scanning", 0, 0)
+	defer bar.Done()
+	defer watchSession(sess, bar)()
+	return sess.ManifestWith(dir, opts)
+}
+
+func diffOptions(c *cli.Context) pack.DiffOptions {
+	return pack.DiffOptions{
+		Delete:  c.Bool("delete") || c.Bool("delete-excluded"),
+		Times:   c.Bool("times"),
+		Renames: c.Bool("renames"),
+		Protect: c.StringSlice("protect"),
+	}
+}
+
+// unpackOptions lets a file replace a non-empty directory only
+// when the transfer deletes, deleting what the directory holds
+// as the transfer's deletes would.
+func unpackOptions(c *cli.Context) pack.UnpackOptions {
+	opts := pack.UnpackOptions{
+		Compress:     c.Bool("compress"),
+		Times:        c.Bool("times"),
+		DelayUpdates: c.Bool("delay-updates"),
+	}
+	if diffOptions(c).Delete {
+		del := deleteOptions(c, nil)
+		opts.Delete = &del
+	}
+	return opts
 }
 
 func configureLogging(verbose bool) {
@@ -130,7 +308,11 @@ func newClient(
 	c *cli.Context, token string,
 ) *spriteapi.Client {
 	api := strings.TrimSuffix(c.String("api"), "/")
-	return spriteapi.New(api+"/v1/sprites", token)
+	client := spriteapi.New(api+"/v1/sprites", token)
+	// --bwlimit was validated when the flags were parsed.
+	rate, _ := throttle.ParseRate(c.String("bwlimit"))
+	client.Limiter = throttle.New(rate)
+	return client
 }
 
 func parseTarget(s string) (string, string, error) {
@@ -154,12 +336,16 @@ func entriesToManifest(
 }
 
 func remoteTmpPath(compress bool) string {
-	var b [8]byte
-	rand.Read(b[:])
 	ext := ".tar"
 	if compress {
 		ext = ".tar.gz"
 	}
+	return remoteTmpFile(ext)
+}
+
+func remoteTmpFile(ext string) string {
+	var b [8]byte
+	rand.Read(b[:])
 	return fmt.Sprintf(
 		"/tmp/sprync-%s%s",
 		hex.EncodeToString(b[:]),
@@ -206,28 +392,133 @@ func humanBytes(n int64) string {
 }
 
 func printChanges(
-	transfers, deletes []string,
+	diff pack.DiffResult,
 	sourceM, targetM pack.Manifest,
 ) {
 	var b strings.Builder
-	for _, p := range transfers {
+	for _, p := range diff.Uploads {
 		prefix := "+"
 		if _, ok := targetM[p]; ok {
 			prefix = "~"
 		}
-		if e, ok := sourceM[p]; ok {
+		e, ok := sourceM[p]
+		switch {
+		case !ok:
+		case e.Dir:
+			fmt.Fprintf(&b, "  %s %s/\n", prefix, p)
+		case e.IsSymlink():
+			fmt.Fprintf(&b,
+				"  %s %s -> %s\n", prefix, p, e.Link,
+			)
+		default:
 			fmt.Fprintf(&b,
 				"  %s %s (%s)\n",
 				prefix, p, humanBytes(e.Size),
 			)
 		}
 	}
-	for _, p := range deletes {
+	for _, p := range diff.Deletes {
+		if pack.DeletesDir(targetM, p) {
+			fmt.Fprintf(&b, "  - %s/\n", p)
+			continue
+		}
 		fmt.Fprintf(&b, "  - %s\n", p)
 	}
+	for _, p := range diff.Chmods {
+		fmt.Fprintf(&b,
+			"  m %s (%04o -> %04o)\n",
+			p, targetM[p].Mode, sourceM[p].Mode,
+		)
+	}
+	for _, cp := range diff.Copies {
+		tag := "C"
+		if cp.Rename {
+			tag = "R"
+		}
+		fmt.Fprintf(&b, "  %s %s -> %s\n", tag, cp.From, cp.To)
+	}
 	fmt.Print(b.String())
 }
 
+func summarize(
+	diff pack.DiffResult, sourceM, targetM pack.Manifest,
+) string {
+	var b strings.Builder
+	size := transferSize(diff.Uploads, sourceM)
+	fmt.Fprintf(&b,
+		"%d to transfer (%s)",
+		len(diff.Uploads), humanBytes(size),
+	)
+	files, dirs := pack.CountDeletes(diff.Deletes, targetM)
+	if files > 0 {
+		fmt.Fprintf(&b, ", %d to delete", files)
+	}
+	if dirs > 0 {
+		fmt.Fprintf(&b, ", %d dirs to remove if empty", dirs)
+	}
+	if len(diff.Chmods) > 0 {
+		fmt.Fprintf(&b,
+			", %d mode changes", len(diff.Chmods),
+		)
+	}
+	if len(diff.Copies) > 0 {
+		fmt.Fprintf(&b,
+			", %d renamed or copied", len(diff.Copies),
+		)
+	}
+	return b.String()
+}
+
+func printDeleted(files, dirs int) {
+	if dirs == 0 {
+		fmt.Printf("Deleted %d files\n", files)
+		return
+	}
+	fmt.Printf(
+		"Deleted %d files, removed %d empty dirs\n", files, dirs,
+	)
+}
+
+// copyFallback adds copies that failed on the target back to
+// the transfer, and their rename sources back to the deletes.
+func copyFallback(
+	copies []pack.Copy,
+	failed []string,
+	uploads, deletes []string,
+) ([]string, []string) {
+	if len(failed) == 0 {
+		return uploads, deletes
+	}
+	bad := make(map[string]bool, len(failed))
+	for _, p := range failed {
+		bad[p] = true
+	}
+	uploads = append([]string(nil), uploads...)
+	deletes = append([]string(nil), deletes...)
+	for _, cp := range copies {
+		if !bad[cp.To] {
+			continue
+		}
+		uploads = append(uploads, cp.To)
+		if cp.Rename {
+			deletes = append(deletes, cp.From)
+		}
+	}
+	sort.Strings(uploads)
+	sort.Strings(deletes)
+	return uploads, deletes
+}
+
+func chmodModes(
+	paths []string, m pack.Manifest,
+) map[string]int {
+	modes := make(map[string]int, len(paths))
+	for _, p := range paths {
+		modes[p] = m[p].Mode
+	}
+	return modes
+}
+
 func transferSize(
 	paths []string, m pack.Manifest,
 ) int64 {
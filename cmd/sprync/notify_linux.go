@@ -0,0 +1,206 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/paths"
+)
+
+const watchMask = syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_ONLYDIR | syscall.IN_DONT_FOLLOW |
+	syscall.IN_EXCL_UNLINK
+
+// treeWatcher reports changes below a directory using inotify,
+// with one watch per directory.
+type treeWatcher struct {
+	f       *os.File
+	fd      int
+	root    string
+	opts    pack.WalkOptions
+	matcher *paths.ExcludeMatcher
+	dirs    map[int]string
+}
+
+func newTreeWatcher(
+	root string, opts pack.WalkOptions,
+) (*treeWatcher, error) {
+	fd, err := syscall.InotifyInit1(
+		syscall.IN_CLOEXEC | syscall.IN_NONBLOCK,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("inotify: %w", err)
+	}
+	w := &treeWatcher{
+		f:    os.NewFile(uintptr(fd), "inotify"),
+		fd:   fd,
+		root: root,
+		opts: opts,
+		dirs: make(map[int]string),
+	}
+	w.resetMatcher()
+	if err := w.addTree(""); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// resetMatcher starts over with the ignore files, which it
+// otherwise reads once.
+func (w *treeWatcher) resetMatcher() {
+	w.matcher = paths.NewMatcher(w.root, paths.MatchOptions{
+		Filters:     w.opts.Filters,
+		Excludes:    w.opts.Excludes,
+		IgnoreFiles: w.opts.IgnoreFiles,
+	})
+}
+
+func (w *treeWatcher) Close() error {
+	return w.f.Close()
+}
+
+// addTree watches rel and every directory below it.
+func (w *treeWatcher) addTree(rel string) error {
+	start := filepath.Join(w.root, filepath.FromSlash(rel))
+	return filepath.WalkDir(start,
+		func(abs string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if abs == start && rel == "" {
+					return err
+				}
+				// Gone again before we got to it.
+				return nil
+			}
+			if !d.IsDir() {
+				return nil
+			}
+			r, err := filepath.Rel(w.root, abs)
+			if err != nil {
+				return err
+			}
+			r = filepath.ToSlash(r)
+			if r == "." {
+				r = ""
+			} else if w.matcher.MatchEntry(r, true) {
+				return filepath.SkipDir
+			}
+			wd, err := syscall.InotifyAddWatch(w.fd, abs, watchMask)
+			if err != nil {
+				return fmt.Errorf("watch %s: %w", abs, err)
+			}
+			w.dirs[wd] = r
+			return nil
+		},
+	)
+}
+
+// forget drops the watches on rel and below, after it was moved
+// away.
+func (w *treeWatcher) forget(rel string) {
+	for wd, dir := range w.dirs {
+		if dir == rel || strings.HasPrefix(dir, rel+"/") {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+// run sends the path, relative to the root, of everything that
+// changes until ctx is done. An empty path means events were
+// lost and the whole tree needs a rescan.
+func (w *treeWatcher) run(
+	ctx context.Context, changes chan<- string,
+) error {
+	go func() {
+		<-ctx.Done()
+		w.f.Close()
+	}()
+	send := func(rel string) bool {
+		select {
+		case changes <- rel:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("read inotify: %w", err)
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent
+			name := strings.TrimRight(
+				string(buf[off:off+int(ev.Len)]), "\x00",
+			)
+			off += int(ev.Len)
+
+			rel, ok := w.event(int(ev.Wd), ev.Mask, name)
+			if ok && !send(rel) {
+				return nil
+			}
+		}
+	}
+}
+
+func (w *treeWatcher) event(
+	wd int, mask uint32, name string,
+) (string, bool) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		return "", true
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+		return "", false
+	}
+	dir, ok := w.dirs[wd]
+	if !ok || name == "" || pack.IsTempName(name) {
+		return "", false
+	}
+	rel := path.Join(dir, name)
+	if slices.Contains(w.opts.IgnoreFiles, name) {
+		// What the file ignores may have changed anywhere
+		// below dir, including directories left unwatched.
+		w.resetMatcher()
+		if err := w.addTree(dir); err != nil {
+			slog.Warn("watch directory", "err", err)
+		}
+		return dir, true
+	}
+	isDir := mask&syscall.IN_ISDIR != 0
+	if w.matcher.MatchEntry(rel, isDir) {
+		return "", false
+	}
+	if isDir {
+		switch {
+		case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+			if err := w.addTree(rel); err != nil {
+				slog.Warn("watch new directory", "err", err)
+			}
+		case mask&syscall.IN_MOVED_FROM != 0:
+			w.forget(rel)
+		}
+	}
+	return rel, true
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/tqbf/sprync/pkg/pack"
+)
+
+type treeWatcher struct{}
+
+func newTreeWatcher(
+	root string, opts pack.WalkOptions,
+) (*treeWatcher, error) {
+	return nil, errors.New("inotify is Linux only")
+}
+
+func (w *treeWatcher) Close() error {
+	return nil
+}
+
+func (w *treeWatcher) run(
+	ctx context.Context, changes chan<- string,
+) error {
+	return nil
+}
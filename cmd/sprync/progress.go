@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/protocol"
+)
+
+const redrawInterval = 100 * time.Millisecond
+
+// progressBar draws a single status line on stderr with files,
+// bytes, rate and, when the total is known, an ETA.
+type progressBar struct {
+	label   string
+	files   int
+	total   int64
+	enabled bool
+	start   time.Time
+
+	mu    sync.Mutex
+	count int
+	bytes int64
+	drawn time.Time
+}
+
+func newProgress(
+	c *cli.Context,
+	label string,
+	files int,
+	total int64,
+) *progressBar {
+	return &progressBar{
+		label:   label,
+		files:   files,
+		total:   total,
+		enabled: c.Bool("progress") && isTerminal(os.Stderr),
+		start:   time.Now(),
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Add records files and bytes finished since the last call.
+func (p *progressBar) Add(files int, bytes int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.count += files
+	p.bytes += bytes
+	p.draw()
+}
+
+func (p *progressBar) Done() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.enabled && !p.drawn.IsZero() {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+	}
+}
+
+func (p *progressBar) draw() {
+	if !p.enabled || time.Since(p.drawn) < redrawInterval {
+		return
+	}
+	p.drawn = time.Now()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "\r\x1b[K  %s %d", p.label, p.count)
+	if p.files > 0 {
+		fmt.Fprintf(&b, "/%d", p.files)
+	}
+	fmt.Fprintf(&b, " files, %s", humanBytes(p.bytes))
+	if p.total > 0 {
+		fmt.Fprintf(&b, "/%s", humanBytes(p.total))
+	}
+
+	elapsed := time.Since(p.start).Seconds()
+	rate := float64(p.bytes) / elapsed
+	if elapsed > 0 && rate > 0 {
+		fmt.Fprintf(&b, ", %s/s", humanBytes(int64(rate)))
+		if p.total > p.bytes {
+			eta := time.Duration(
+				float64(p.total-p.bytes) / rate * float64(time.Second),
+			).Round(time.Second)
+			fmt.Fprintf(&b, ", ETA %s", eta)
+		}
+	}
+	fmt.Fprint(os.Stderr, b.String())
+}
+
+// watchSession feeds the running totals spryncd reports for one
+// command into bar, which several sessions may share, until the
+// returned func is called.
+func watchSession(
+	sess *protocol.Session, bar *progressBar,
+) func() {
+	if bar.enabled {
+		var count int
+		var bytes int64
+		sess.OnProgress = func(c int, b int64) {
+			bar.Add(c-count, b-bytes)
+			count, bytes = c, b
+		}
+	}
+	return func() {
+		sess.OnProgress = nil
+	}
+}
+
+func countFiles(paths []string, m pack.Manifest) int {
+	n := 0
+	for _, p := range paths {
+		if !m[p].Dir {
+			n++
+		}
+	}
+	return n
+}
@@ -1,80 +1,109 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
-	"strings"
 
 	"github.com/urfave/cli/v2"
 
 	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/paths"
+	"github.com/tqbf/sprync/pkg/protocol"
+	"github.com/tqbf/sprync/pkg/spriteapi"
 )
 
 func pullCmd() *cli.Command {
 	return &cli.Command{
 		Name:      "pull",
 		Usage:     "pull sprite directory to local",
-		ArgsUsage: "<sprite>:<remoteDir> <localDir>",
-		Flags:     syncFlags(),
-		Action:    pullAction,
+		ArgsUsage: "<sprite>:<remoteDir> <localDir> | <target>",
+		Flags: append(syncFlags(),
+			&cli.BoolFlag{
+				Name:  "watch",
+				Usage: "keep pulling changes as they happen",
+			},
+			debounceFlag(),
+			pollFlag(),
+		),
+		Action: pullAction,
 	}
 }
 
 func pullAction(c *cli.Context) error {
-	if c.NArg() != 2 {
-		return fmt.Errorf(
-			"usage: sprync pull <sprite>:<remoteDir> <localDir>",
-		)
+	t, src, localDir, err := targetArgs(c,
+		"sprync pull <sprite>:<remoteDir> <localDir> | <target>",
+		true,
+	)
+	if err != nil {
+		return err
 	}
-	sprite, remoteDir, err := parseTarget(c.Args().Get(0))
+	sprite, remoteDir, err := parseTarget(src)
 	if err != nil {
 		return err
 	}
-	localDir := c.Args().Get(1)
+	return t.runHooks(c, func() error {
+		return pull(c, sprite, remoteDir, localDir)
+	})
+}
 
+func pull(
+	c *cli.Context, sprite, remoteDir, localDir string,
+) error {
 	token, err := requireToken(c, sprite)
 	if err != nil {
 		return err
 	}
 
-	ctx, cancel := contextWithTimeout(c)
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if c.Bool("watch") {
+		ctx, cancel = watchContext()
+	} else {
+		ctx, cancel = contextWithTimeout(c)
+	}
 	defer cancel()
 
 	client := newClient(c, token)
-	excludes := c.StringSlice("exclude")
-	compress := c.Bool("compress")
-	deleteOn := c.Bool("delete")
+	opts := walkOptions(c)
 	dryRun := c.Bool("dry-run")
 
 	sess, err := openSession(ctx, client, sprite)
 	if err != nil {
 		return err
 	}
-	defer sess.Close(ctx)
+	defer sess.Close(context.Background())
 
-	entries, exists, elapsed, err := sess.Manifest(
-		remoteDir, excludes,
+	remote, err := remoteManifest(
+		c, sess, remoteDir, opts,
 	)
 	if err != nil {
 		return fmt.Errorf("remote manifest: %w", err)
 	}
 	slog.Debug("remote manifest",
-		"count", len(entries),
-		"exists", exists,
-		"elapsed", elapsed,
+		"count", len(remote.Entries),
+		"exists", remote.Exists,
+		"elapsed", remote.Elapsed,
+		"cache_hits", remote.CacheHits,
+		"cache_misses", remote.CacheMisses,
 	)
 
-	if !exists {
+	if !remote.Exists {
 		return fmt.Errorf(
 			"remote directory %s does not exist", remoteDir,
 		)
 	}
 
-	remoteM := entriesToManifest(entries)
+	remoteM := entriesToManifest(remote.Entries)
 
-	localM, err := pack.WalkLocal(localDir, excludes)
+	localM, err := localManifestWith(
+		c, localDir, targetWalkOptions(c),
+	)
 	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("walk local: %w", err)
 	}
@@ -85,62 +114,105 @@ func pullAction(c *cli.Context) error {
 		"count", len(localM),
 	)
 
-	diff := pack.ComputeDiff(remoteM, localM, deleteOn)
-	downloads := diff.Uploads
-	deletes := diff.Deletes
+	diff := pack.ComputeDiffWith(
+		remoteM, localM, diffOptions(c),
+	)
 
-	if len(downloads) == 0 && len(deletes) == 0 {
+	if diff.Empty() {
+		discardJournals(sess, "pull", sprite, remoteDir, localDir)
 		fmt.Println("Already in sync.")
-		return nil
+	} else {
+		fmt.Printf(
+			"Pulling from %s:%s\n", sprite, remoteDir,
+		)
+		printChanges(diff, remoteM, localM)
+		fmt.Println(summarize(diff, remoteM, localM))
+		if !dryRun {
+			err := applyPull(ctx, c, client, sess,
+				sprite, remoteDir, localDir, diff, remoteM, localM,
+			)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	fmt.Printf(
-		"Pulling from %s:%s\n", sprite, remoteDir,
-	)
-	printChanges(downloads, deletes, remoteM, localM)
-
-	var b strings.Builder
-	size := transferSize(downloads, remoteM)
-	fmt.Fprintf(&b,
-		"%d to transfer (%s)",
-		len(downloads), humanBytes(size),
-	)
-	if len(deletes) > 0 {
-		fmt.Fprintf(&b, ", %d to delete", len(deletes))
+	if !c.Bool("watch") {
+		return nil
 	}
-	fmt.Fprintf(&b, "\n")
-	fmt.Print(b.String())
+	if !dryRun {
+		err := settleLocal(c, localDir, localM, remoteM, diff)
+		if err != nil {
+			return err
+		}
+	}
+	return watchRemote(ctx, &pullWatch{
+		c:         c,
+		client:    client,
+		sess:      sess,
+		sprite:    sprite,
+		remoteDir: remoteDir,
+		localDir:  localDir,
+		remoteM:   remoteM,
+		localM:    localM,
+	})
+}
 
-	if dryRun {
-		return nil
+// applyPull makes localDir match diff, computed from remoteM
+// against localM: local copies, then tarballs, then deletes and
+// mode changes.
+func applyPull(
+	ctx context.Context,
+	c *cli.Context,
+	client *spriteapi.Client,
+	sess *protocol.Session,
+	sprite, remoteDir, localDir string,
+	diff pack.DiffResult,
+	remoteM, localM pack.Manifest,
+) error {
+	err := checkDeletes(c, diff, remoteM, localM, localDir)
+	if err != nil {
+		return err
+	}
+	downloads, deletes := diff.Uploads, diff.Deletes
+	size := transferSize(downloads, remoteM)
+	backup, err := localBackup(c, localDir)
+	if err != nil {
+		return err
 	}
 
-	if len(downloads) > 0 {
-		packResult, err := sess.Pack(
-			remoteDir, downloads, compress,
-		)
-		if err != nil {
-			return fmt.Errorf("remote pack: %w", err)
+	if len(diff.Copies) > 0 {
+		var failed []string
+		for _, cp := range pack.CopyOrder(diff.Copies) {
+			err := backup.SaveCopy(localDir, cp)
+			if err == nil {
+				err = pack.CopyPath(localDir, cp, c.Bool("times"))
+			}
+			if err != nil {
+				slog.Warn("copy failed",
+					"path", cp.To, "err", err,
+				)
+				failed = append(failed, cp.To)
+			}
 		}
-		slog.Debug("packed",
-			"dest", packResult.Dest,
-			"size", packResult.Size,
-			"count", packResult.Count,
+		fmt.Printf(
+			"Copied %d files locally\n",
+			len(diff.Copies)-len(failed),
 		)
-
-		body, err := client.FSRead(
-			ctx, sprite, packResult.Dest,
+		downloads, deletes = copyFallback(
+			diff.Copies, failed, downloads, deletes,
 		)
-		if err != nil {
-			return fmt.Errorf("download: %w", err)
-		}
-		defer body.Close()
+		size = transferSize(downloads, remoteM)
+	}
 
-		count, err := pack.UnpackTar(
-			body, localDir, compress,
+	if len(downloads) == 0 {
+		discardJournals(sess, "pull", sprite, remoteDir, localDir)
+	} else {
+		count, err := pullTars(ctx, c, client, sess,
+			sprite, remoteDir, localDir, downloads, remoteM,
 		)
 		if err != nil {
-			return fmt.Errorf("unpack: %w", err)
+			return err
 		}
 		fmt.Printf(
 			"Transferred %d files (%s)\n",
@@ -149,19 +221,116 @@ func pullAction(c *cli.Context) error {
 	}
 
 	if len(deletes) > 0 {
-		deleted := 0
-		for _, p := range deletes {
-			target := filepath.Join(localDir, p)
-			if err := os.RemoveAll(target); err != nil {
+		files, dirs := pack.DeletePaths(localDir, deletes,
+			deleteOptions(c, backup),
+			func(p string, err error) {
 				slog.Warn("delete failed",
 					"path", p, "err", err,
 				)
+			},
+		)
+		printDeleted(files, dirs)
+	}
+
+	if len(diff.Chmods) > 0 {
+		changed := 0
+		for _, p := range diff.Chmods {
+			if paths.CheckParents(localDir, p) != nil {
+				continue
+			}
+			target := filepath.Join(localDir, p)
+			err := pack.ChmodPath(target, remoteM[p].Mode)
+			if err != nil {
+				slog.Warn("chmod failed",
+					"path", p, "err", err,
+				)
 				continue
 			}
-			deleted++
+			changed++
 		}
-		fmt.Printf("Deleted %d files\n", deleted)
+		fmt.Printf("Updated mode of %d files\n", changed)
 	}
 
 	return nil
 }
+
+// pullTar packs downloads on the sprite and unpacks them into
+// localDir, resuming an interrupted earlier pull when j covers
+// the same files.
+func pullTar(
+	ctx context.Context,
+	c *cli.Context,
+	client *spriteapi.Client,
+	sess *protocol.Session,
+	j *transferJournal,
+	sprite, remoteDir, localDir string,
+	downloads []string,
+	noParents bool,
+	remoteM pack.Manifest,
+	stage *pack.Stage,
+	bar *progressBar,
+) (int, error) {
+	compress := c.Bool("compress")
+	uopts := unpackOptions(c)
+	uopts.Stage = stage
+	backup, err := localBackup(c, localDir)
+	if err != nil {
+		return 0, err
+	}
+	uopts.Backup = backup
+
+	var body io.ReadCloser
+	if j.Size > 0 && j.covers(downloads, remoteM, compress) {
+		var err error
+		body, err = openDownload(ctx, client, sprite, j)
+		switch {
+		case err == nil:
+			uopts.Only = downloads
+		case spriteapi.IsNotFound(err):
+			slog.Debug("remote tarball is gone, starting over")
+		default:
+			return 0, fmt.Errorf("download: %w", err)
+		}
+	}
+
+	if body == nil {
+		j.discard(sess)
+		j.reset(downloads, remoteM, compress)
+		packResult, err := sess.PackToWith(
+			remoteDir, j.Paths, j.Remote, protocol.PackOptions{
+				Compress:  compress,
+				CopyLinks: c.Bool("copy-links"),
+				NoParents: noParents,
+			},
+		)
+		if err != nil {
+			return 0, fmt.Errorf("remote pack: %w", err)
+		}
+		slog.Debug("packed",
+			"dest", packResult.Dest,
+			"size", packResult.Size,
+			"count", packResult.Count,
+		)
+		j.Size = packResult.Size
+		j.save()
+
+		body, err = openDownload(ctx, client, sprite, j)
+		if err != nil {
+			return 0, fmt.Errorf("download: %w", err)
+		}
+	}
+
+	uopts.Progress = bar.Add
+	count, err := pack.UnpackTarWith(body, localDir, uopts)
+	body.Close()
+	if err != nil {
+		// A tarball that arrived whole and still fails to unpack
+		// would fail the same way on resume.
+		if j.complete() {
+			j.discard(sess)
+		}
+		return count, fmt.Errorf("unpack: %w", err)
+	}
+	j.discard(sess)
+	return count, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/protocol"
+	"github.com/tqbf/sprync/pkg/spriteapi"
+)
+
+// pullWatch holds what pull --watch knows of both trees between
+// pulls, so each pull only rescans the paths that changed.
+type pullWatch struct {
+	c         *cli.Context
+	client    *spriteapi.Client
+	sess      *protocol.Session
+	sprite    string
+	remoteDir string
+	localDir  string
+
+	remoteM pack.Manifest
+	localM  pack.Manifest
+}
+
+// watchRemote pulls changes as the sprite reports them through
+// /fs/watch, and polls with full rescans when it can't.
+func watchRemote(ctx context.Context, w *pullWatch) error {
+	c := w.c
+	fsw, err := w.client.FSWatch(
+		ctx, w.sprite, []string{w.remoteDir}, true,
+	)
+	if err == nil {
+		fmt.Printf(
+			"Watching %s:%s -> %s (Ctrl-C to stop)\n",
+			w.sprite, w.remoteDir, w.localDir,
+		)
+		changes := make(chan string, 256)
+		errc := make(chan error, 1)
+		go func() {
+			errc <- forwardEvents(ctx, fsw, w.remoteDir, changes)
+		}()
+		err = debounce(ctx, c.Duration("debounce"), changes, errc,
+			func(changed []string) error {
+				return w.update(ctx, changed)
+			},
+		)
+		fsw.Close()
+		if err == nil {
+			return nil
+		}
+	}
+
+	fmt.Fprintf(os.Stderr,
+		"remote watch unavailable (%v), polling every %s\n",
+		err, c.Duration("poll"),
+	)
+	ticker := time.NewTicker(c.Duration("poll"))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if err := w.update(ctx, nil); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+	}
+}
+
+// forwardEvents sends the path of each event below dir, relative
+// to it, until the watch fails or ctx is done.
+func forwardEvents(
+	ctx context.Context,
+	fsw *spriteapi.FSWatcher,
+	dir string,
+	changes chan<- string,
+) error {
+	for {
+		ev, err := fsw.Next(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		rel, ok := remoteRel(dir, ev.Path)
+		if !ok || pack.IsTempName(path.Base(rel)) {
+			continue
+		}
+		select {
+		case changes <- rel:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// remoteRel returns p relative to dir, or "" for dir itself.
+func remoteRel(dir, p string) (string, bool) {
+	dir, p = path.Clean(dir), path.Clean(p)
+	if p == dir {
+		return "", true
+	}
+	return strings.CutPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// update rescans the changed paths on the sprite, or everything
+// when changed is nil, and pulls the difference.
+func (w *pullWatch) update(
+	ctx context.Context, changed []string,
+) error {
+	opts := walkOptions(w.c)
+	opts.Only = narrowOnly(changed, opts.Only)
+	remote, err := w.sess.ManifestWith(w.remoteDir, opts)
+	if err != nil {
+		return fmt.Errorf("remote manifest: %w", err)
+	}
+	if !remote.Exists {
+		return fmt.Errorf(
+			"remote directory %s does not exist", w.remoteDir,
+		)
+	}
+	if changed == nil {
+		w.remoteM = entriesToManifest(remote.Entries)
+	} else {
+		set := make(map[string]bool, len(opts.Only))
+		for _, p := range opts.Only {
+			set[p] = true
+		}
+		for p := range w.remoteM {
+			if underAny(p, set, true) {
+				delete(w.remoteM, p)
+			}
+		}
+		for _, e := range remote.Entries {
+			w.remoteM[e.Path] = e
+		}
+	}
+
+	diff := pack.ComputeDiffWith(
+		w.remoteM, w.localM, diffOptions(w.c),
+	)
+	if diff.Empty() {
+		return nil
+	}
+	fmt.Printf("[%s] %s\n",
+		time.Now().Format("15:04:05"), summarize(diff, w.remoteM, w.localM),
+	)
+	printChanges(diff, w.remoteM, w.localM)
+	if w.c.Bool("dry-run") {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, w.c.Duration("timeout"))
+	defer cancel()
+	err = applyPull(ctx, w.c, w.client, w.sess,
+		w.sprite, w.remoteDir, w.localDir,
+		diff, w.remoteM, w.localM,
+	)
+	if err != nil {
+		return err
+	}
+	return settleLocal(w.c, w.localDir, w.localM, w.remoteM, diff)
+}
+
+// settleLocal updates localM to what localDir holds once diff,
+// pulled from remoteM, has been applied, reading back the
+// deletes that were kept.
+func settleLocal(
+	c *cli.Context,
+	localDir string,
+	localM, remoteM pack.Manifest,
+	diff pack.DiffResult,
+) error {
+	applyDiff(localM, remoteM, diff)
+	if len(diff.Deletes) == 0 {
+		return nil
+	}
+	opts := targetWalkOptions(c)
+	opts.Only = diff.Deletes
+	kept, err := pack.BuildManifest(localDir, opts)
+	if err != nil {
+		return fmt.Errorf("walk local: %w", err)
+	}
+	maps.Copy(localM, kept)
+	return nil
+}
@@ -1,15 +1,16 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"log/slog"
 	"sort"
-	"strings"
 
 	"github.com/urfave/cli/v2"
 
 	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/protocol"
+	"github.com/tqbf/sprync/pkg/spriteapi"
 )
 
 func pushCmd() *cli.Command {
@@ -17,38 +18,35 @@ func pushCmd() *cli.Command {
 		Name:  "push",
 		Usage: "push directory to sprite",
 		ArgsUsage: "<localDir|sprite:dir>" +
-			" <sprite:dir>",
+			" <sprite:dir> | <target>",
 		Flags:  syncFlags(),
 		Action: pushAction,
 	}
 }
 
 func pushAction(c *cli.Context) error {
-	if c.NArg() != 2 {
-		return fmt.Errorf(
-			"usage: sprync push <src> <sprite:dir>",
-		)
-	}
-
-	srcSprite, srcDir, srcErr := parseTarget(
-		c.Args().Get(0),
-	)
-	dstSprite, dstDir, err := parseTarget(
-		c.Args().Get(1),
+	t, src, dst, err := targetArgs(c,
+		"sprync push <src> <sprite:dir> | <target>", false,
 	)
 	if err != nil {
 		return err
 	}
 
-	if srcErr == nil {
-		return spriteToSpritePush(c,
-			srcSprite, srcDir,
-			dstSprite, dstDir,
-		)
+	srcSprite, srcDir, srcErr := parseTarget(src)
+	dstSprite, dstDir, err := parseTarget(dst)
+	if err != nil {
+		return err
 	}
-	return localToSpritePush(c,
-		c.Args().Get(0), dstSprite, dstDir,
-	)
+
+	return t.runHooks(c, func() error {
+		if srcErr == nil {
+			return spriteToSpritePush(c,
+				srcSprite, srcDir,
+				dstSprite, dstDir,
+			)
+		}
+		return localToSpritePush(c, src, dstSprite, dstDir)
+	})
 }
 
 func localToSpritePush(
@@ -64,11 +62,8 @@ func localToSpritePush(
 	defer cancel()
 
 	var (
-		client   = newClient(c, token)
-		excludes = c.StringSlice("exclude")
-		compress = c.Bool("compress")
-		deleteOn = c.Bool("delete")
-		dryRun   = c.Bool("dry-run")
+		client = newClient(c, token)
+		dryRun = c.Bool("dry-run")
 	)
 
 	sess, err := openSession(ctx, client, sprite)
@@ -77,21 +72,23 @@ func localToSpritePush(
 	}
 	defer sess.Close(ctx)
 
-	entries, exists, elapsed, err := sess.Manifest(
-		remoteDir, excludes,
+	remote, err := remoteManifest(
+		c, sess, remoteDir, targetWalkOptions(c),
 	)
 	if err != nil {
 		return fmt.Errorf("remote manifest: %w", err)
 	}
 	slog.Debug("remote manifest",
-		"count", len(entries),
-		"exists", exists,
-		"elapsed", elapsed,
+		"count", len(remote.Entries),
+		"exists", remote.Exists,
+		"elapsed", remote.Elapsed,
+		"cache_hits", remote.CacheHits,
+		"cache_misses", remote.CacheMisses,
 	)
 
-	remoteM := entriesToManifest(entries)
+	remoteM := entriesToManifest(remote.Entries)
 
-	localM, err := pack.WalkLocal(localDir, excludes)
+	localM, err := localManifest(c, localDir)
 	if err != nil {
 		return fmt.Errorf("walk local: %w", err)
 	}
@@ -99,85 +96,133 @@ func localToSpritePush(
 		"count", len(localM),
 	)
 
-	var uploads, deletes []string
-	if !exists {
+	var diff pack.DiffResult
+	if !remote.Exists {
 		for p := range localM {
-			uploads = append(uploads, p)
+			diff.Uploads = append(diff.Uploads, p)
 		}
-		sort.Strings(uploads)
+		sort.Strings(diff.Uploads)
 	} else {
-		diff := pack.ComputeDiff(
-			localM, remoteM, deleteOn,
+		diff = pack.ComputeDiffWith(
+			localM, remoteM, diffOptions(c),
 		)
-		uploads = diff.Uploads
-		deletes = diff.Deletes
 	}
 
-	if len(uploads) == 0 && len(deletes) == 0 {
+	if diff.Empty() {
+		discardJournals(sess, "push", sprite, remoteDir, localDir)
 		fmt.Println("Already in sync.")
 		return nil
 	}
 
 	tag := ""
-	if !exists {
+	if !remote.Exists {
 		tag = " (new)"
 	}
 	fmt.Printf(
 		"Pushing to %s:%s%s\n", sprite, remoteDir, tag,
 	)
-	printChanges(uploads, deletes, localM, remoteM)
-
-	var b strings.Builder
-	size := transferSize(uploads, localM)
-	fmt.Fprintf(&b,
-		"%d to transfer (%s)",
-		len(uploads), humanBytes(size),
-	)
-	if len(deletes) > 0 {
-		fmt.Fprintf(&b, ", %d to delete", len(deletes))
-	}
-	fmt.Fprintf(&b, "\n")
-	fmt.Print(b.String())
+	printChanges(diff, localM, remoteM)
+	fmt.Println(summarize(diff, localM, remoteM))
 
 	if dryRun {
 		return nil
 	}
+	return applyPush(ctx, c, client, sess,
+		sprite, localDir, remoteDir, diff, localM, remoteM,
+	)
+}
 
-	if len(uploads) > 0 {
-		var buf bytes.Buffer
-		_, err := pack.PackTar(
-			localDir, uploads, &buf, compress,
+// applyPush makes remoteDir match diff, computed from localM
+// against remoteM: copies on the sprite, then delta patches,
+// then tarballs, then deletes and mode changes.
+func applyPush(
+	ctx context.Context,
+	c *cli.Context,
+	client *spriteapi.Client,
+	sess *protocol.Session,
+	sprite, localDir, remoteDir string,
+	diff pack.DiffResult,
+	localM, remoteM pack.Manifest,
+) error {
+	err := checkDeletes(c, diff, localM, remoteM,
+		sprite+":"+remoteDir,
+	)
+	if err != nil {
+		return err
+	}
+	uploads, deletes := diff.Uploads, diff.Deletes
+	size := transferSize(uploads, localM)
+
+	if len(diff.Copies) > 0 {
+		result, err := sess.CopyWith(
+			remoteDir, diff.Copies, c.Bool("times"),
+			remoteBackup(c),
 		)
 		if err != nil {
-			return fmt.Errorf("pack: %w", err)
+			return fmt.Errorf("copy: %w", err)
 		}
+		fmt.Printf("Copied %d files on sprite\n", result.Count)
+		uploads, deletes = copyFallback(
+			diff.Copies, result.Failed, uploads, deletes,
+		)
+		size = transferSize(uploads, localM)
+	}
 
-		dest := remoteTmpPath(compress)
-		err = client.FSWrite(
-			ctx, sprite, dest, "", false, &buf,
+	// With --delay-updates the patched files wait in a stage
+	// to go in place with the tarballs.
+	var held []string
+	candidates := deltaCandidates(c, uploads, localM, remoteM)
+	if len(candidates) > 0 {
+		if c.Bool("delay-updates") {
+			held = []string{remoteTmpFile(".stage")}
+		}
+		patched, err := pushDelta(ctx, c, client, sess,
+			sprite, localDir, remoteDir, candidates, localM,
+			stageFor(held, 0),
 		)
 		if err != nil {
-			return fmt.Errorf("upload: %w", err)
+			return fmt.Errorf("delta: %w", err)
 		}
+		uploads = without(uploads, patched)
+		size = transferSize(uploads, localM)
+	}
 
-		result, err := sess.Extract(
-			remoteDir, dest, compress,
+	if len(uploads) == 0 {
+		if err := commitStages(sess, held, nil); err != nil {
+			return err
+		}
+		discardJournals(sess, "push", sprite, remoteDir, localDir)
+	} else {
+		count, err := pushTars(ctx, c, client, sess,
+			sprite, localDir, remoteDir, uploads, localM, held,
 		)
 		if err != nil {
-			return fmt.Errorf("extract: %w", err)
+			return commitStages(sess, held, err)
 		}
 		fmt.Printf(
 			"Transferred %d files (%s)\n",
-			result.Count, humanBytes(size),
+			count, humanBytes(size),
 		)
 	}
 
 	if len(deletes) > 0 {
-		result, err := sess.Delete(remoteDir, deletes)
+		result, err := sess.DeleteWith(
+			remoteDir, deletes, deleteOptions(c, remoteBackup(c)),
+		)
 		if err != nil {
 			return fmt.Errorf("delete: %w", err)
 		}
-		fmt.Printf("Deleted %d files\n", result.Count)
+		printDeleted(result.Count, result.Dirs)
+	}
+
+	if len(diff.Chmods) > 0 {
+		result, err := sess.Chmod(
+			remoteDir, chmodModes(diff.Chmods, localM),
+		)
+		if err != nil {
+			return fmt.Errorf("chmod: %w", err)
+		}
+		fmt.Printf("Updated mode of %d files\n", result.Count)
 	}
 
 	return nil
@@ -196,11 +241,9 @@ func spriteToSpritePush(
 	defer cancel()
 
 	var (
-		client   = newClient(c, token)
-		excludes = c.StringSlice("exclude")
-		compress = c.Bool("compress")
-		deleteOn = c.Bool("delete")
-		dryRun   = c.Bool("dry-run")
+		client = newClient(c, token)
+		opts   = walkOptions(c)
+		dryRun = c.Bool("dry-run")
 	)
 
 	srcSess, err := openSession(ctx, client, srcSprite)
@@ -215,49 +258,48 @@ func spriteToSpritePush(
 	}
 	defer dstSess.Close(ctx)
 
-	srcEntries, srcExists, _, err := srcSess.Manifest(
-		srcDir, excludes,
+	src, err := remoteManifest(
+		c, srcSess, srcDir, opts,
 	)
 	if err != nil {
 		return fmt.Errorf("src manifest: %w", err)
 	}
-	if !srcExists {
+	if !src.Exists {
 		return fmt.Errorf(
 			"source %s:%s does not exist",
 			srcSprite, srcDir,
 		)
 	}
-	srcM := entriesToManifest(srcEntries)
+	srcM := entriesToManifest(src.Entries)
 
-	dstEntries, dstExists, _, err := dstSess.Manifest(
-		dstDir, excludes,
+	dst, err := remoteManifest(
+		c, dstSess, dstDir, targetWalkOptions(c),
 	)
 	if err != nil {
 		return fmt.Errorf("dst manifest: %w", err)
 	}
-	dstM := entriesToManifest(dstEntries)
+	dstM := entriesToManifest(dst.Entries)
 
-	var uploads, deletes []string
-	if !dstExists {
+	var diff pack.DiffResult
+	if !dst.Exists {
 		for p := range srcM {
-			uploads = append(uploads, p)
+			diff.Uploads = append(diff.Uploads, p)
 		}
-		sort.Strings(uploads)
+		sort.Strings(diff.Uploads)
 	} else {
-		diff := pack.ComputeDiff(
-			srcM, dstM, deleteOn,
+		diff = pack.ComputeDiffWith(
+			srcM, dstM, diffOptions(c),
 		)
-		uploads = diff.Uploads
-		deletes = diff.Deletes
 	}
+	uploads, deletes := diff.Uploads, diff.Deletes
 
-	if len(uploads) == 0 && len(deletes) == 0 {
+	if diff.Empty() {
 		fmt.Println("Already in sync.")
 		return nil
 	}
 
 	tag := ""
-	if !dstExists {
+	if !dst.Exists {
 		tag = " (new)"
 	}
 	fmt.Printf(
@@ -265,56 +307,63 @@ func spriteToSpritePush(
 		srcSprite, srcDir,
 		dstSprite, dstDir, tag,
 	)
-	printChanges(uploads, deletes, srcM, dstM)
-
-	var b strings.Builder
-	size := transferSize(uploads, srcM)
-	fmt.Fprintf(&b,
-		"%d to transfer (%s)",
-		len(uploads), humanBytes(size),
-	)
-	if len(deletes) > 0 {
-		fmt.Fprintf(&b, ", %d to delete", len(deletes))
-	}
-	fmt.Fprintf(&b, "\n")
-	fmt.Print(b.String())
+	printChanges(diff, srcM, dstM)
+	fmt.Println(summarize(diff, srcM, dstM))
 
 	if dryRun {
 		return nil
 	}
+	err = checkDeletes(c, diff, srcM, dstM, dstSprite+":"+dstDir)
+	if err != nil {
+		return err
+	}
 
-	if len(uploads) > 0 {
-		dest := remoteTmpPath(compress)
-		destURL := client.FSWriteURL(
-			dstSprite, dest, "", false,
-		)
-
-		result, err := srcSess.Transfer(
-			srcDir, uploads, compress,
-			destURL, token,
+	if len(diff.Copies) > 0 {
+		result, err := dstSess.CopyWith(
+			dstDir, diff.Copies, c.Bool("times"),
+			remoteBackup(c),
 		)
 		if err != nil {
-			return fmt.Errorf("transfer: %w", err)
+			return fmt.Errorf("copy: %w", err)
 		}
+		fmt.Printf("Copied %d files on sprite\n", result.Count)
+		uploads, deletes = copyFallback(
+			diff.Copies, result.Failed, uploads, deletes,
+		)
+	}
 
-		_, err = dstSess.Extract(
-			dstDir, dest, compress,
+	if len(uploads) > 0 {
+		count, sent, err := transferTars(ctx, c, client, token,
+			srcSess, dstSess, srcDir, dstSprite, dstDir,
+			uploads, srcM,
 		)
 		if err != nil {
-			return fmt.Errorf("extract: %w", err)
+			return err
 		}
 		fmt.Printf(
 			"Transferred %d files (%s)\n",
-			result.Count, humanBytes(result.Size),
+			count, humanBytes(sent),
 		)
 	}
 
 	if len(deletes) > 0 {
-		result, err := dstSess.Delete(dstDir, deletes)
+		result, err := dstSess.DeleteWith(
+			dstDir, deletes, deleteOptions(c, remoteBackup(c)),
+		)
 		if err != nil {
 			return fmt.Errorf("delete: %w", err)
 		}
-		fmt.Printf("Deleted %d files\n", result.Count)
+		printDeleted(result.Count, result.Dirs)
+	}
+
+	if len(diff.Chmods) > 0 {
+		result, err := dstSess.Chmod(
+			dstDir, chmodModes(diff.Chmods, srcM),
+		)
+		if err != nil {
+			return fmt.Errorf("chmod: %w", err)
+		}
+		fmt.Printf("Updated mode of %d files\n", result.Count)
 	}
 
 	return nil
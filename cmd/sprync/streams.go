@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/protocol"
+	"github.com/tqbf/sprync/pkg/spriteapi"
+)
+
+// planStreams splits paths into the groups --streams sends in
+// parallel and the directories sent after them, so that a
+// directory's mode is applied once everything inside it has been
+// written. The groups then leave out their parents' headers.
+// With a single stream, everything is in one group.
+func planStreams(
+	c *cli.Context, paths []string, m pack.Manifest,
+) ([][]string, []string) {
+	if c.Int("streams") <= 1 {
+		return [][]string{paths}, nil
+	}
+	var files, dirs []string
+	for _, p := range paths {
+		if m[p].Dir {
+			dirs = append(dirs, p)
+		} else {
+			files = append(files, p)
+		}
+	}
+	groups := splitBySize(files, m, c.Int("streams"))
+	if len(groups) <= 1 {
+		return [][]string{paths}, nil
+	}
+	return groups, dirs
+}
+
+// splitBySize deals paths into at most n groups of roughly equal
+// total size, placing the largest files first.
+func splitBySize(
+	paths []string, m pack.Manifest, n int,
+) [][]string {
+	n = min(n, len(paths))
+	if n <= 1 {
+		return [][]string{paths}
+	}
+	sorted := append([]string(nil), paths...)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return m[sorted[a]].Size > m[sorted[b]].Size
+	})
+
+	groups := make([][]string, n)
+	totals := make([]int64, n)
+	for _, p := range sorted {
+		best := 0
+		for i := 1; i < n; i++ {
+			if totals[i] < totals[best] ||
+				totals[i] == totals[best] &&
+					len(groups[i]) < len(groups[best]) {
+				best = i
+			}
+		}
+		groups[best] = append(groups[best], p)
+		totals[best] += m[p].Size
+	}
+	for _, g := range groups {
+		sort.Strings(g)
+	}
+	return groups
+}
+
+// remoteStages returns a stage file for each of n extracts,
+// followed by held, the stages of earlier steps, that
+// --delay-updates must put in place together. It returns nil
+// when a single extract can do so itself.
+func remoteStages(c *cli.Context, n int, held ...string) []string {
+	if !c.Bool("delay-updates") || n+len(held) <= 1 {
+		return nil
+	}
+	stages := make([]string, n, n+len(held))
+	for i := range stages {
+		stages[i] = remoteTmpFile(".stage")
+	}
+	return append(stages, held...)
+}
+
+func stageFor(stages []string, i int) string {
+	if stages == nil {
+		return ""
+	}
+	return stages[i]
+}
+
+// commitStages puts the files staged by every extract in place,
+// or removes them when err says an extract failed.
+func commitStages(
+	sess *protocol.Session, stages []string, err error,
+) error {
+	switch {
+	case stages == nil:
+		return err
+	case err != nil:
+		sess.Commit(stages, true)
+		return err
+	}
+	if _, err := sess.Commit(stages, false); err != nil {
+		return fmt.Errorf("commit: %w", err)
+	}
+	return nil
+}
+
+// forkSessions returns sess followed by n-1 forks of it. The
+// returned func closes the forks.
+func forkSessions(
+	ctx context.Context, sess *protocol.Session, n int,
+) ([]*protocol.Session, func(), error) {
+	sessions := []*protocol.Session{sess}
+	closeForks := func() {
+		for _, s := range sessions[1:] {
+			s.Close(ctx)
+		}
+	}
+	for len(sessions) < n {
+		fork, err := sess.Fork(ctx)
+		if err != nil {
+			closeForks()
+			return nil, nil, fmt.Errorf("open stream: %w", err)
+		}
+		sessions = append(sessions, fork)
+	}
+	return sessions, closeForks, nil
+}
+
+// parallel runs fn(0) through fn(n-1) concurrently and returns
+// the first error by index.
+func parallel(n int, fn func(i int) error) error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func streamKind(kind string, i, n int) string {
+	if n == 1 {
+		return kind
+	}
+	return fmt.Sprintf("%s.%d", kind, i+1)
+}
+
+// discardJournals clears the journals of every stream of an
+// earlier transfer, once nothing is left for them to resume.
+func discardJournals(
+	sess *protocol.Session,
+	kind, sprite, remoteDir, localDir string,
+) {
+	openJournal(kind, sprite, remoteDir, localDir).discard(sess)
+	for i := 1; ; i++ {
+		j := openJournal(
+			fmt.Sprintf("%s.%d", kind, i),
+			sprite, remoteDir, localDir,
+		)
+		if j.Remote == "" {
+			return
+		}
+		j.discard(sess)
+	}
+}
+
+// pushTars uploads paths from localDir and extracts them into
+// remoteDir over --streams parallel tarballs. It returns the
+// number of files extracted. With --delay-updates no file is put
+// in place until every tarball has extracted, and then the files
+// of held, the stages of earlier steps, go in with them.
+func pushTars(
+	ctx context.Context,
+	c *cli.Context,
+	client *spriteapi.Client,
+	sess *protocol.Session,
+	sprite, localDir, remoteDir string,
+	paths []string,
+	localM pack.Manifest,
+	held []string,
+) (int, error) {
+	groups, dirs := planStreams(c, paths, localM)
+	sessions, closeForks, err := forkSessions(ctx, sess, len(groups))
+	if err != nil {
+		return 0, err
+	}
+	defer closeForks()
+
+	journals := make([]*transferJournal, len(groups))
+	for i := range groups {
+		journals[i] = openJournal(
+			streamKind("push", i, len(groups)),
+			sprite, remoteDir, localDir,
+		)
+	}
+
+	files := countFiles(paths, localM)
+	size := transferSize(paths, localM)
+	only := make([][]string, len(groups))
+	bar := newProgress(c, "uploading", files, size)
+	err = parallel(len(groups), func(i int) error {
+		var err error
+		only[i], err = uploadTar(ctx, c, client, sessions[i],
+			journals[i], sprite, localDir, groups[i],
+			len(dirs) > 0, localM, bar,
+		)
+		return err
+	})
+	bar.Done()
+	if err != nil {
+		return 0, err
+	}
+
+	extracts := len(groups)
+	if len(dirs) > 0 {
+		extracts++
+	}
+	stages := remoteStages(c, extracts, held...)
+	counts := make([]int, len(groups))
+	bar = newProgress(c, "extracting", files, size)
+	err = parallel(len(groups), func(i int) error {
+		var err error
+		counts[i], err = extractTar(c, sessions[i],
+			remoteDir, journals[i].Remote, only[i],
+			stageFor(stages, i), bar,
+		)
+		if err == nil {
+			journals[i].discard(sessions[i])
+		}
+		return err
+	})
+	bar.Done()
+	if err != nil {
+		return 0, commitStages(sess, stages, err)
+	}
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if len(dirs) > 0 {
+		j := openJournal("push", sprite, remoteDir, localDir)
+		only, err := uploadTar(ctx, c, client, sess,
+			j, sprite, localDir, dirs, false, localM,
+			newProgress(c, "uploading", 0, 0),
+		)
+		if err != nil {
+			return total, commitStages(sess, stages, err)
+		}
+		n, err := extractTar(c, sess, remoteDir, j.Remote, only,
+			stageFor(stages, len(groups)),
+			newProgress(c, "extracting", 0, 0),
+		)
+		if err != nil {
+			return total, commitStages(sess, stages, err)
+		}
+		total += n
+	}
+	if err := commitStages(sess, stages, nil); err != nil {
+		return 0, err
+	}
+	discardJournals(sess, "push", sprite, remoteDir, localDir)
+	return total, nil
+}
+
+// uploadTar packs paths and uploads them in chunks that spryncd
+// joins into j.Remote, reusing whatever an earlier attempt
+// recorded in j. When resuming, it returns the paths still to be
+// extracted; otherwise it returns nil, meaning all of them.
+func uploadTar(
+	ctx context.Context,
+	c *cli.Context,
+	client *spriteapi.Client,
+	sess *protocol.Session,
+	j *transferJournal,
+	sprite, localDir string,
+	paths []string,
+	noParents bool,
+	localM pack.Manifest,
+	bar *progressBar,
+) ([]string, error) {
+	compress := c.Bool("compress")
+	packPaths, only := paths, []string(nil)
+	if j.covers(paths, localM, compress) {
+		slog.Debug("resuming push", "chunks", len(j.Chunks))
+		packPaths, only = j.Paths, paths
+	} else {
+		j.discard(sess)
+		j.reset(paths, localM, compress)
+	}
+
+	parts, sent, err := uploadChunks(ctx, client, sprite, j,
+		func(w io.Writer) error {
+			_, err := pack.PackTarWith(
+				localDir, packPaths, w, pack.PackOptions{
+					Compress:  compress,
+					CopyLinks: c.Bool("copy-links"),
+					NoParents: noParents,
+					Progress:  bar.Add,
+				},
+			)
+			if err != nil {
+				return fmt.Errorf("pack: %w", err)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("uploaded", "chunks", len(parts), "sent", sent)
+	if _, err := sess.Concat(j.Remote, parts); err != nil {
+		return nil, fmt.Errorf("concat: %w", err)
+	}
+	return only, nil
+}
+
+// extractTar extracts src into dir on the sprite, leaving the
+// files in stage, if set, for commitStages.
+func extractTar(
+	c *cli.Context,
+	sess *protocol.Session,
+	dir, src string,
+	only []string,
+	stage string,
+	bar *progressBar,
+) (int, error) {
+	opts := unpackOptions(c)
+	opts.Only = only
+	opts.Backup = remoteBackup(c)
+	stop := watchSession(sess, bar)
+	result, err := sess.ExtractStaged(dir, src, stage, opts)
+	stop()
+	if err != nil {
+		return 0, fmt.Errorf("extract: %w", err)
+	}
+	return result.Count, nil
+}
+
+// pullTars downloads paths from remoteDir into localDir over
+// --streams parallel tarballs. It returns the number of files
+// unpacked. With --delay-updates no file is put in place until
+// every tarball has unpacked.
+func pullTars(
+	ctx context.Context,
+	c *cli.Context,
+	client *spriteapi.Client,
+	sess *protocol.Session,
+	sprite, remoteDir, localDir string,
+	paths []string,
+	remoteM pack.Manifest,
+) (int, error) {
+	groups, dirs := planStreams(c, paths, remoteM)
+	sessions, closeForks, err := forkSessions(ctx, sess, len(groups))
+	if err != nil {
+		return 0, err
+	}
+	defer closeForks()
+
+	var stage *pack.Stage
+	if c.Bool("delay-updates") {
+		stage = pack.NewStage()
+		defer stage.Abort()
+	}
+
+	counts := make([]int, len(groups))
+	bar := newProgress(c, "downloading",
+		countFiles(paths, remoteM),
+		transferSize(paths, remoteM),
+	)
+	err = parallel(len(groups), func(i int) error {
+		j := openJournal(
+			streamKind("pull", i, len(groups)),
+			sprite, remoteDir, localDir,
+		)
+		var err error
+		counts[i], err = pullTar(ctx, c, client, sessions[i], j,
+			sprite, remoteDir, localDir, groups[i],
+			len(dirs) > 0, remoteM, stage, bar,
+		)
+		return err
+	})
+	bar.Done()
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	if len(dirs) > 0 {
+		j := openJournal("pull", sprite, remoteDir, localDir)
+		n, err := pullTar(ctx, c, client, sess, j,
+			sprite, remoteDir, localDir, dirs, false, remoteM,
+			stage, bar,
+		)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	if stage != nil {
+		if err := stage.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	discardJournals(sess, "pull", sprite, remoteDir, localDir)
+	return total, nil
+}
+
+// transferTars sends paths from one sprite straight to another
+// over --streams parallel tarballs. It returns the number of
+// files extracted and the bytes sent.
+func transferTars(
+	ctx context.Context,
+	c *cli.Context,
+	client *spriteapi.Client,
+	token string,
+	srcSess, dstSess *protocol.Session,
+	srcDir, dstSprite, dstDir string,
+	paths []string,
+	srcM pack.Manifest,
+) (int, int64, error) {
+	groups, dirs := planStreams(c, paths, srcM)
+	if len(dirs) > 0 {
+		groups = append(groups, dirs)
+	}
+	srcs, closeSrcs, err := forkSessions(ctx, srcSess, len(groups))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer closeSrcs()
+	dsts, closeDsts, err := forkSessions(ctx, dstSess, len(groups))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer closeDsts()
+
+	// The directory group, if any, is last and only extracted
+	// once the others are done.
+	n := len(groups)
+	if len(dirs) > 0 {
+		n--
+	}
+
+	// Each stream's spryncd uploads on its own, so they share
+	// --bwlimit between them.
+	limit := client.Limiter.Rate()
+	if limit > 0 {
+		limit = max(limit/int64(len(groups)), 1)
+	}
+
+	files := countFiles(paths, srcM)
+	size := transferSize(paths, srcM)
+	dests := make([]string, len(groups))
+	sizes := make([]int64, len(groups))
+	bar := newProgress(c, "transferring", files, size)
+	err = parallel(len(groups), func(i int) error {
+		dests[i] = remoteTmpPath(c.Bool("compress"))
+		destURL := client.FSWriteURL(dstSprite, dests[i], "", false)
+		stop := watchSession(srcs[i], bar)
+		result, err := srcs[i].TransferWith(
+			srcDir, groups[i], destURL, token,
+			protocol.TransferOptions{
+				Compress:  c.Bool("compress"),
+				CopyLinks: c.Bool("copy-links"),
+				BWLimit:   limit,
+				NoParents: len(dirs) > 0 && i < n,
+			},
+		)
+		stop()
+		if err != nil {
+			return fmt.Errorf("transfer: %w", err)
+		}
+		sizes[i] = result.Size
+		return nil
+	})
+	bar.Done()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	stages := remoteStages(c, len(groups))
+	counts := make([]int, len(groups))
+	bar = newProgress(c, "extracting", files, size)
+	err = parallel(n, func(i int) error {
+		var err error
+		counts[i], err = extractTar(c, dsts[i], dstDir,
+			dests[i], nil, stageFor(stages, i), bar,
+		)
+		return err
+	})
+	if err == nil && n < len(groups) {
+		counts[n], err = extractTar(c, dsts[n], dstDir,
+			dests[n], nil, stageFor(stages, n), bar,
+		)
+	}
+	bar.Done()
+	if err := commitStages(dstSess, stages, err); err != nil {
+		return 0, 0, err
+	}
+
+	total, sent := 0, int64(0)
+	for i := range groups {
+		total += counts[i]
+		sent += sizes[i]
+	}
+	return total, sent, nil
+}
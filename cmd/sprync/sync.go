@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/protocol"
+)
+
+const baseVersion = 1
+
+func syncCmd() *cli.Command {
+	var flags []cli.Flag
+	for _, f := range syncFlags() {
+		// The base tells deletions apart from files the other
+		// side never had, so sync always carries them over.
+		switch f.Names()[0] {
+		case "delete", "delete-excluded":
+		default:
+			flags = append(flags, f)
+		}
+	}
+	return &cli.Command{
+		Name:      "sync",
+		Usage:     "sync changes both ways with a sprite",
+		ArgsUsage: "<localDir> <sprite:dir> | <target>",
+		Flags: append(flags, &cli.StringFlag{
+			Name:  "prefer",
+			Usage: "resolve conflicts: local, remote or newer",
+			Action: func(_ *cli.Context, v string) error {
+				switch v {
+				case pack.PreferLocal, pack.PreferRemote,
+					pack.PreferNewer:
+					return nil
+				}
+				return fmt.Errorf(
+					"--prefer must be local, remote or newer",
+				)
+			},
+		}),
+		Action: syncAction,
+	}
+}
+
+// syncBase is the manifest both sides agreed on after the last
+// sync, kept in the cache dir.
+type syncBase struct {
+	Version int                  `json:"version"`
+	Entries []pack.ManifestEntry `json:"entries"`
+}
+
+func loadBase(path string) pack.Manifest {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return make(pack.Manifest)
+	}
+	var saved syncBase
+	if err := json.Unmarshal(data, &saved); err != nil ||
+		saved.Version != baseVersion {
+		slog.Debug("ignoring sync base", "path", path, "err", err)
+		return make(pack.Manifest)
+	}
+	return entriesToManifest(saved.Entries)
+}
+
+func saveBase(path string, m pack.Manifest) error {
+	saved := syncBase{Version: baseVersion}
+	for _, e := range m {
+		saved.Entries = append(saved.Entries, e)
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+func syncAction(c *cli.Context) error {
+	t, localDir, dst, err := targetArgs(c,
+		"sprync sync <localDir> <sprite:dir> | <target>", false,
+	)
+	if err != nil {
+		return err
+	}
+	sprite, remoteDir, err := parseTarget(dst)
+	if err != nil {
+		return err
+	}
+	return t.runHooks(c, func() error {
+		return syncDirs(c, localDir, sprite, remoteDir)
+	})
+}
+
+func syncDirs(
+	c *cli.Context, localDir, sprite, remoteDir string,
+) error {
+	token, err := requireToken(c, sprite)
+	if err != nil {
+		return err
+	}
+	basePath, err := cacheFile(
+		"bases", "sync", sprite, remoteDir, localDir,
+	)
+	if err != nil {
+		return fmt.Errorf("sync base: %w", err)
+	}
+
+	ctx, cancel := contextWithTimeout(c)
+	defer cancel()
+
+	client := newClient(c, token)
+	sess, err := openSession(ctx, client, sprite)
+	if err != nil {
+		return err
+	}
+	defer sess.Close(ctx)
+
+	remote, err := remoteManifest(
+		c, sess, remoteDir, walkOptions(c),
+	)
+	if err != nil {
+		return fmt.Errorf("remote manifest: %w", err)
+	}
+	remoteM := entriesToManifest(remote.Entries)
+
+	localM, err := localManifest(c, localDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("walk local: %w", err)
+	}
+	base := loadBase(basePath)
+	if localM == nil || !remote.Exists {
+		// A missing side was not emptied file by file; start
+		// over rather than delete everything on the other.
+		base = make(pack.Manifest)
+	}
+	if localM == nil {
+		localM = make(pack.Manifest)
+	}
+
+	result := pack.ComputeSync(base, localM, remoteM,
+		pack.SyncOptions{
+			Times:   c.Bool("times"),
+			Renames: c.Bool("renames"),
+			Prefer:  c.String("prefer"),
+			Protect: c.StringSlice("protect"),
+		},
+	)
+	localCopies, remoteCopies := keepConflicts(
+		&result, localM, remoteM,
+	)
+	printSync(result, localM, remoteM, sprite, remoteDir)
+	if c.Bool("dry-run") {
+		return nil
+	}
+
+	err = saveConflicts(c, sess, localDir, remoteDir,
+		localCopies, remoteCopies,
+	)
+	if err != nil {
+		return err
+	}
+	if !result.Pull.Empty() {
+		err := applyPull(ctx, c, client, sess,
+			sprite, remoteDir, localDir,
+			result.Pull, remoteM, localM,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if !result.Push.Empty() {
+		err := applyPush(ctx, c, client, sess,
+			sprite, localDir, remoteDir,
+			result.Push, localM, remoteM,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	localF, remoteF := maps.Clone(localM), maps.Clone(remoteM)
+	applyDiff(localF, remoteM, result.Pull)
+	applyDiff(remoteF, localM, result.Push)
+	next := pack.SyncBase(base, localF, remoteF, c.Bool("times"))
+	if err := saveBase(basePath, next); err != nil {
+		return fmt.Errorf("save sync base: %w", err)
+	}
+
+	unresolved := 0
+	for _, cf := range result.Conflicts {
+		if cf.Winner == "" {
+			unresolved++
+		}
+	}
+	if unresolved > 0 {
+		return fmt.Errorf(
+			"%d conflicts left alone; resolve them by hand "+
+				"or rerun with --prefer", unresolved,
+		)
+	}
+	return nil
+}
+
+// keepConflicts plans the conflict copies of resolved conflicts:
+// each is made on the losing side, then sent to the other like
+// any new file. It adds them to the manifests and result.
+func keepConflicts(
+	result *pack.SyncResult,
+	localM, remoteM pack.Manifest,
+) (local, remote []pack.Copy) {
+	for _, cf := range result.Conflicts {
+		if cf.Backup == "" {
+			continue
+		}
+		from, d := localM, &result.Push
+		if cf.Winner == pack.PreferLocal {
+			from, d = remoteM, &result.Pull
+		}
+		e := from[cf.Path]
+		cp := pack.Copy{
+			From:  cf.Path,
+			To:    cf.Backup,
+			Mode:  e.Mode,
+			MTime: e.MTime,
+		}
+		e.Path = cf.Backup
+		from[cf.Backup] = e
+		d.Uploads = append(d.Uploads, cf.Backup)
+		if cf.Winner == pack.PreferLocal {
+			remote = append(remote, cp)
+		} else {
+			local = append(local, cp)
+		}
+	}
+	return local, remote
+}
+
+func saveConflicts(
+	c *cli.Context,
+	sess *protocol.Session,
+	localDir, remoteDir string,
+	local, remote []pack.Copy,
+) error {
+	for _, cp := range local {
+		err := pack.CopyPath(localDir, cp, c.Bool("times"))
+		if err != nil {
+			return fmt.Errorf("keep %s: %w", cp.To, err)
+		}
+	}
+	if len(remote) == 0 {
+		return nil
+	}
+	result, err := sess.Copy(remoteDir, remote, c.Bool("times"))
+	if err != nil {
+		return fmt.Errorf("keep conflict copies: %w", err)
+	}
+	if len(result.Failed) > 0 {
+		return fmt.Errorf(
+			"keep conflict copies on sprite: %s",
+			strings.Join(result.Failed, ", "),
+		)
+	}
+	return nil
+}
+
+func printSync(
+	result pack.SyncResult,
+	localM, remoteM pack.Manifest,
+	sprite, remoteDir string,
+) {
+	if result.Push.Empty() && result.Pull.Empty() &&
+		len(result.Conflicts) == 0 {
+		fmt.Println("Already in sync.")
+		return
+	}
+	if !result.Push.Empty() {
+		fmt.Printf("Pushing to %s:%s\n", sprite, remoteDir)
+		printChanges(result.Push, localM, remoteM)
+		fmt.Println(summarize(result.Push, localM, remoteM))
+	}
+	if !result.Pull.Empty() {
+		fmt.Printf("Pulling from %s:%s\n", sprite, remoteDir)
+		printChanges(result.Pull, remoteM, localM)
+		fmt.Println(summarize(result.Pull, remoteM, localM))
+	}
+	if len(result.Conflicts) == 0 {
+		return
+	}
+	fmt.Println("Conflicts:")
+	for _, cf := range result.Conflicts {
+		loser := pack.PreferRemote
+		if cf.Winner == pack.PreferRemote {
+			loser = pack.PreferLocal
+		}
+		switch {
+		case cf.Winner == "":
+			fmt.Printf("  ! %s (changed on both sides)\n", cf.Path)
+		case cf.Backup == "":
+			fmt.Printf("  ! %s (kept %s)\n", cf.Path, cf.Winner)
+		default:
+			fmt.Printf(
+				"  ! %s (kept %s, %s version saved as %s)\n",
+				cf.Path, cf.Winner, loser, cf.Backup,
+			)
+		}
+	}
+}
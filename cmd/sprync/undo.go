@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/tqbf/sprync/pkg/config"
+	"github.com/tqbf/sprync/pkg/pack"
+)
+
+// backupName names the backup set of this run of sprync. Every
+// transfer it makes shares the set, so undo reverts them
+// together.
+var backupName = pack.NewBackupName(time.Now())
+
+func backupFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.BoolFlag{
+			Name:  "backup",
+			Usage: "keep replaced and deleted files for undo",
+		},
+		&cli.StringFlag{
+			Name:  "backup-dir",
+			Usage: "keep backups under this dir (implies --backup)",
+		},
+	}
+}
+
+func undoCmd() *cli.Command {
+	return &cli.Command{
+		Name:      "undo",
+		Usage:     "restore the files the last --backup run replaced",
+		ArgsUsage: "<localDir|sprite:dir|target>",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "backup-dir",
+				Usage: "dir the backups were kept under",
+			},
+			&cli.BoolFlag{
+				Name:  "list",
+				Usage: "list backups instead of restoring one",
+			},
+		},
+		Action: undoAction,
+	}
+}
+
+// remoteBackup returns the backup set for changes made on a
+// sprite, or nil without --backup. spryncd picks the root
+// unless --backup-dir gives one.
+func remoteBackup(c *cli.Context) *pack.Backup {
+	if !c.Bool("backup") && c.String("backup-dir") == "" {
+		return nil
+	}
+	return &pack.Backup{
+		Root: c.String("backup-dir"),
+		Name: backupName,
+	}
+}
+
+// localBackup returns the backup set for changes made in dir.
+func localBackup(
+	c *cli.Context, dir string,
+) (*pack.Backup, error) {
+	b := remoteBackup(c)
+	if b == nil {
+		return nil, nil
+	}
+	root, err := localBackupRoot(c, dir)
+	if err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	b.Root = root
+	return b, nil
+}
+
+func localBackupRoot(c *cli.Context, dir string) (string, error) {
+	if root := c.String("backup-dir"); root != "" {
+		return filepath.Abs(root)
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return pack.BackupRootIn(filepath.Join(base, "sprync"), dir)
+}
+
+// undoSide is one dir undo may restore, with the backup sets
+// kept for it.
+type undoSide struct {
+	spec    string
+	names   []string
+	restore func(name string) (int, error)
+}
+
+func undoAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return fmt.Errorf(
+			"usage: sprync undo <localDir|sprite:dir|target>",
+		)
+	}
+	specs, err := undoDirs(c, c.Args().First())
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := contextWithTimeout(c)
+	defer cancel()
+
+	var sides []undoSide
+	for _, spec := range specs {
+		sprite, dir, err := parseTarget(spec)
+		if err != nil {
+			root, err := localBackupRoot(c, spec)
+			if err != nil {
+				return fmt.Errorf("backup: %w", err)
+			}
+			names, err := pack.ListBackups(root)
+			if err != nil {
+				return fmt.Errorf("backups: %w", err)
+			}
+			sides = append(sides, undoSide{
+				spec:  spec,
+				names: names,
+				restore: func(name string) (int, error) {
+					b := pack.Backup{Root: root, Name: name}
+					return b.Restore(spec)
+				},
+			})
+			continue
+		}
+
+		token, err := requireToken(c, sprite)
+		if err != nil {
+			return err
+		}
+		sess, err := openSession(ctx, newClient(c, token), sprite)
+		if err != nil {
+			return err
+		}
+		defer sess.Close(ctx)
+		root := c.String("backup-dir")
+		names, err := sess.Backups(dir, root)
+		if err != nil {
+			return fmt.Errorf("backups: %w", err)
+		}
+		sides = append(sides, undoSide{
+			spec:  spec,
+			names: names,
+			restore: func(name string) (int, error) {
+				result, err := sess.Restore(dir, pack.Backup{
+					Root: root, Name: name,
+				})
+				if err != nil {
+					return 0, err
+				}
+				return result.Count, nil
+			},
+		})
+	}
+
+	if c.Bool("list") {
+		for _, s := range sides {
+			fmt.Printf("%s:\n", s.spec)
+			for _, name := range s.names {
+				fmt.Printf("  %s\n", name)
+			}
+		}
+		return nil
+	}
+
+	// Sides changed by the same run share its backup name, so
+	// undoing a sync restores both.
+	latest := ""
+	for _, s := range sides {
+		if n := len(s.names); n > 0 && s.names[n-1] > latest {
+			latest = s.names[n-1]
+		}
+	}
+	if latest == "" {
+		return fmt.Errorf("no backup of %s", c.Args().First())
+	}
+	for _, s := range sides {
+		if n := len(s.names); n == 0 || s.names[n-1] != latest {
+			continue
+		}
+		count, err := s.restore(latest)
+		if err != nil {
+			return fmt.Errorf("restore %s: %w", s.spec, err)
+		}
+		fmt.Printf(
+			"Restored %d files in %s from backup %s\n",
+			count, s.spec, latest,
+		)
+	}
+	return nil
+}
+
+// undoDirs returns the dirs arg names: a sprite dir, both sides
+// of a target in the config, or else a local dir.
+func undoDirs(c *cli.Context, arg string) ([]string, error) {
+	if strings.Contains(arg, ":") {
+		return []string{arg}, nil
+	}
+	cfg, err := loadConfig(c)
+	switch {
+	case errors.Is(err, config.ErrNotFound):
+	case err != nil:
+		return nil, fmt.Errorf("config: %w", err)
+	default:
+		if t, ok := cfg.Targets[arg]; ok {
+			return []string{t.Source, t.Destination}, nil
+		}
+	}
+	return []string{arg}, nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tqbf/sprync/pkg/spriteapi"
+)
+
+// uploadStream runs write in its own goroutine and streams what
+// it produces to dest on the sprite, so memory use does not grow
+// with the size of the upload. It returns the bytes sent.
+func uploadStream(
+	ctx context.Context,
+	client *spriteapi.Client,
+	sprite, dest string,
+	write func(io.Writer) error,
+) (int64, error) {
+	pr, pw := io.Pipe()
+	ch := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		pw.CloseWithError(err)
+		ch <- err
+	}()
+
+	cr := &countingReader{r: pr}
+	uploadErr := client.FSWrite(ctx, sprite, dest, "", false, cr)
+	pr.CloseWithError(uploadErr)
+	writeErr := <-ch
+
+	if uploadErr != nil &&
+		(writeErr == nil || errors.Is(writeErr, uploadErr)) {
+		return cr.n, fmt.Errorf("upload: %w", uploadErr)
+	}
+	return cr.n, writeErr
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+const chunkSize = 8 << 20
+
+// uploadChunks streams what write produces to the sprite in
+// chunkSize pieces named after j.Remote, recording each in the
+// journal. Chunks matching the journal were uploaded by an earlier
+// attempt and are skipped. It returns the remote chunk paths in
+// order and the bytes sent.
+func uploadChunks(
+	ctx context.Context,
+	client *spriteapi.Client,
+	sprite string,
+	j *transferJournal,
+	write func(io.Writer) error,
+) ([]string, int64, error) {
+	pr, pw := io.Pipe()
+	ch := make(chan error, 1)
+	go func() {
+		err := write(pw)
+		pw.CloseWithError(err)
+		ch <- err
+	}()
+
+	parts, sent, uploadErr := sendChunks(ctx, client, sprite, j, pr)
+	pr.CloseWithError(uploadErr)
+	writeErr := <-ch
+
+	if uploadErr != nil &&
+		(writeErr == nil || errors.Is(writeErr, uploadErr)) {
+		return nil, sent, uploadErr
+	}
+	return parts, sent, writeErr
+}
+
+func sendChunks(
+	ctx context.Context,
+	client *spriteapi.Client,
+	sprite string,
+	j *transferJournal,
+	r io.Reader,
+) ([]string, int64, error) {
+	buf := make([]byte, chunkSize)
+	var parts []string
+	var sent int64
+	for i := 0; ; i++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return parts, sent, err
+		}
+		last := err == io.ErrUnexpectedEOF
+
+		sum := sha256.Sum256(buf[:n])
+		hash := hex.EncodeToString(sum[:])
+		part := j.chunkPath(i)
+		parts = append(parts, part)
+		if i < len(j.Chunks) && j.Chunks[i] == hash {
+			if last {
+				break
+			}
+			continue
+		}
+
+		j.Chunks = j.Chunks[:min(i, len(j.Chunks))]
+		err = client.FSWrite(
+			ctx, sprite, part, "", false, bytes.NewReader(buf[:n]),
+		)
+		if err != nil {
+			return parts, sent, fmt.Errorf("upload: %w", err)
+		}
+		sent += int64(n)
+		j.Chunks = append(j.Chunks, hash)
+		j.save()
+		if last {
+			break
+		}
+	}
+	return parts, sent, nil
+}
+
+// openDownload streams the journal's remote tarball. Bytes saved
+// by an earlier attempt are replayed from the local part file and
+// only the rest is fetched, with new bytes appended to the file.
+func openDownload(
+	ctx context.Context,
+	client *spriteapi.Client,
+	sprite string,
+	j *transferJournal,
+) (io.ReadCloser, error) {
+	partPath := j.partPath()
+	if partPath == "" {
+		return client.FSRead(ctx, sprite, j.Remote)
+	}
+	err := os.MkdirAll(filepath.Dir(partPath), 0755)
+	if err != nil {
+		return nil, err
+	}
+	part, err := os.OpenFile(partPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := part.Stat()
+	if err != nil {
+		part.Close()
+		return nil, err
+	}
+
+	offset := info.Size()
+	if offset > j.Size {
+		offset = 0
+	}
+	body := io.NopCloser(strings.NewReader(""))
+	if offset < j.Size {
+		body, offset, err = client.FSReadFrom(
+			ctx, sprite, j.Remote, offset,
+		)
+		if err != nil {
+			part.Close()
+			return nil, err
+		}
+	}
+	if offset > 0 {
+		slog.Debug("resuming download", "offset", offset)
+	}
+
+	if err := part.Truncate(offset); err != nil {
+		body.Close()
+		part.Close()
+		return nil, err
+	}
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		body.Close()
+		part.Close()
+		return nil, err
+	}
+	return &download{
+		Reader: io.MultiReader(
+			io.NewSectionReader(part, 0, offset),
+			io.TeeReader(body, part),
+		),
+		body: body,
+		part: part,
+	}, nil
+}
+
+type download struct {
+	io.Reader
+	body io.Closer
+	part *os.File
+}
+
+func (d *download) Close() error {
+	d.body.Close()
+	return d.part.Close()
+}
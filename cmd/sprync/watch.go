@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/protocol"
+	"github.com/tqbf/sprync/pkg/spriteapi"
+)
+
+const watchRetry = 5 * time.Second
+
+func watchCmd() *cli.Command {
+	return &cli.Command{
+		Name:      "watch",
+		Usage:     "push local changes to a sprite as they happen",
+		ArgsUsage: "<localDir> <sprite:dir> | <target>",
+		Flags:     append(syncFlags(), debounceFlag(), pollFlag()),
+		Action:    watchAction,
+	}
+}
+
+func debounceFlag() cli.Flag {
+	return &cli.DurationFlag{
+		Name:  "debounce",
+		Value: 300 * time.Millisecond,
+		Usage: "wait for changes to settle before syncing",
+	}
+}
+
+func pollFlag() cli.Flag {
+	return &cli.DurationFlag{
+		Name:  "poll",
+		Value: 2 * time.Second,
+		Usage: "rescan interval when changes cannot be watched",
+	}
+}
+
+// watchContext is done when the user interrupts a watch.
+func watchContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(
+		context.Background(), os.Interrupt, syscall.SIGTERM,
+	)
+}
+
+// pushWatch holds what watch knows of both trees between
+// pushes, so each push only rescans the paths that changed.
+type pushWatch struct {
+	c         *cli.Context
+	client    *spriteapi.Client
+	sess      *protocol.Session
+	sprite    string
+	localDir  string
+	remoteDir string
+
+	localM  pack.Manifest
+	remoteM pack.Manifest
+}
+
+func watchAction(c *cli.Context) error {
+	_, localDir, dst, err := targetArgs(c,
+		"sprync watch <localDir> <sprite:dir> | <target>", false,
+	)
+	if err != nil {
+		return err
+	}
+	sprite, remoteDir, err := parseTarget(dst)
+	if err != nil {
+		return err
+	}
+	token, err := requireToken(c, sprite)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := watchContext()
+	defer stop()
+
+	// Watch before the first scan so that nothing changed
+	// during it is missed.
+	tw, err := newTreeWatcher(localDir, walkOptions(c))
+	if err != nil {
+		fmt.Fprintf(os.Stderr,
+			"local watch unavailable (%v), polling every %s\n",
+			err, c.Duration("poll"),
+		)
+	} else {
+		defer tw.Close()
+	}
+
+	client := newClient(c, token)
+	sess, err := openSession(ctx, client, sprite)
+	if err != nil {
+		return err
+	}
+	defer sess.Close(context.Background())
+
+	w := &pushWatch{
+		c:         c,
+		client:    client,
+		sess:      sess,
+		sprite:    sprite,
+		localDir:  localDir,
+		remoteDir: remoteDir,
+	}
+	if err := w.scan(ctx); err != nil {
+		return err
+	}
+
+	changes := make(chan string, 256)
+	errc := make(chan error, 1)
+	if tw != nil {
+		go func() { errc <- tw.run(ctx, changes) }()
+	} else {
+		go pollTree(ctx, c.Duration("poll"), changes)
+	}
+
+	fmt.Printf(
+		"Watching %s -> %s:%s (Ctrl-C to stop)\n",
+		localDir, sprite, remoteDir,
+	)
+	return debounce(ctx, c.Duration("debounce"), changes, errc,
+		func(changed []string) error {
+			return w.update(ctx, changed)
+		},
+	)
+}
+
+// pollTree asks for a rescan of the whole tree every interval,
+// for when changes cannot be watched.
+func pollTree(
+	ctx context.Context,
+	interval time.Duration,
+	changes chan<- string,
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		select {
+		case changes <- "":
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// debounce collects paths from changes until none arrive for
+// delay, then hands them to fn. A failed fn is retried after
+// watchRetry. It returns when ctx is done or errc yields.
+func debounce(
+	ctx context.Context,
+	delay time.Duration,
+	changes <-chan string,
+	errc <-chan error,
+	fn func(changed []string) error,
+) error {
+	pending := make(map[string]bool)
+	timer := time.NewTimer(delay)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-errc:
+			return err
+		case p := <-changes:
+			pending[p] = true
+			timer.Reset(delay)
+		case <-timer.C:
+			if len(pending) == 0 {
+				continue
+			}
+			if err := fn(collapsePaths(pending)); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				fmt.Fprintf(os.Stderr,
+					"error: %v (retrying in %s)\n", err, watchRetry,
+				)
+				timer.Reset(watchRetry)
+				continue
+			}
+			clear(pending)
+		}
+	}
+}
+
+// collapsePaths returns the changed paths sorted, without those
+// below another changed path. An empty path, meaning the whole
+// tree, collapses to nil.
+func collapsePaths(set map[string]bool) []string {
+	if set[""] {
+		return nil
+	}
+	var out []string
+	for p := range set {
+		if !underAny(p, set, false) {
+			out = append(out, p)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// underAny reports whether p, or with self false one of its
+// parents, is in set.
+func underAny(p string, set map[string]bool, self bool) bool {
+	if self && set[p] {
+		return true
+	}
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		if set[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// narrowOnly limits changed paths to the --files-from list only,
+// if there is one.
+func narrowOnly(changed, only []string) []string {
+	if only == nil {
+		return changed
+	}
+	if changed == nil {
+		return only
+	}
+	set := make(map[string]bool, len(only))
+	for _, p := range only {
+		set[p] = true
+	}
+	out := []string{}
+	for _, p := range changed {
+		if underAny(p, set, true) {
+			out = append(out, p)
+			continue
+		}
+		for _, o := range only {
+			if strings.HasPrefix(o, p+"/") {
+				out = append(out, o)
+			}
+		}
+	}
+	return out
+}
+
+// scan compares both whole trees and pushes the difference.
+func (w *pushWatch) scan(ctx context.Context) error {
+	remote, err := remoteManifest(
+		w.c, w.sess, w.remoteDir, targetWalkOptions(w.c),
+	)
+	if err != nil {
+		return fmt.Errorf("remote manifest: %w", err)
+	}
+	w.remoteM = entriesToManifest(remote.Entries)
+	w.localM, err = localManifest(w.c, w.localDir)
+	if err != nil {
+		return fmt.Errorf("walk local: %w", err)
+	}
+	return w.push(ctx)
+}
+
+// update rescans only the changed paths, or everything when
+// changed is nil, and pushes the difference.
+func (w *pushWatch) update(
+	ctx context.Context, changed []string,
+) error {
+	if changed == nil {
+		m, err := localManifest(w.c, w.localDir)
+		if err != nil {
+			return fmt.Errorf("walk local: %w", err)
+		}
+		w.localM = m
+		return w.push(ctx)
+	}
+
+	opts := walkOptions(w.c)
+	opts.Only = narrowOnly(changed, opts.Only)
+	part, err := pack.BuildManifest(w.localDir, opts)
+	if err != nil {
+		return fmt.Errorf("walk local: %w", err)
+	}
+	set := make(map[string]bool, len(opts.Only))
+	for _, p := range opts.Only {
+		set[p] = true
+	}
+	for p := range w.localM {
+		if underAny(p, set, true) {
+			delete(w.localM, p)
+		}
+	}
+	for p, e := range part {
+		w.localM[p] = e
+	}
+	return w.push(ctx)
+}
+
+func (w *pushWatch) push(ctx context.Context) error {
+	diff := pack.ComputeDiffWith(
+		w.localM, w.remoteM, diffOptions(w.c),
+	)
+	if diff.Empty() {
+		return nil
+	}
+	fmt.Printf("[%s] %s\n",
+		time.Now().Format("15:04:05"), summarize(diff, w.localM, w.remoteM),
+	)
+	printChanges(diff, w.localM, w.remoteM)
+	if w.c.Bool("dry-run") {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, w.c.Duration("timeout"))
+	defer cancel()
+	err := applyPush(ctx, w.c, w.client, w.sess,
+		w.sprite, w.localDir, w.remoteDir,
+		diff, w.localM, w.remoteM,
+	)
+	if err != nil {
+		return err
+	}
+	return w.settle(diff)
+}
+
+// settle updates remoteM to what the sprite holds once diff has
+// been pushed, reading back the deletes spryncd kept, such as
+// dirs that still hold excluded files.
+func (w *pushWatch) settle(diff pack.DiffResult) error {
+	applyDiff(w.remoteM, w.localM, diff)
+	if len(diff.Deletes) == 0 {
+		return nil
+	}
+	opts := targetWalkOptions(w.c)
+	opts.Only = diff.Deletes
+	kept, err := w.sess.ManifestWith(w.remoteDir, opts)
+	if err != nil {
+		return fmt.Errorf("remote manifest: %w", err)
+	}
+	for _, e := range kept.Entries {
+		w.remoteM[e.Path] = e
+	}
+	return nil
+}
+
+// applyDiff updates target to what it holds once diff, computed
+// from source against it, has been carried out. The caller reads
+// back the deletes, since some may have been kept.
+func applyDiff(target, source pack.Manifest, diff pack.DiffResult) {
+	for _, p := range diff.Uploads {
+		target[p] = source[p]
+	}
+	for _, p := range diff.Chmods {
+		target[p] = source[p]
+	}
+	for _, cp := range diff.Copies {
+		target[cp.To] = source[cp.To]
+		if cp.Rename {
+			delete(target, cp.From)
+		}
+	}
+	for _, p := range diff.Deletes {
+		delete(target, p)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -13,12 +14,16 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/tqbf/sprync/pkg/pack"
 	"github.com/tqbf/sprync/pkg/paths"
 	"github.com/tqbf/sprync/pkg/protocol"
+	"github.com/tqbf/sprync/pkg/throttle"
 )
 
 const version = "0.1.0"
@@ -42,13 +47,57 @@ func (s sender) nonFatal(msg string) {
 	})
 }
 
+const progressInterval = 250 * time.Millisecond
+
+// progress batches file and byte counts into periodic
+// TypeProgress responses for clients that asked for them.
+type progress struct {
+	send sender
+	on   bool
+
+	mu    sync.Mutex
+	count int
+	bytes int64
+	last  time.Time
+}
+
+func newProgress(req *protocol.Request, send sender) *progress {
+	return &progress{
+		send: send,
+		on:   req.Progress,
+		last: time.Now(),
+	}
+}
+
+func (p *progress) add(files int, bytes int64) {
+	if !p.on {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.count += files
+	p.bytes += bytes
+	if time.Since(p.last) < progressInterval {
+		return
+	}
+	p.last = time.Now()
+	p.send(protocol.Response{
+		Type:  protocol.TypeProgress,
+		Count: p.count,
+		Size:  p.bytes,
+	})
+}
+
 func main() {
 	slog.SetDefault(slog.New(
 		slog.NewTextHandler(os.Stderr, nil),
 	))
 
 	enc := json.NewEncoder(os.Stdout)
+	var encMu sync.Mutex
 	send := sender(func(resp protocol.Response) {
+		encMu.Lock()
+		defer encMu.Unlock()
 		if err := enc.Encode(resp); err != nil {
 			slog.Error("write response", "err", err)
 			cleanup()
@@ -81,8 +130,26 @@ func main() {
 			handleExtract(req, send)
 		case "delete":
 			handleDelete(req, send)
+		case "chmod":
+			handleChmod(req, send)
+		case "copy":
+			handleCopy(req, send)
+		case "signature":
+			handleSignature(req, send)
+		case "patch":
+			handlePatch(req, send)
 		case "transfer":
 			handleTransfer(req, send)
+		case "concat":
+			handleConcat(req, send)
+		case "discard":
+			handleDiscard(req, send)
+		case "commit":
+			handleCommit(req, send)
+		case "backups":
+			handleBackups(req, send)
+		case "restore":
+			handleRestore(req, send)
 		case "quit":
 			cleanup()
 			os.Exit(0)
@@ -117,54 +184,49 @@ func handleManifest(req *protocol.Request, send sender) {
 		return
 	}
 
-	matcher := paths.NewExcludeMatcher(req.Excludes)
-	count := 0
-	buf := make([]byte, 1<<20)
-
-	walkErr := filepath.WalkDir(
-		req.Dir,
-		func(p string, d fs.DirEntry, err error) error {
-			if err != nil {
-				send.nonFatal(fmt.Sprintf("walk: %s", err))
-				return nil
-			}
-
-			rel, err := filepath.Rel(req.Dir, p)
-			if err != nil {
-				return nil
-			}
-			rel = filepath.ToSlash(rel)
-			if rel == "." {
-				return nil
-			}
+	if err := validatePaths(req.Paths); err != nil {
+		send.fatal(err.Error())
+		return
+	}
 
-			if matcher.Match(rel) {
-				if d.IsDir() {
-					return filepath.SkipDir
-				}
-				return nil
-			}
-			if d.IsDir() || !d.Type().IsRegular() {
-				return nil
-			}
+	opts := pack.WalkOptions{
+		Filters:     req.Filters,
+		Excludes:    req.Excludes,
+		IgnoreFiles: req.IgnoreFiles,
+		CopyLinks:   req.CopyLinks,
+		Only:        req.Paths,
+	}
+	cache := openCache(req.Dir)
+	prog := newProgress(req, send)
+	count := 0
 
-			entry, err := hashFileEntry(p, rel, buf)
-			if err != nil {
-				send.nonFatal(
-					fmt.Sprintf("hash %s: %s", rel, err),
-				)
-				return nil
+	walkErr := walkManifest(req.Dir, opts,
+		func(
+			rel, abs string, info fs.FileInfo, buf []byte,
+		) (fileEntry, error) {
+			return cachedFileEntry(
+				cache, req.Checksum, abs, rel, info, buf,
+			)
+		},
+		func(item manifestItem) {
+			if item.msg != "" {
+				send.nonFatal(item.msg)
+				return
 			}
-
+			entry := item.entry
 			send(protocol.Response{
 				Type: protocol.TypeEntry,
 				Path: entry.path,
 				Hash: entry.hash,
 				Mode: entry.mode,
 				Size: entry.size,
+				Link: entry.link,
+
+				IsDir: entry.dir,
+				MTime: entry.mtime,
 			})
 			count++
-			return nil
+			prog.add(1, entry.size)
 		},
 	)
 
@@ -173,46 +235,224 @@ func handleManifest(req *protocol.Request, send sender) {
 		return
 	}
 
+	var hits, misses int
+	if cache != nil {
+		hits, misses = cache.Stats()
+		if err := cache.Save(); err != nil {
+			slog.Warn("save hash cache", "err", err)
+		}
+	}
+
 	send(protocol.Response{
 		Type:      protocol.TypeManifestDone,
 		Count:     count,
 		Exists:    protocol.BoolPtr(true),
 		ElapsedMs: time.Since(start).Milliseconds(),
+
+		CacheHits:   hits,
+		CacheMisses: misses,
 	})
 }
 
+func stateDir() (string, error) {
+	if d := os.Getenv("SPRYNC_STATE_DIR"); d != "" {
+		return d, nil
+	}
+	if d := os.Getenv("XDG_STATE_HOME"); d != "" {
+		return filepath.Join(d, "sprync"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", "sprync"), nil
+}
+
+func openCache(dir string) *pack.HashCache {
+	state, err := stateDir()
+	if err != nil {
+		slog.Warn("hash cache disabled", "err", err)
+		return nil
+	}
+	path, err := pack.CachePathIn(state, dir)
+	if err != nil {
+		slog.Warn("hash cache disabled", "err", err)
+		return nil
+	}
+	return pack.OpenHashCache(path)
+}
+
+func cachedFileEntry(
+	cache *pack.HashCache,
+	checksum bool,
+	abs, rel string,
+	info fs.FileInfo,
+	buf []byte,
+) (fileEntry, error) {
+	if cache != nil && !checksum {
+		if hash, ok := cache.Lookup(rel, info); ok {
+			return fileEntry{
+				path:  rel,
+				hash:  hash,
+				mode:  int(info.Mode().Perm()),
+				size:  info.Size(),
+				mtime: info.ModTime().Unix(),
+			}, nil
+		}
+	}
+	entry, stat, err := hashFileEntry(abs, rel, buf)
+	if err == nil && cache != nil {
+		cache.Store(rel, stat, entry.hash)
+	}
+	return entry, err
+}
+
+type manifestItem struct {
+	entry fileEntry
+	msg   string
+}
+
+type hashFunc func(
+	rel, abs string, info fs.FileInfo, buf []byte,
+) (fileEntry, error)
+
+type hashJob struct {
+	rel, abs string
+	info     fs.FileInfo
+	out      chan<- manifestItem
+}
+
+// walkManifest hashes files on runtime.NumCPU() workers while
+// the walk continues, but calls emit in walk order from the
+// calling goroutine.
+func walkManifest(
+	dir string,
+	opts pack.WalkOptions,
+	hash hashFunc,
+	emit func(manifestItem),
+) error {
+	workers := runtime.NumCPU()
+	jobs := make(chan hashJob, workers)
+	order := make(chan chan manifestItem, 64*workers)
+
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 1<<20)
+			for j := range jobs {
+				entry, err := hash(j.rel, j.abs, j.info, buf)
+				if err != nil {
+					j.out <- manifestItem{
+						msg: fmt.Sprintf("hash %s: %s", j.rel, err),
+					}
+					continue
+				}
+				j.out <- manifestItem{entry: entry}
+			}
+		}()
+	}
+
+	var walkErr error
+	go func() {
+		defer close(order)
+		defer close(jobs)
+		walkErr = pack.WalkTree(dir, opts,
+			func(rel, abs string, info fs.FileInfo, err error) error {
+				out := make(chan manifestItem, 1)
+				order <- out
+				if err != nil {
+					out <- manifestItem{
+						msg: fmt.Sprintf("walk: %s", err),
+					}
+					return nil
+				}
+
+				switch {
+				case info.IsDir():
+					out <- manifestItem{entry: fileEntry{
+						path:  rel,
+						mode:  int(info.Mode().Perm()),
+						dir:   true,
+						mtime: info.ModTime().Unix(),
+					}}
+				case info.Mode()&fs.ModeSymlink != 0:
+					entry, err := linkEntry(abs, rel, info)
+					if err != nil {
+						out <- manifestItem{
+							msg: fmt.Sprintf("hash %s: %s", rel, err),
+						}
+						return nil
+					}
+					out <- manifestItem{entry: entry}
+				default:
+					jobs <- hashJob{rel, abs, info, out}
+				}
+				return nil
+			},
+		)
+	}()
+
+	for out := range order {
+		emit(<-out)
+	}
+	wg.Wait()
+	return walkErr
+}
+
 type fileEntry struct {
 	path string
 	hash string
 	mode int
 	size int64
+	link string
+	dir  bool
+
+	mtime int64
+}
+
+func linkEntry(
+	absPath, relPath string, info fs.FileInfo,
+) (fileEntry, error) {
+	target, err := os.Readlink(absPath)
+	if err != nil {
+		return fileEntry{}, err
+	}
+	return fileEntry{
+		path:  relPath,
+		mode:  int(info.Mode().Perm()),
+		link:  target,
+		mtime: info.ModTime().Unix(),
+	}, nil
 }
 
 func hashFileEntry(
 	absPath, relPath string, buf []byte,
-) (fileEntry, error) {
+) (fileEntry, fs.FileInfo, error) {
 	f, err := os.Open(absPath)
 	if err != nil {
-		return fileEntry{}, err
+		return fileEntry{}, nil, err
 	}
 	defer f.Close()
 
 	info, err := f.Stat()
 	if err != nil {
-		return fileEntry{}, err
+		return fileEntry{}, nil, err
 	}
 
 	h := sha256.New()
 	if _, err := io.CopyBuffer(h, f, buf); err != nil {
-		return fileEntry{}, err
+		return fileEntry{}, nil, err
 	}
 
 	return fileEntry{
-		path: relPath,
-		hash: hex.EncodeToString(h.Sum(nil)),
-		mode: int(info.Mode().Perm()),
-		size: info.Size(),
-	}, nil
+		path:  relPath,
+		hash:  hex.EncodeToString(h.Sum(nil)),
+		mode:  int(info.Mode().Perm()),
+		size:  info.Size(),
+		mtime: info.ModTime().Unix(),
+	}, info, nil
 }
 
 func handlePack(req *protocol.Request, send sender) {
@@ -239,7 +479,9 @@ func handlePack(req *protocol.Request, send sender) {
 		}
 	}
 
-	trackedFiles = append(trackedFiles, req.Dest)
+	if !req.Keep {
+		trackedFiles = append(trackedFiles, req.Dest)
+	}
 
 	f, err := os.Create(req.Dest)
 	if err != nil {
@@ -247,8 +489,12 @@ func handlePack(req *protocol.Request, send sender) {
 		return
 	}
 
-	count, err := pack.PackTar(
-		req.Dir, req.Paths, f, req.Compress,
+	count, err := pack.PackTarWith(
+		req.Dir, req.Paths, f, pack.PackOptions{
+			Compress:  req.Compress,
+			CopyLinks: req.CopyLinks,
+			NoParents: req.NoParents,
+		},
 	)
 	f.Close()
 	if err != nil {
@@ -280,6 +526,20 @@ func handleExtract(req *protocol.Request, send sender) {
 		send.fatal("src must be under /tmp/")
 		return
 	}
+	if err := validatePaths(req.Paths); err != nil {
+		send.fatal(err.Error())
+		return
+	}
+	if req.Stage != "" && !validTmpPath(req.Stage) {
+		send.fatal("stage must be under /tmp/")
+		return
+	}
+
+	backup, err := requestBackup(req)
+	if err != nil {
+		send.fatal(err.Error())
+		return
+	}
 
 	f, err := os.Open(req.Src)
 	if err != nil {
@@ -287,9 +547,38 @@ func handleExtract(req *protocol.Request, send sender) {
 		return
 	}
 
-	count, err := pack.UnpackTar(f, req.Dir, req.Compress)
+	opts := pack.UnpackOptions{
+		Compress:     req.Compress,
+		Times:        req.Times,
+		Progress:     newProgress(req, send).add,
+		Only:         req.Paths,
+		DelayUpdates: req.DelayUpdates,
+		Backup:       backup,
+	}
+	if req.Delete {
+		opts.Delete = &pack.DeleteOptions{
+			Protect: req.Protect,
+			Exclude: paths.MatchOptions{
+				Filters:     req.Filters,
+				Excludes:    req.Excludes,
+				IgnoreFiles: req.IgnoreFiles,
+			},
+			DeleteExcluded: req.DeleteExcluded,
+		}
+	}
+	if req.Stage != "" {
+		opts.Stage = pack.NewStage()
+	}
+	count, err := pack.UnpackTarWith(f, req.Dir, opts)
 	f.Close()
+	if err == nil && opts.Stage != nil {
+		trackedFiles = append(trackedFiles, req.Stage)
+		err = opts.Stage.Save(req.Stage)
+	}
 	if err != nil {
+		if opts.Stage != nil {
+			opts.Stage.Abort()
+		}
 		send.fatal(fmt.Sprintf("extract: %s", err))
 		return
 	}
@@ -302,6 +591,106 @@ func handleExtract(req *protocol.Request, send sender) {
 	})
 }
 
+func handleSignature(req *protocol.Request, send sender) {
+	if err := validateDir(req.Dir); err != nil {
+		send.fatal(err.Error())
+		return
+	}
+	if err := validatePaths(req.Paths); err != nil {
+		send.fatal(err.Error())
+		return
+	}
+	if !validTmpPath(req.Dest) {
+		send.fatal("dest must be under /tmp/")
+		return
+	}
+
+	trackedFiles = append(trackedFiles, req.Dest)
+
+	f, err := os.Create(req.Dest)
+	if err != nil {
+		send.fatal(fmt.Sprintf("create dest: %s", err))
+		return
+	}
+
+	count, err := pack.WriteSignatures(req.Dir, req.Paths, f)
+	f.Close()
+	if err != nil {
+		os.Remove(req.Dest)
+		send.fatal(fmt.Sprintf("signature: %s", err))
+		return
+	}
+
+	info, err := os.Stat(req.Dest)
+	if err != nil {
+		send.fatal(fmt.Sprintf("stat dest: %s", err))
+		return
+	}
+
+	send(protocol.Response{
+		Type:  protocol.TypeSignatureDone,
+		Dest:  req.Dest,
+		Size:  info.Size(),
+		Count: count,
+	})
+}
+
+func handlePatch(req *protocol.Request, send sender) {
+	if err := validateDir(req.Dir); err != nil {
+		send.fatal(err.Error())
+		return
+	}
+	if !validTmpPath(req.Src) {
+		send.fatal("src must be under /tmp/")
+		return
+	}
+	if req.Stage != "" && !validTmpPath(req.Stage) {
+		send.fatal("stage must be under /tmp/")
+		return
+	}
+	backup, err := requestBackup(req)
+	if err != nil {
+		send.fatal(err.Error())
+		return
+	}
+
+	f, err := os.Open(req.Src)
+	if err != nil {
+		send.fatal(fmt.Sprintf("open src: %s", err))
+		return
+	}
+
+	opts := pack.UnpackOptions{
+		Compress:     req.Compress,
+		Times:        req.Times,
+		DelayUpdates: req.DelayUpdates,
+		Backup:       backup,
+	}
+	if req.Stage != "" {
+		opts.Stage = pack.NewStage()
+	}
+	count, failed, err := pack.ApplyDelta(f, req.Dir, opts)
+	f.Close()
+	os.Remove(req.Src)
+	if err == nil && opts.Stage != nil {
+		trackedFiles = append(trackedFiles, req.Stage)
+		err = opts.Stage.Save(req.Stage)
+	}
+	if err != nil {
+		if opts.Stage != nil {
+			opts.Stage.Abort()
+		}
+		send.fatal(fmt.Sprintf("patch: %s", err))
+		return
+	}
+
+	send(protocol.Response{
+		Type:   protocol.TypePatchDone,
+		Count:  count,
+		Failed: failed,
+	})
+}
+
 func handleDelete(req *protocol.Request, send sender) {
 	if err := validateDir(req.Dir); err != nil {
 		send.fatal(err.Error())
@@ -318,13 +707,68 @@ func handleDelete(req *protocol.Request, send sender) {
 			return
 		}
 	}
+	backup, err := requestBackup(req)
+	if err != nil {
+		send.fatal(err.Error())
+		return
+	}
+
+	opts := pack.DeleteOptions{
+		Backup:  backup,
+		Protect: req.Protect,
+		Exclude: paths.MatchOptions{
+			Filters:     req.Filters,
+			Excludes:    req.Excludes,
+			IgnoreFiles: req.IgnoreFiles,
+		},
+		DeleteExcluded: req.DeleteExcluded,
+	}
+	files, dirs := pack.DeletePaths(req.Dir, req.Paths, opts,
+		func(p string, err error) {
+			send.nonFatal(
+				fmt.Sprintf("delete %s: %s", p, err),
+			)
+		},
+	)
+
+	send(protocol.Response{
+		Type:  protocol.TypeDeleteDone,
+		Count: files,
+		Dirs:  dirs,
+	})
+}
+
+func handleChmod(req *protocol.Request, send sender) {
+	if err := validateDir(req.Dir); err != nil {
+		send.fatal(err.Error())
+		return
+	}
+	pathList := make([]string, 0, len(req.Modes))
+	for p := range req.Modes {
+		pathList = append(pathList, p)
+	}
+	sort.Strings(pathList)
+	if err := validatePaths(pathList); err != nil {
+		send.fatal(err.Error())
+		return
+	}
+	for _, p := range pathList {
+		full := filepath.Join(req.Dir, p)
+		if !paths.IsWithinDir(req.Dir, full) {
+			send.fatal(fmt.Sprintf("path escapes dir: %s", p))
+			return
+		}
+	}
 
 	count := 0
-	for _, p := range req.Paths {
+	for _, p := range pathList {
+		if paths.CheckParents(req.Dir, p) != nil {
+			continue
+		}
 		full := filepath.Join(req.Dir, p)
-		if err := os.RemoveAll(full); err != nil {
+		if err := pack.ChmodPath(full, req.Modes[p]); err != nil {
 			send.nonFatal(
-				fmt.Sprintf("delete %s: %s", p, err),
+				fmt.Sprintf("chmod %s: %s", p, err),
 			)
 			continue
 		}
@@ -332,7 +776,241 @@ func handleDelete(req *protocol.Request, send sender) {
 	}
 
 	send(protocol.Response{
-		Type:  protocol.TypeDeleteDone,
+		Type:  protocol.TypeChmodDone,
+		Count: count,
+	})
+}
+
+func handleCopy(req *protocol.Request, send sender) {
+	if err := validateDir(req.Dir); err != nil {
+		send.fatal(err.Error())
+		return
+	}
+	copies := make([]pack.Copy, 0, len(req.Copies))
+	for _, op := range req.Copies {
+		for _, p := range []string{op.From, op.To} {
+			if err := paths.ValidateRelPath(p); err != nil {
+				send.fatal(fmt.Sprintf("invalid path: %s", err))
+				return
+			}
+			full := filepath.Join(req.Dir, p)
+			if !paths.IsWithinDir(req.Dir, full) {
+				send.fatal(fmt.Sprintf("path escapes dir: %s", p))
+				return
+			}
+		}
+		copies = append(copies, pack.Copy{
+			From:   op.From,
+			To:     op.To,
+			Mode:   op.Mode,
+			MTime:  op.MTime,
+			Rename: op.Rename,
+		})
+	}
+	backup, err := requestBackup(req)
+	if err != nil {
+		send.fatal(err.Error())
+		return
+	}
+
+	count := 0
+	var failed []string
+	for _, c := range pack.CopyOrder(copies) {
+		err := backup.SaveCopy(req.Dir, c)
+		if err == nil {
+			err = pack.CopyPath(req.Dir, c, req.Times)
+		}
+		if err != nil {
+			send.nonFatal(
+				fmt.Sprintf("copy %s: %s", c.To, err),
+			)
+			failed = append(failed, c.To)
+			continue
+		}
+		count++
+	}
+
+	send(protocol.Response{
+		Type:   protocol.TypeCopyDone,
+		Count:  count,
+		Failed: failed,
+	})
+}
+
+func handleConcat(req *protocol.Request, send sender) {
+	if !validTmpPath(req.Dest) {
+		send.fatal("dest must be under /tmp/")
+		return
+	}
+	for _, p := range req.Paths {
+		if !validTmpPath(p) {
+			send.fatal("parts must be under /tmp/")
+			return
+		}
+	}
+
+	f, err := os.Create(req.Dest)
+	if err != nil {
+		send.fatal(fmt.Sprintf("create dest: %s", err))
+		return
+	}
+	var size int64
+	for _, p := range req.Paths {
+		n, err := appendFile(f, p)
+		size += n
+		if err != nil {
+			f.Close()
+			os.Remove(req.Dest)
+			send.fatal(fmt.Sprintf("concat %s: %s", p, err))
+			return
+		}
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(req.Dest)
+		send.fatal(fmt.Sprintf("concat: %s", err))
+		return
+	}
+
+	send(protocol.Response{
+		Type: protocol.TypeConcatDone,
+		Dest: req.Dest,
+		Size: size,
+	})
+}
+
+func appendFile(w io.Writer, path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+func handleDiscard(req *protocol.Request, send sender) {
+	count := 0
+	for _, p := range req.Paths {
+		if !validTmpPath(p) {
+			send.nonFatal(fmt.Sprintf("not under /tmp/: %s", p))
+			continue
+		}
+		err := os.Remove(p)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			send.nonFatal(fmt.Sprintf("discard %s: %s", p, err))
+			continue
+		}
+		if err == nil {
+			count++
+		}
+	}
+
+	send(protocol.Response{
+		Type:  protocol.TypeDiscardDone,
+		Count: count,
+	})
+}
+
+// handleCommit puts the files staged by earlier extracts, maybe
+// in other sessions, in place all together, or removes them.
+func handleCommit(req *protocol.Request, send sender) {
+	stage := pack.NewStage()
+	for _, p := range req.Paths {
+		if !validTmpPath(p) {
+			send.fatal(fmt.Sprintf("not under /tmp/: %s", p))
+			return
+		}
+		err := stage.Load(p)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			stage.Abort()
+			send.fatal(fmt.Sprintf("commit: %s", err))
+			return
+		}
+		os.Remove(p)
+	}
+
+	count := stage.Len()
+	if req.Abort {
+		stage.Abort()
+		count = 0
+	} else if err := stage.Commit(); err != nil {
+		send.fatal(fmt.Sprintf("commit: %s", err))
+		return
+	}
+	send(protocol.Response{
+		Type:  protocol.TypeCommitDone,
+		Count: count,
+	})
+}
+
+// backupRoot returns the root a request names for backups of
+// req.Dir, by default one under the state dir.
+func backupRoot(req *protocol.Request) (string, error) {
+	if req.Dir == "" {
+		return "", fmt.Errorf("missing dir")
+	}
+	if req.Backup.Root != "" {
+		return req.Backup.Root, nil
+	}
+	state, err := stateDir()
+	if err != nil {
+		return "", fmt.Errorf("backup: %w", err)
+	}
+	return pack.BackupRootIn(state, req.Dir)
+}
+
+// requestBackup returns the backup set a request names, if any.
+func requestBackup(req *protocol.Request) (*pack.Backup, error) {
+	if req.Backup == nil {
+		return nil, nil
+	}
+	root, err := backupRoot(req)
+	if err != nil {
+		return nil, err
+	}
+	b := &pack.Backup{Root: root, Name: req.Backup.Name}
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func handleBackups(req *protocol.Request, send sender) {
+	if req.Backup == nil {
+		req.Backup = &pack.Backup{}
+	}
+	root, err := backupRoot(req)
+	if err != nil {
+		send.fatal(err.Error())
+		return
+	}
+	names, err := pack.ListBackups(root)
+	if err != nil {
+		send.fatal(fmt.Sprintf("backups: %s", err))
+		return
+	}
+	send(protocol.Response{
+		Type:  protocol.TypeBackups,
+		Names: names,
+	})
+}
+
+func handleRestore(req *protocol.Request, send sender) {
+	backup, err := requestBackup(req)
+	if err != nil {
+		send.fatal(err.Error())
+		return
+	}
+	if backup == nil {
+		send.fatal("missing backup")
+		return
+	}
+	count, err := backup.Restore(req.Dir)
+	if err != nil {
+		send.fatal(fmt.Sprintf("restore: %s", err))
+		return
+	}
+	send(protocol.Response{
+		Type:  protocol.TypeRestoreDone,
 		Count: count,
 	})
 }
@@ -361,7 +1039,8 @@ func validatePaths(pathList []string) error {
 }
 
 func validTmpPath(p string) bool {
-	return p != "" && strings.HasPrefix(p, "/tmp/")
+	return p != "" && filepath.Clean(p) == p &&
+		strings.HasPrefix(p, "/tmp/")
 }
 
 func handleTransfer(
@@ -401,15 +1080,22 @@ func handleTransfer(
 	}
 	ch := make(chan packResult, 1)
 
+	prog := newProgress(req, send)
 	go func() {
-		count, err := pack.PackTar(
-			req.Dir, req.Paths, pw, req.Compress,
+		count, err := pack.PackTarWith(
+			req.Dir, req.Paths, pw, pack.PackOptions{
+				Compress:  req.Compress,
+				CopyLinks: req.CopyLinks,
+				NoParents: req.NoParents,
+				Progress:  prog.add,
+			},
 		)
 		pw.CloseWithError(err)
 		ch <- packResult{count, err}
 	}()
 
-	cr := &countingReader{r: pr}
+	limit := throttle.New(req.BWLimit)
+	cr := &countingReader{r: limit.Reader(pr)}
 	httpReq, err := http.NewRequest("PUT", req.URL, cr)
 	if err != nil {
 		pr.Close()
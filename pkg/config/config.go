@@ -0,0 +1,121 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const FileName = ".sprync.yaml"
+
+var ErrNotFound = errors.New(FileName + " not found")
+
+// Config is a project's .sprync.yaml: named targets, so that
+// "sprync push dev" needs no paths or flags.
+type Config struct {
+	Path    string             `yaml:"-"`
+	Targets map[string]*Target `yaml:"targets"`
+}
+
+type Target struct {
+	// Source is the local dir, relative to the config file, or
+	// a sprite:dir. Destination is always a sprite:dir.
+	Source      string   `yaml:"source"`
+	Destination string   `yaml:"destination"`
+	Exclude     []string `yaml:"exclude,omitempty"`
+	// Compress and Delete are nil unless set, leaving the
+	// flags' defaults alone.
+	Compress *bool `yaml:"compress,omitempty"`
+	Delete   *bool `yaml:"delete,omitempty"`
+	Hooks    Hooks `yaml:"hooks,omitempty"`
+}
+
+// Hooks are shell commands run in the config file's directory
+// before and after a transfer.
+type Hooks struct {
+	Pre  []string `yaml:"pre,omitempty"`
+	Post []string `yaml:"post,omitempty"`
+}
+
+// Find returns the config file in dir or the nearest parent
+// that has one.
+func Find(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, FileName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", ErrNotFound
+		}
+		dir = parent
+	}
+}
+
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{Path: path}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	err = dec.Decode(cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	dir := filepath.Dir(path)
+	for name, t := range cfg.Targets {
+		if t == nil || t.Source == "" || t.Destination == "" {
+			return nil, fmt.Errorf(
+				"%s: target %q needs a source and a destination",
+				path, name,
+			)
+		}
+		if !strings.Contains(t.Source, ":") &&
+			!filepath.IsAbs(t.Source) {
+			t.Source = filepath.Join(dir, t.Source)
+		}
+	}
+	return cfg, nil
+}
+
+func (c *Config) Target(name string) (*Target, error) {
+	t, ok := c.Targets[name]
+	if !ok {
+		return nil, fmt.Errorf(
+			"no target %q in %s (have: %s)",
+			name, c.Path, strings.Join(c.Names(), ", "),
+		)
+	}
+	return t, nil
+}
+
+func (c *Config) Names() []string {
+	names := make([]string, 0, len(c.Targets))
+	for name := range c.Targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,94 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeConfig(t *testing.T, dir, body string) string {
+	t.Helper()
+	path := filepath.Join(dir, FileName)
+	assert.NoError(t, os.WriteFile(path, []byte(body), 0644))
+	return path
+}
+
+func TestFindWalksUp(t *testing.T) {
+	root := t.TempDir()
+	path := writeConfig(t, root, "")
+	deep := filepath.Join(root, "a", "b")
+	assert.NoError(t, os.MkdirAll(deep, 0755))
+
+	found, err := Find(deep)
+	assert.NoError(t, err)
+	assert.Equal(t, path, found)
+
+	_, err = Find(t.TempDir())
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	path := writeConfig(t, dir, `
+targets:
+  dev:
+    source: ./app
+    destination: dev-box:/home/sprite/app
+    exclude: [node_modules, .git]
+    compress: true
+    hooks:
+      pre: [make build]
+  mirror:
+    source: dev-box:/home/sprite/app
+    destination: staging:/srv/app
+    delete: true
+`)
+
+	cfg, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dev", "mirror"}, cfg.Names())
+
+	dev, err := cfg.Target("dev")
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "app"), dev.Source)
+	assert.Equal(t, "dev-box:/home/sprite/app", dev.Destination)
+	assert.Equal(t, []string{"node_modules", ".git"}, dev.Exclude)
+	assert.True(t, *dev.Compress)
+	assert.Nil(t, dev.Delete)
+	assert.Equal(t, []string{"make build"}, dev.Hooks.Pre)
+
+	mirror, err := cfg.Target("mirror")
+	assert.NoError(t, err)
+	assert.Equal(t, "dev-box:/home/sprite/app", mirror.Source)
+	assert.True(t, *mirror.Delete)
+
+	_, err = cfg.Target("prod")
+	assert.ErrorContains(t, err, "have: dev, mirror")
+}
+
+func TestLoadRejectsBadTargets(t *testing.T) {
+	cases := map[string]string{
+		"unknown field": `
+targets:
+  dev:
+    source: .
+    destination: box:/app
+    excludes: [.git]
+`,
+		"no destination": `
+targets:
+  dev:
+    source: .
+`,
+		"empty target": `
+targets:
+  dev:
+`,
+	}
+	for name, body := range cases {
+		_, err := Load(writeConfig(t, t.TempDir(), body))
+		assert.Error(t, err, name)
+	}
+}
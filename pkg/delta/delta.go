@@ -0,0 +1,266 @@
+package delta
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"io"
+	"math"
+)
+
+const (
+	MinBlockSize = 2048
+	maxLiteral   = 1 << 20
+)
+
+type BlockSig struct {
+	Weak   uint32
+	Strong [16]byte
+}
+
+// Signature describes a base file as a sequence of fixed-size
+// blocks; the last block may be short.
+type Signature struct {
+	BlockSize int
+	Size      int64
+	Blocks    []BlockSig
+}
+
+type OpKind uint8
+
+const (
+	OpCopy OpKind = iota + 1
+	OpLiteral
+)
+
+// Op either copies Count blocks starting at Block from the base
+// file or inserts Data verbatim.
+type Op struct {
+	Kind  OpKind
+	Block int64
+	Count int64
+	Data  []byte
+}
+
+func BlockSizeFor(size int64) int {
+	bs := int(math.Sqrt(float64(size)))
+	bs = (bs + 1023) &^ 1023
+	return max(bs, MinBlockSize)
+}
+
+func Sign(r io.Reader, size int64) (*Signature, error) {
+	sig := &Signature{BlockSize: BlockSizeFor(size)}
+	buf := make([]byte, sig.BlockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, BlockSig{
+				Weak:   weakSum(buf[:n]),
+				Strong: strongSum(buf[:n]),
+			})
+			sig.Size += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Diff reads the new version of a file from r and calls emit
+// with the ops that rebuild it from the base described by sig.
+func Diff(sig *Signature, r io.Reader, emit func(Op) error) error {
+	d := &differ{
+		sig:   sig,
+		emit:  emit,
+		index: make(map[uint32][]int, len(sig.Blocks)),
+	}
+	for i, b := range sig.Blocks {
+		d.index[b.Weak] = append(d.index[b.Weak], i)
+	}
+	return d.run(bufio.NewReaderSize(r, 1<<16))
+}
+
+type differ struct {
+	sig   *Signature
+	emit  func(Op) error
+	index map[uint32][]int
+
+	run0, runN int64
+}
+
+func (d *differ) run(br *bufio.Reader) error {
+	bs := d.sig.BlockSize
+	var buf []byte
+	start := 0
+
+	fill := func() (bool, error) {
+		for len(buf)-start < bs {
+			c, err := br.ReadByte()
+			if err == io.EOF {
+				return false, nil
+			}
+			if err != nil {
+				return false, err
+			}
+			buf = append(buf, c)
+		}
+		return true, nil
+	}
+
+	for {
+		full, err := fill()
+		if err != nil {
+			return err
+		}
+		if !full {
+			return d.finish(buf, start)
+		}
+
+		window := buf[start:]
+		w := weakSum(window)
+		a, b := w&0xffff, w>>16
+		for {
+			if i, ok := d.match(a|b<<16, buf[start:]); ok {
+				if err := d.literal(buf[:start]); err != nil {
+					return err
+				}
+				if err := d.copyBlock(int64(i)); err != nil {
+					return err
+				}
+				buf, start = buf[:0], 0
+				break
+			}
+
+			c, err := br.ReadByte()
+			if err == io.EOF {
+				return d.finish(buf, len(buf))
+			}
+			if err != nil {
+				return err
+			}
+			out := uint32(buf[start])
+			buf = append(buf, c)
+			start++
+			a = (a - out + uint32(c)) & 0xffff
+			b = (b - uint32(bs)*out + a) & 0xffff
+
+			if start >= maxLiteral {
+				if err := d.literal(buf[:start]); err != nil {
+					return err
+				}
+				buf = append(buf[:0], buf[start:]...)
+				start = 0
+			}
+		}
+	}
+}
+
+func (d *differ) match(weak uint32, window []byte) (int, bool) {
+	cands, ok := d.index[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := strongSum(window)
+	full := int(d.sig.Size / int64(d.sig.BlockSize))
+	for _, i := range cands {
+		if i < full && d.sig.Blocks[i].Strong == strong {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// finish handles the bytes left at EOF: buf[:start] is literal
+// and buf[start:] is shorter than a block, so it can only match
+// a short final block of the base.
+func (d *differ) finish(buf []byte, start int) error {
+	tail := buf[start:]
+	n := len(d.sig.Blocks)
+	short := int(d.sig.Size % int64(d.sig.BlockSize))
+	if len(tail) > 0 && len(tail) == short &&
+		d.sig.Blocks[n-1].Strong == strongSum(tail) {
+		if err := d.literal(buf[:start]); err != nil {
+			return err
+		}
+		if err := d.copyBlock(int64(n - 1)); err != nil {
+			return err
+		}
+		return d.flushCopy()
+	}
+	if err := d.literal(buf); err != nil {
+		return err
+	}
+	return d.flushCopy()
+}
+
+func (d *differ) copyBlock(i int64) error {
+	if d.runN > 0 && d.run0+d.runN == i {
+		d.runN++
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.run0, d.runN = i, 1
+	return nil
+}
+
+func (d *differ) flushCopy() error {
+	if d.runN == 0 {
+		return nil
+	}
+	op := Op{Kind: OpCopy, Block: d.run0, Count: d.runN}
+	d.runN = 0
+	return d.emit(op)
+}
+
+func (d *differ) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	return d.emit(Op{
+		Kind: OpLiteral,
+		Data: append([]byte(nil), data...),
+	})
+}
+
+// Apply writes the result of op to w, reading copied blocks
+// from base.
+func Apply(
+	base io.ReaderAt, blockSize int, op Op, w io.Writer,
+) error {
+	switch op.Kind {
+	case OpCopy:
+		bs := int64(blockSize)
+		_, err := io.Copy(w, io.NewSectionReader(
+			base, op.Block*bs, op.Count*bs,
+		))
+		return err
+	case OpLiteral:
+		_, err := w.Write(op.Data)
+		return err
+	}
+	return nil
+}
+
+func weakSum(p []byte) uint32 {
+	var a, b uint32
+	n := uint32(len(p))
+	for i, c := range p {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a&0xffff | (b&0xffff)<<16
+}
+
+func strongSum(p []byte) [16]byte {
+	sum := sha256.Sum256(p)
+	var s [16]byte
+	copy(s[:], sum[:16])
+	return s
+}
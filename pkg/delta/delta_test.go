@@ -0,0 +1,88 @@
+package delta
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func roundTrip(t *testing.T, base, target []byte) []Op {
+	t.Helper()
+	sig, err := Sign(bytes.NewReader(base), int64(len(base)))
+	require.NoError(t, err)
+
+	var ops []Op
+	err = Diff(sig, bytes.NewReader(target), func(op Op) error {
+		ops = append(ops, op)
+		return nil
+	})
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	for _, op := range ops {
+		require.NoError(t,
+			Apply(bytes.NewReader(base), sig.BlockSize, op, &out),
+		)
+	}
+	assert.Equal(t, target, out.Bytes())
+	return ops
+}
+
+func literalBytes(ops []Op) int {
+	n := 0
+	for _, op := range ops {
+		n += len(op.Data)
+	}
+	return n
+}
+
+func randomBytes(n int, seed int64) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(b)
+	return b
+}
+
+func TestDiffIdentical(t *testing.T) {
+	base := randomBytes(100_000, 1)
+	ops := roundTrip(t, base, base)
+	assert.Equal(t, 0, literalBytes(ops))
+	assert.Len(t, ops, 1)
+}
+
+func TestDiffSmallEdit(t *testing.T) {
+	base := randomBytes(500_000, 2)
+	target := bytes.Clone(base)
+	copy(target[250_000:], []byte("a few changed bytes"))
+
+	ops := roundTrip(t, base, target)
+	assert.Less(t, literalBytes(ops), 2*BlockSizeFor(500_000))
+}
+
+func TestDiffInsertShiftsData(t *testing.T) {
+	base := randomBytes(300_000, 3)
+	target := append(
+		append(bytes.Clone(base[:1000]), "inserted"...),
+		base[1000:]...,
+	)
+
+	ops := roundTrip(t, base, target)
+	assert.Less(t, literalBytes(ops), 2*BlockSizeFor(300_000))
+}
+
+func TestDiffAppendAndTruncate(t *testing.T) {
+	base := randomBytes(123_457, 4)
+	roundTrip(t, base, append(bytes.Clone(base), "tail"...))
+	roundTrip(t, base, base[:50_000])
+	roundTrip(t, base, nil)
+	roundTrip(t, nil, base)
+}
+
+func TestDiffUnrelated(t *testing.T) {
+	base := randomBytes(64_000, 5)
+	target := randomBytes(64_000, 6)
+	ops := roundTrip(t, base, target)
+	assert.Equal(t, len(target), literalBytes(ops))
+}
@@ -14,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/coder/websocket"
 )
@@ -21,8 +22,11 @@ import (
 type Server struct {
 	HS      *httptest.Server
 	RootDir string
-	mu      sync.Mutex
-	procs   []*os.Process
+	// DisableWatch makes /fs/watch fail, like a sprite
+	// without the watch API.
+	DisableWatch bool
+	mu           sync.Mutex
+	procs        []*os.Process
 }
 
 func New(rootDir string) *Server {
@@ -51,6 +55,8 @@ func (s *Server) routeSprite(
 		s.handleFSWrite(w, r)
 	case op == "/fs/read":
 		s.handleFSRead(w, r)
+	case op == "/fs/watch":
+		s.handleFSWatch(w, r)
 	case op == "/exec":
 		s.handleExec(w, r)
 	default:
@@ -153,7 +159,7 @@ func (s *Server) handleFSRead(
 	w.Header().Set(
 		"Content-Type", "application/octet-stream",
 	)
-	io.Copy(w, f)
+	http.ServeContent(w, r, "", time.Time{}, f)
 }
 
 func (s *Server) handleExec(
@@ -3,10 +3,13 @@ package fakeserver
 import (
 	"bytes"
 	"context"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,6 +23,7 @@ import (
 
 func buildSpryncd(t *testing.T) string {
 	t.Helper()
+	t.Setenv("SPRYNC_STATE_DIR", t.TempDir())
 	bin := filepath.Join(t.TempDir(), "spryncd")
 	cmd := exec.Command(
 		"go", "build", "-o", bin, "./cmd/spryncd",
@@ -151,15 +155,18 @@ func TestWSManifestExistingDir(t *testing.T) {
 	)
 	require.NoError(t, err)
 	assert.True(t, exists)
-	assert.Len(t, entries, 3)
+	assert.Len(t, entries, 4)
 	assert.True(t, elapsed >= 0)
 
 	pathSet := map[string]bool{}
 	for _, e := range entries {
 		pathSet[e.Path] = true
-		assert.NotEmpty(t, e.Hash)
 		assert.NotZero(t, e.Mode)
+		if !e.Dir {
+			assert.NotEmpty(t, e.Hash)
+		}
 	}
+	assert.True(t, pathSet["src"])
 	assert.True(t, pathSet["main.go"])
 	assert.True(t, pathSet["src/util.go"])
 	assert.True(t, pathSet["README.md"])
@@ -494,6 +501,47 @@ func TestWSSessionClose(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestWSForkSession(t *testing.T) {
+	spryncdBin := buildSpryncd(t)
+	_, client, rootDir := setupServer(t)
+	ctx := context.Background()
+
+	remoteDir := filepath.Join(rootDir, "project")
+	makeTree(t, remoteDir, map[string]string{
+		"a.go":     "package a",
+		"sub/b.go": "package b",
+	})
+
+	sess := openSession(t, client, spryncdBin)
+	defer sess.Close(ctx)
+
+	fork, err := sess.Fork(ctx)
+	require.NoError(t, err)
+	assert.NotEqual(t, sess.PID, fork.PID)
+
+	var wg sync.WaitGroup
+	results := make([][]pack.ManifestEntry, 2)
+	errs := make([]error, 2)
+	for i, s := range []*protocol.Session{sess, fork} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], _, _, errs[i] = s.Manifest(remoteDir, nil)
+		}()
+	}
+	wg.Wait()
+	for i := range results {
+		require.NoError(t, errs[i])
+		assert.Len(t, results[i], 3)
+	}
+
+	require.NoError(t, fork.Close(ctx))
+
+	entries, _, _, err := sess.Manifest(remoteDir, nil)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
+
 func TestWSUploadAndRunSpryncd(t *testing.T) {
 	spryncdBin := buildSpryncd(t)
 	_, client, _ := setupServer(t)
@@ -551,6 +599,155 @@ func TestWSFSWriteAndRead(t *testing.T) {
 	assert.Equal(t, content, buf.Bytes())
 }
 
+func TestWSStreamingPushUpload(t *testing.T) {
+	spryncdBin := buildSpryncd(t)
+	_, client, rootDir := setupServer(t)
+	ctx := context.Background()
+
+	localDir := t.TempDir()
+	remoteDir := filepath.Join(rootDir, "project")
+	require.NoError(t, os.MkdirAll(remoteDir, 0755))
+	makeTree(t, localDir, map[string]string{
+		"a.go":     "package a",
+		"sub/b.go": "package b",
+	})
+
+	sess := openSession(t, client, spryncdBin)
+	defer sess.Close(ctx)
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := pack.PackTar(
+			localDir, []string{"a.go", "sub/b.go"}, pw,
+			true,
+		)
+		pw.CloseWithError(err)
+	}()
+
+	tarPath := "/tmp/sprync-ws-stream.tar.gz"
+	t.Cleanup(func() { os.Remove(tarPath) })
+	err := client.FSWrite(ctx, "test-sprite", tarPath, "", false, pr)
+	require.NoError(t, err)
+
+	result, err := sess.Extract(remoteDir, tarPath, true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Count)
+
+	got, err := os.ReadFile(filepath.Join(remoteDir, "sub/b.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "package b", string(got))
+}
+
+func TestWSResumablePull(t *testing.T) {
+	spryncdBin := buildSpryncd(t)
+	_, client, rootDir := setupServer(t)
+	ctx := context.Background()
+
+	remoteDir := filepath.Join(rootDir, "project")
+	makeTree(t, remoteDir, map[string]string{
+		"a.go":     "package a",
+		"sub/b.go": "package b",
+	})
+
+	tarPath := "/tmp/sprync-ws-resume.tar.gz"
+	t.Cleanup(func() { os.Remove(tarPath) })
+	sess := openSession(t, client, spryncdBin)
+	packed, err := sess.PackTo(
+		remoteDir, []string{"a.go", "sub/b.go"}, tarPath,
+		true,
+	)
+	require.NoError(t, err)
+	require.NoError(t, sess.Close(ctx))
+
+	whole, err := os.ReadFile(tarPath)
+	require.NoError(t, err)
+	assert.Equal(t, packed.Size, int64(len(whole)))
+
+	rc, offset, err := client.FSReadFrom(
+		ctx, "test-sprite", tarPath, 10,
+	)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(rc)
+	rc.Close()
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), offset)
+	assert.Equal(t, whole[10:], rest)
+
+	_, _, err = client.FSReadFrom(
+		ctx, "test-sprite", "/tmp/sprync-ws-missing.tar.gz", 10,
+	)
+	assert.True(t, spriteapi.IsNotFound(err))
+
+	sess = openSession(t, client, spryncdBin)
+	defer sess.Close(ctx)
+	discarded, err := sess.Discard([]string{tarPath})
+	require.NoError(t, err)
+	assert.Equal(t, 1, discarded.Count)
+	_, err = os.Stat(tarPath)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWSChunkedPush(t *testing.T) {
+	spryncdBin := buildSpryncd(t)
+	_, client, rootDir := setupServer(t)
+	ctx := context.Background()
+
+	localDir := t.TempDir()
+	remoteDir := filepath.Join(rootDir, "project")
+	require.NoError(t, os.MkdirAll(remoteDir, 0755))
+	makeTree(t, localDir, map[string]string{
+		"a.go":     "package a",
+		"sub/b.go": "package b",
+	})
+
+	var buf bytes.Buffer
+	_, err := pack.PackTar(
+		localDir, []string{"a.go", "sub/b.go"}, &buf,
+		true,
+	)
+	require.NoError(t, err)
+	data := buf.Bytes()
+
+	tarPath := "/tmp/sprync-ws-chunked.tar.gz"
+	parts := []string{tarPath + ".0000", tarPath + ".0001"}
+	t.Cleanup(func() { os.Remove(tarPath) })
+	for i, chunk := range [][]byte{
+		data[:len(data)/2], data[len(data)/2:],
+	} {
+		err := client.FSWrite(
+			ctx, "test-sprite", parts[i], "", false,
+			bytes.NewReader(chunk),
+		)
+		require.NoError(t, err)
+	}
+
+	sess := openSession(t, client, spryncdBin)
+	defer sess.Close(ctx)
+
+	joined, err := sess.Concat(tarPath, parts)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), joined.Size)
+
+	result, err := sess.ExtractWith(
+		remoteDir, tarPath, pack.UnpackOptions{
+			Compress: true,
+			Only:     []string{"sub/b.go"},
+		},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Count)
+
+	got, err := os.ReadFile(filepath.Join(remoteDir, "sub/b.go"))
+	require.NoError(t, err)
+	assert.Equal(t, "package b", string(got))
+	_, err = os.Stat(filepath.Join(remoteDir, "a.go"))
+	assert.True(t, os.IsNotExist(err))
+
+	discarded, err := sess.Discard(parts)
+	require.NoError(t, err)
+	assert.Equal(t, 2, discarded.Count)
+}
+
 func TestWSLargeManifest(t *testing.T) {
 	spryncdBin := buildSpryncd(t)
 	_, client, rootDir := setupServer(t)
@@ -560,6 +757,7 @@ func TestWSLargeManifest(t *testing.T) {
 	require.NoError(t, os.MkdirAll(remoteDir, 0755))
 
 	files := map[string]string{}
+	dirs := map[string]bool{}
 	for i := range 500 {
 		subdir := string(rune('a' + i%26))
 		name := filepath.Join(
@@ -567,6 +765,7 @@ func TestWSLargeManifest(t *testing.T) {
 			filepath.Base(t.TempDir())+".go",
 		)
 		files[name] = "package " + subdir
+		dirs[subdir] = true
 	}
 	makeTree(t, remoteDir, files)
 
@@ -578,7 +777,7 @@ func TestWSLargeManifest(t *testing.T) {
 	)
 	require.NoError(t, err)
 	assert.True(t, exists)
-	assert.Len(t, entries, len(files))
+	assert.Len(t, entries, len(files)+len(dirs))
 }
 
 func TestWSPackPathTraversal(t *testing.T) {
@@ -1016,3 +1215,78 @@ func TestWSSpriteToPushBlind(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+
+func TestWSTransferBWLimit(t *testing.T) {
+	spryncdBin := buildSpryncd(t)
+	_, client, rootDir := setupServer(t)
+	ctx := context.Background()
+
+	srcDir := filepath.Join(rootDir, "src-limited")
+	makeTree(t, srcDir, map[string]string{
+		"big.bin": strings.Repeat("x", 256<<10),
+	})
+
+	srcSess := openSessionFor(
+		t, client, spryncdBin, "src-sprite",
+	)
+	defer srcSess.Close(ctx)
+
+	tmpDest := "/tmp/sprync-s2s-limited.tar"
+	t.Cleanup(func() { os.Remove(tmpDest) })
+	destURL := client.FSWriteURL(
+		"dst-sprite", tmpDest, "", false,
+	)
+
+	start := time.Now()
+	result, err := srcSess.TransferWith(
+		srcDir, []string{"big.bin"}, destURL, "test-token",
+		protocol.TransferOptions{BWLimit: 512 << 10},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Count)
+	assert.Greater(t, result.Size, int64(256<<10))
+	assert.GreaterOrEqual(t,
+		time.Since(start), 400*time.Millisecond,
+	)
+}
+
+func TestWSFSWatch(t *testing.T) {
+	_, client, rootDir := setupServer(t)
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Second,
+	)
+	defer cancel()
+
+	dir := filepath.Join(rootDir, "project")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	w, err := client.FSWatch(
+		ctx, "test-sprite", []string{"/project"}, true,
+	)
+	require.NoError(t, err)
+	defer w.Close()
+
+	makeTree(t, dir, map[string]string{"sub/out.log": "line"})
+	ev, err := w.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "create", ev.Event)
+	assert.Equal(t, "/project/sub/out.log", ev.Path)
+	assert.Equal(t, int64(4), ev.Size)
+	assert.False(t, ev.IsDir)
+
+	require.NoError(t, os.Remove(filepath.Join(dir, "sub/out.log")))
+	ev, err = w.Next(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "remove", ev.Event)
+	assert.Equal(t, "/project/sub/out.log", ev.Path)
+}
+
+func TestWSFSWatchUnavailable(t *testing.T) {
+	srv, client, _ := setupServer(t)
+	srv.DisableWatch = true
+
+	_, err := client.FSWatch(
+		context.Background(), "test-sprite",
+		[]string{"/project"}, true,
+	)
+	assert.Error(t, err)
+}
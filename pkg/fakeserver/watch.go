@@ -0,0 +1,178 @@
+package fakeserver
+
+import (
+	"context"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/coder/websocket"
+)
+
+// watchPoll is how often the fake /fs/watch rescans. The real
+// API pushes events as they happen.
+const watchPoll = 50 * time.Millisecond
+
+type watchState struct {
+	size  int64
+	mode  fs.FileMode
+	mtime time.Time
+	dir   bool
+}
+
+func (s *Server) handleFSWatch(
+	w http.ResponseWriter, r *http.Request,
+) {
+	if s.DisableWatch {
+		http.Error(w, "not found", 404)
+		return
+	}
+	conn, err := websocket.Accept(
+		w, r, &websocket.AcceptOptions{
+			InsecureSkipVerify: true,
+		},
+	)
+	if err != nil {
+		return
+	}
+	defer conn.CloseNow()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	var sub struct {
+		Type      string   `json:"type"`
+		Paths     []string `json:"paths"`
+		Recursive bool     `json:"recursive"`
+	}
+	_, data, err := conn.Read(ctx)
+	if err != nil {
+		return
+	}
+	if json.Unmarshal(data, &sub) != nil ||
+		sub.Type != "subscribe" || len(sub.Paths) == 0 {
+		writeJSON(ctx, conn, map[string]any{
+			"type":    "error",
+			"message": "expected subscribe",
+		})
+		return
+	}
+
+	snaps := make([]map[string]watchState, len(sub.Paths))
+	for i, p := range sub.Paths {
+		snaps[i] = snapshotTree(s.resolvePath(p), sub.Recursive)
+	}
+	writeJSON(ctx, conn, map[string]any{
+		"type":  "subscribed",
+		"paths": sub.Paths,
+	})
+
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.Read(ctx); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(watchPoll)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for i, p := range sub.Paths {
+			next := snapshotTree(s.resolvePath(p), sub.Recursive)
+			for _, ev := range watchEvents(p, snaps[i], next) {
+				if writeJSON(ctx, conn, ev) != nil {
+					return
+				}
+			}
+			snaps[i] = next
+		}
+	}
+}
+
+func snapshotTree(
+	root string, recursive bool,
+) map[string]watchState {
+	snap := make(map[string]watchState)
+	filepath.WalkDir(root,
+		func(abs string, d fs.DirEntry, err error) error {
+			if err != nil || abs == root {
+				return nil
+			}
+			rel, _ := filepath.Rel(root, abs)
+			info, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			snap[filepath.ToSlash(rel)] = watchState{
+				size:  info.Size(),
+				mode:  info.Mode(),
+				mtime: info.ModTime(),
+				dir:   d.IsDir(),
+			}
+			if d.IsDir() && !recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		},
+	)
+	return snap
+}
+
+func watchEvents(
+	root string, prev, next map[string]watchState,
+) []map[string]any {
+	var events []map[string]any
+	add := func(kind, rel string, st watchState) {
+		events = append(events, map[string]any{
+			"type":      "event",
+			"event":     kind,
+			"path":      path.Join(root, rel),
+			"timestamp": time.Now().Format(time.RFC3339Nano),
+			"size":      st.size,
+			"isDir":     st.dir,
+		})
+	}
+	for rel, st := range next {
+		old, ok := prev[rel]
+		switch {
+		case !ok:
+			add("create", rel, st)
+		case old.mode != st.mode:
+			add("chmod", rel, st)
+		case !st.dir && (old.size != st.size ||
+			!old.mtime.Equal(st.mtime)):
+			add("write", rel, st)
+		}
+	}
+	for rel, st := range prev {
+		if _, ok := next[rel]; !ok {
+			add("remove", rel, st)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i]["path"].(string) <
+			events[j]["path"].(string)
+	})
+	return events
+}
+
+func writeJSON(
+	ctx context.Context, conn *websocket.Conn, v any,
+) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return conn.Write(ctx, websocket.MessageText, data)
+}
@@ -3,6 +3,7 @@ package harness
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
@@ -78,12 +79,13 @@ func TestManifestUnicodeFilenames(t *testing.T) {
 	entries, exists, _, err := s.Manifest(dir, nil)
 	require.NoError(t, err)
 	assert.True(t, exists)
-	assert.Len(t, entries, 3)
+	assert.Len(t, entries, 4)
 
 	pathSet := map[string]bool{}
 	for _, e := range entries {
 		pathSet[e.Path] = true
 	}
+	assert.True(t, pathSet["données"])
 	assert.True(t, pathSet["日本語.txt"])
 	assert.True(t, pathSet["café.txt"])
 	assert.True(t, pathSet["données/fête.md"])
@@ -106,7 +108,7 @@ func TestManifestSpacesInFilenames(t *testing.T) {
 	entries, exists, _, err := s.Manifest(dir, nil)
 	require.NoError(t, err)
 	assert.True(t, exists)
-	assert.Len(t, entries, 4)
+	assert.Len(t, entries, 5)
 }
 
 func TestManifestDeeplyNested(t *testing.T) {
@@ -128,8 +130,11 @@ func TestManifestDeeplyNested(t *testing.T) {
 	entries, exists, _, err := s.Manifest(dir, nil)
 	require.NoError(t, err)
 	assert.True(t, exists)
-	assert.Len(t, entries, 1)
-	assert.Equal(t, deepPath, entries[0].Path)
+	assert.Len(t, entries, len(parts)+1)
+	assert.Equal(t, deepPath, entries[len(entries)-1].Path)
+	for _, e := range entries[:len(parts)] {
+		assert.True(t, e.Dir, "expected dir: %s", e.Path)
+	}
 }
 
 func TestManifestVariousModes(t *testing.T) {
@@ -171,7 +176,7 @@ func TestManifestVariousModes(t *testing.T) {
 	}
 }
 
-func TestManifestSkipsSymlinks(t *testing.T) {
+func TestManifestSymlinks(t *testing.T) {
 	bin := buildSpryncd(t)
 	s, err := Start(bin)
 	require.NoError(t, err)
@@ -181,19 +186,25 @@ func TestManifestSkipsSymlinks(t *testing.T) {
 	makeTree(t, dir, map[string]string{
 		"real.txt": "real content",
 	})
-	os.Symlink(
-		filepath.Join(dir, "real.txt"),
-		filepath.Join(dir, "link.txt"),
-	)
+	require.NoError(t, os.Symlink(
+		"real.txt", filepath.Join(dir, "link.txt"),
+	))
 
 	entries, exists, _, err := s.Manifest(dir, nil)
 	require.NoError(t, err)
 	assert.True(t, exists)
-	assert.Len(t, entries, 1)
-	assert.Equal(t, "real.txt", entries[0].Path)
+	assert.Len(t, entries, 2)
+
+	byPath := map[string]pack.ManifestEntry{}
+	for _, e := range entries {
+		byPath[e.Path] = e
+	}
+	assert.Equal(t, "real.txt", byPath["link.txt"].Link)
+	assert.Empty(t, byPath["link.txt"].Hash)
+	assert.Empty(t, byPath["real.txt"].Link)
 }
 
-func TestManifestSkipsSubdirSymlinks(t *testing.T) {
+func TestManifestSubdirSymlinkNotFollowed(t *testing.T) {
 	bin := buildSpryncd(t)
 	s, err := Start(bin)
 	require.NoError(t, err)
@@ -207,12 +218,60 @@ func TestManifestSkipsSubdirSymlinks(t *testing.T) {
 	makeTree(t, other, map[string]string{
 		"secret.txt": "should not appear",
 	})
-	os.Symlink(other, filepath.Join(dir, "linked_dir"))
+	require.NoError(t, os.Symlink(
+		other, filepath.Join(dir, "linked_dir"),
+	))
 
 	entries, exists, _, err := s.Manifest(dir, nil)
 	require.NoError(t, err)
 	assert.True(t, exists)
-	assert.Len(t, entries, 1)
+	assert.Len(t, entries, 2)
+	for _, e := range entries {
+		assert.NotEqual(t, "linked_dir/secret.txt", e.Path)
+	}
+}
+
+func TestManifestCopyLinks(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	dir := t.TempDir()
+	other := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"real.txt": "real",
+	})
+	makeTree(t, other, map[string]string{
+		"inner.txt": "followed",
+	})
+	require.NoError(t, os.Symlink(
+		"real.txt", filepath.Join(dir, "link.txt"),
+	))
+	require.NoError(t, os.Symlink(
+		other, filepath.Join(dir, "linked_dir"),
+	))
+	require.NoError(t, os.Symlink(
+		".", filepath.Join(dir, "loop"),
+	))
+
+	res, err := s.ManifestWith(
+		dir, pack.WalkOptions{CopyLinks: true},
+	)
+	require.NoError(t, err)
+	assert.True(t, res.Exists)
+
+	byPath := map[string]pack.ManifestEntry{}
+	for _, e := range res.Entries {
+		byPath[e.Path] = e
+	}
+	assert.Len(t, byPath, 4)
+	assert.True(t, byPath["linked_dir"].Dir)
+	assert.Equal(t,
+		byPath["real.txt"].Hash, byPath["link.txt"].Hash,
+	)
+	assert.Empty(t, byPath["link.txt"].Link)
+	assert.Contains(t, byPath, "linked_dir/inner.txt")
 }
 
 func TestManifestLargeFile(t *testing.T) {
@@ -403,6 +462,38 @@ func TestManifestIdempotent(t *testing.T) {
 	assert.Equal(t, m1, m2)
 }
 
+func TestManifestParallelOrder(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	dir := t.TempDir()
+	files := map[string]string{}
+	for i := range 200 {
+		name := fmt.Sprintf("d%d/f%03d.bin", i%7, i)
+		files[name] = strings.Repeat("x", (200-i)*1000)
+	}
+	makeTree(t, dir, files)
+
+	var want []string
+	err = pack.WalkTree(dir, pack.WalkOptions{},
+		func(rel, _ string, _ os.FileInfo, err error) error {
+			want = append(want, rel)
+			return err
+		},
+	)
+	require.NoError(t, err)
+
+	entries, _, _, err := s.Manifest(dir, nil)
+	require.NoError(t, err)
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Path)
+	}
+	assert.Equal(t, want, got)
+}
+
 func TestLocalAndRemoteHashesAgree(t *testing.T) {
 	bin := buildSpryncd(t)
 	s, err := Start(bin)
@@ -4,6 +4,7 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -115,7 +116,7 @@ func TestPushFlowBlindPush(t *testing.T) {
 
 	files, err := collectLocalPaths(localDir, nil)
 	require.NoError(t, err)
-	assert.Len(t, files, 2)
+	assert.Len(t, files, 3)
 
 	tarPath := "/tmp/sprync-blind-test.tar.gz"
 	localManifest, err := pack.WalkLocal(localDir, nil)
@@ -355,3 +356,235 @@ func TestFileModePreserved(t *testing.T) {
 	assert.Len(t, entries, 1)
 	assert.Equal(t, 0755, entries[0].Mode)
 }
+
+func TestPushFlowDirectories(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	localDir := t.TempDir()
+	remoteDir := t.TempDir()
+
+	makeTree(t, localDir, map[string]string{
+		"main.go": "package main",
+	})
+	require.NoError(t, os.MkdirAll(
+		filepath.Join(localDir, "uploads"), 0700,
+	))
+	makeTree(t, remoteDir, map[string]string{
+		"main.go":          "package main",
+		"stale/old/x.txt":  "gone",
+		"stale/keep/y.log": "excluded",
+	})
+
+	entries, _, _, err := s.Manifest(remoteDir, []string{"*.log"})
+	require.NoError(t, err)
+	remoteManifest := make(pack.Manifest, len(entries))
+	for _, e := range entries {
+		remoteManifest[e.Path] = e
+	}
+
+	localManifest, err := pack.WalkLocal(localDir, []string{"*.log"})
+	require.NoError(t, err)
+
+	diff := pack.ComputeDiff(localManifest, remoteManifest, true)
+	assert.Equal(t, []string{"uploads"}, diff.Uploads)
+	assert.Equal(t, []string{
+		"stale", "stale/keep", "stale/old", "stale/old/x.txt",
+	}, diff.Deletes)
+
+	tarPath := "/tmp/sprync-dirs-test.tar.gz"
+	f, err := os.Create(tarPath)
+	require.NoError(t, err)
+	_, err = pack.PackTar(localDir, diff.Uploads, f, true)
+	f.Close()
+	require.NoError(t, err)
+	defer os.Remove(tarPath)
+
+	_, err = s.Extract(remoteDir, tarPath, true)
+	require.NoError(t, err)
+
+	info, err := os.Stat(filepath.Join(remoteDir, "uploads"))
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	_, err = s.Delete(remoteDir, diff.Deletes)
+	require.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(remoteDir, "stale/old"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(remoteDir, "stale/keep/y.log"))
+	assert.NoError(t, err)
+}
+
+func TestPushFlowPreservesTimes(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	localDir := t.TempDir()
+	remoteDir := t.TempDir()
+	makeTree(t, localDir, map[string]string{
+		"Makefile": "all:\n",
+	})
+	old := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(
+		filepath.Join(localDir, "Makefile"), old, old,
+	))
+
+	tarPath := "/tmp/sprync-times-test.tar.gz"
+	f, err := os.Create(tarPath)
+	require.NoError(t, err)
+	_, err = pack.PackTar(
+		localDir, []string{"Makefile"}, f, true,
+	)
+	f.Close()
+	require.NoError(t, err)
+	defer os.Remove(tarPath)
+
+	_, err = s.ExtractWith(remoteDir, tarPath, pack.UnpackOptions{
+		Compress: true,
+		Times:    true,
+	})
+	require.NoError(t, err)
+
+	entries, _, _, err := s.Manifest(remoteDir, nil)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, old.Unix(), entries[0].MTime)
+
+	localManifest, err := pack.WalkLocal(localDir, nil)
+	require.NoError(t, err)
+	diff := pack.ComputeDiffWith(
+		localManifest,
+		pack.Manifest{entries[0].Path: entries[0]},
+		pack.DiffOptions{Times: true},
+	)
+	assert.Nil(t, diff.Uploads)
+}
+
+func TestPushFlowDelta(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	localDir := t.TempDir()
+	remoteDir := t.TempDir()
+	data := make([]byte, 1<<20)
+	for i := range data {
+		data[i] = byte(i * 7 % 251)
+	}
+	require.NoError(t, os.WriteFile(
+		filepath.Join(remoteDir, "db.sqlite"), data, 0644,
+	))
+	data[500_000] ^= 0xff
+	require.NoError(t, os.WriteFile(
+		filepath.Join(localDir, "db.sqlite"), data, 0600,
+	))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(remoteDir, "stale.bin"), []byte("old"), 0644,
+	))
+	require.NoError(t, os.WriteFile(
+		filepath.Join(localDir, "stale.bin"), []byte("new"), 0644,
+	))
+
+	sigPath := "/tmp/sprync-delta-test.sig"
+	defer os.Remove(sigPath)
+	sigResult, err := s.Signature(
+		remoteDir, []string{"db.sqlite", "stale.bin"}, sigPath,
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 2, sigResult.Count)
+
+	f, err := os.Open(sigPath)
+	require.NoError(t, err)
+	sigs, err := pack.ReadSignatures(f)
+	f.Close()
+	require.NoError(t, err)
+
+	localM, err := pack.WalkLocal(localDir, nil)
+	require.NoError(t, err)
+	stale := localM["stale.bin"]
+	stale.Hash = "bogus"
+
+	deltaPath := "/tmp/sprync-delta-test.delta"
+	out, err := os.Create(deltaPath)
+	require.NoError(t, err)
+	literal, err := pack.PackDelta(localDir,
+		[]pack.ManifestEntry{localM["db.sqlite"], stale},
+		sigs, out, true,
+	)
+	out.Close()
+	require.NoError(t, err)
+	assert.Less(t, literal, int64(len(data)/10))
+
+	result, err := s.Patch(remoteDir, deltaPath, pack.UnpackOptions{
+		Compress: true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Count)
+	assert.Equal(t, []string{"stale.bin"}, result.Failed)
+
+	got, err := os.ReadFile(filepath.Join(remoteDir, "db.sqlite"))
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	info, err := os.Stat(filepath.Join(remoteDir, "db.sqlite"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	old, err := os.ReadFile(filepath.Join(remoteDir, "stale.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(old))
+}
+
+func TestPushFlowSymlinkOverDir(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	localDir := t.TempDir()
+	remoteDir := t.TempDir()
+	require.NoError(t, os.Symlink(
+		"static", filepath.Join(localDir, "assets"),
+	))
+	makeTree(t, remoteDir, map[string]string{
+		"assets/logo.png":     "png",
+		"assets/css/site.css": "body {}",
+		"assets/keep.lock":    "protected",
+	})
+
+	tarPath := "/tmp/sprync-symlink-dir-test.tar"
+	f, err := os.Create(tarPath)
+	require.NoError(t, err)
+	_, err = pack.PackTarWith(
+		localDir, []string{"assets"}, f, pack.PackOptions{},
+	)
+	f.Close()
+	require.NoError(t, err)
+	defer os.Remove(tarPath)
+
+	_, err = s.ExtractWith(remoteDir, tarPath, pack.UnpackOptions{})
+	assert.ErrorContains(t, err, "not empty")
+	_, err = os.Stat(filepath.Join(remoteDir, "assets/css/site.css"))
+	assert.NoError(t, err)
+
+	_, err = s.ExtractWith(remoteDir, tarPath, pack.UnpackOptions{
+		Delete: &pack.DeleteOptions{Protect: []string{"*.lock"}},
+	})
+	assert.ErrorContains(t, err, "kept")
+	_, err = os.Stat(filepath.Join(remoteDir, "assets/keep.lock"))
+	assert.NoError(t, err)
+
+	_, err = s.ExtractWith(remoteDir, tarPath, pack.UnpackOptions{
+		Delete: &pack.DeleteOptions{},
+	})
+	require.NoError(t, err)
+	target, err := os.Readlink(filepath.Join(remoteDir, "assets"))
+	require.NoError(t, err)
+	assert.Equal(t, "static", target)
+}
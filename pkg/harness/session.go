@@ -19,6 +19,11 @@ type Session struct {
 	mu      sync.Mutex
 	Version string
 	PID     int
+
+	// OnProgress, when set, asks spryncd for progress updates
+	// during manifest, extract and transfer and receives the
+	// running file and byte counts.
+	OnProgress func(count int, bytes int64)
 }
 
 func Start(spryncdPath string) (*Session, error) {
@@ -89,23 +94,52 @@ func (s *Session) Manifest(
 	dir string,
 	excludes []string,
 ) ([]pack.ManifestEntry, bool, time.Duration, error) {
+	res, err := s.ManifestWith(dir, pack.WalkOptions{
+		Excludes:    excludes,
+		IgnoreFiles: pack.DefaultIgnoreFiles,
+	})
+	if err != nil {
+		return nil, false, 0, err
+	}
+	return res.Entries, res.Exists, res.Elapsed, nil
+}
+
+type ManifestResult struct {
+	Entries []pack.ManifestEntry
+	Exists  bool
+	Elapsed time.Duration
+
+	CacheHits   int
+	CacheMisses int
+}
+
+func (s *Session) ManifestWith(
+	dir string,
+	opts pack.WalkOptions,
+) (*ManifestResult, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	err := s.send(protocol.Request{
-		Cmd:      "manifest",
-		Dir:      dir,
-		Excludes: excludes,
+		Cmd:         "manifest",
+		Dir:         dir,
+		Filters:     opts.Filters,
+		Excludes:    opts.Excludes,
+		IgnoreFiles: opts.IgnoreFiles,
+		Paths:       opts.Only,
+		CopyLinks:   opts.CopyLinks,
+		Checksum:    opts.Checksum,
+		Progress:    s.OnProgress != nil,
 	})
 	if err != nil {
-		return nil, false, 0, err
+		return nil, err
 	}
 
 	var entries []pack.ManifestEntry
 	for {
 		resp, err := s.readResponse()
 		if err != nil {
-			return nil, false, 0, err
+			return nil, err
 		}
 
 		switch resp.Type {
@@ -115,20 +149,32 @@ func (s *Session) Manifest(
 				Hash: resp.Hash,
 				Mode: resp.Mode,
 				Size: resp.Size,
+				Link: resp.Link,
+				Dir:  resp.IsDir,
+
+				MTime: resp.MTime,
 			})
 		case protocol.TypeManifestDone:
-			exists := resp.Exists != nil && *resp.Exists
-			elapsed := time.Duration(
-				resp.ElapsedMs,
-			) * time.Millisecond
-			return entries, exists, elapsed, nil
+			return &ManifestResult{
+				Entries: entries,
+				Exists:  resp.Exists != nil && *resp.Exists,
+				Elapsed: time.Duration(
+					resp.ElapsedMs,
+				) * time.Millisecond,
+				CacheHits:   resp.CacheHits,
+				CacheMisses: resp.CacheMisses,
+			}, nil
+		case protocol.TypeProgress:
+			if s.OnProgress != nil {
+				s.OnProgress(resp.Count, resp.Size)
+			}
 		case protocol.TypeError:
 			if resp.Fatal {
-				return nil, false, 0,
+				return nil,
 					fmt.Errorf("remote: %s", resp.Message)
 			}
 		default:
-			return nil, false, 0, fmt.Errorf(
+			return nil, fmt.Errorf(
 				"unexpected response: %s", resp.Type,
 			)
 		}
@@ -146,16 +192,30 @@ func (s *Session) Pack(
 	pathList []string,
 	dest string,
 	compress bool,
+) (*PackResult, error) {
+	return s.PackWith(
+		dir, pathList, dest,
+		protocol.PackOptions{Compress: compress},
+	)
+}
+
+func (s *Session) PackWith(
+	dir string,
+	pathList []string,
+	dest string,
+	opts protocol.PackOptions,
 ) (*PackResult, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	err := s.send(protocol.Request{
-		Cmd:      "pack",
-		Dir:      dir,
-		Paths:    pathList,
-		Dest:     dest,
-		Compress: compress,
+		Cmd:       "pack",
+		Dir:       dir,
+		Paths:     pathList,
+		Dest:      dest,
+		Compress:  opts.Compress,
+		CopyLinks: opts.CopyLinks,
+		NoParents: opts.NoParents,
 	})
 	if err != nil {
 		return nil, err
@@ -194,14 +254,93 @@ func (s *Session) Extract(
 	dir, src string,
 	compress bool,
 ) (*ExtractResult, error) {
+	return s.ExtractWith(
+		dir, src, pack.UnpackOptions{Compress: compress},
+	)
+}
+
+func (s *Session) ExtractWith(
+	dir, src string,
+	opts pack.UnpackOptions,
+) (*ExtractResult, error) {
+	return s.ExtractStaged(dir, src, "", opts)
+}
+
+// ExtractStaged extracts like ExtractWith but, when stage is
+// set, leaves the files beside their targets and lists them in
+// stage, a file under /tmp, for Commit.
+func (s *Session) ExtractStaged(
+	dir, src, stage string,
+	opts pack.UnpackOptions,
+) (*ExtractResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req := protocol.Request{
+		Cmd:          "extract",
+		Dir:          dir,
+		Src:          src,
+		Compress:     opts.Compress,
+		Times:        opts.Times,
+		Paths:        opts.Only,
+		Progress:     s.OnProgress != nil,
+		DelayUpdates: opts.DelayUpdates,
+		Stage:        stage,
+		Backup:       opts.Backup,
+	}
+	if d := opts.Delete; d != nil {
+		req.Delete = true
+		req.Protect = d.Protect
+		req.Filters = d.Exclude.Filters
+		req.Excludes = d.Exclude.Excludes
+		req.IgnoreFiles = d.Exclude.IgnoreFiles
+		req.DeleteExcluded = d.DeleteExcluded
+	}
+	if err := s.send(req); err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case protocol.TypeExtractDone:
+			return &ExtractResult{Count: resp.Count}, nil
+		case protocol.TypeProgress:
+			if s.OnProgress != nil {
+				s.OnProgress(resp.Count, resp.Size)
+			}
+		case protocol.TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("remote: %s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type CommitResult struct {
+	Count int
+}
+
+// Commit puts the files of every stage in place together, or
+// with abort removes them, and then removes the stages.
+func (s *Session) Commit(
+	stages []string, abort bool,
+) (*CommitResult, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	err := s.send(protocol.Request{
-		Cmd:      "extract",
-		Dir:      dir,
-		Src:      src,
-		Compress: compress,
+		Cmd:   "commit",
+		Paths: stages,
+		Abort: abort,
 	})
 	if err != nil {
 		return nil, err
@@ -213,8 +352,8 @@ func (s *Session) Extract(
 			return nil, err
 		}
 		switch resp.Type {
-		case protocol.TypeExtractDone:
-			return &ExtractResult{Count: resp.Count}, nil
+		case protocol.TypeCommitDone:
+			return &CommitResult{Count: resp.Count}, nil
 		case protocol.TypeError:
 			if resp.Fatal {
 				return nil,
@@ -228,21 +367,196 @@ func (s *Session) Extract(
 	}
 }
 
+// DeleteResult counts the files deleted in Count and the empty
+// directories removed in Dirs.
 type DeleteResult struct {
 	Count int
+	Dirs  int
 }
 
 func (s *Session) Delete(
 	dir string,
 	pathList []string,
+) (*DeleteResult, error) {
+	return s.DeleteWith(dir, pathList, pack.DeleteOptions{})
+}
+
+func (s *Session) DeleteWith(
+	dir string,
+	pathList []string,
+	opts pack.DeleteOptions,
 ) (*DeleteResult, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	err := s.send(protocol.Request{
-		Cmd:   "delete",
+		Cmd:            "delete",
+		Dir:            dir,
+		Paths:          pathList,
+		Backup:         opts.Backup,
+		Protect:        opts.Protect,
+		Filters:        opts.Exclude.Filters,
+		Excludes:       opts.Exclude.Excludes,
+		IgnoreFiles:    opts.Exclude.IgnoreFiles,
+		DeleteExcluded: opts.DeleteExcluded,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case protocol.TypeDeleteDone:
+			return &DeleteResult{
+				Count: resp.Count,
+				Dirs:  resp.Dirs,
+			}, nil
+		case protocol.TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("remote: %s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type ChmodResult struct {
+	Count int
+}
+
+func (s *Session) Chmod(
+	dir string,
+	modes map[string]int,
+) (*ChmodResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.send(protocol.Request{
+		Cmd:   "chmod",
+		Dir:   dir,
+		Modes: modes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case protocol.TypeChmodDone:
+			return &ChmodResult{Count: resp.Count}, nil
+		case protocol.TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("remote: %s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type CopyResult struct {
+	Count  int
+	Failed []string
+}
+
+func (s *Session) Copy(
+	dir string,
+	copies []pack.Copy,
+	times bool,
+) (*CopyResult, error) {
+	return s.CopyWith(dir, copies, times, nil)
+}
+
+// CopyWith copies files below dir, first saving into backup the
+// files it overwrites or renames away.
+func (s *Session) CopyWith(
+	dir string,
+	copies []pack.Copy,
+	times bool,
+	backup *pack.Backup,
+) (*CopyResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ops := make([]protocol.CopyOp, 0, len(copies))
+	for _, c := range copies {
+		ops = append(ops, protocol.CopyOp{
+			From:   c.From,
+			To:     c.To,
+			Mode:   c.Mode,
+			MTime:  c.MTime,
+			Rename: c.Rename,
+		})
+	}
+	err := s.send(protocol.Request{
+		Cmd:    "copy",
+		Dir:    dir,
+		Copies: ops,
+		Times:  times,
+		Backup: backup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case protocol.TypeCopyDone:
+			return &CopyResult{
+				Count:  resp.Count,
+				Failed: resp.Failed,
+			}, nil
+		case protocol.TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("remote: %s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type SignatureResult struct {
+	Dest  string
+	Size  int64
+	Count int
+}
+
+func (s *Session) Signature(
+	dir string,
+	pathList []string,
+	dest string,
+) (*SignatureResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.send(protocol.Request{
+		Cmd:   "signature",
 		Dir:   dir,
 		Paths: pathList,
+		Dest:  dest,
 	})
 	if err != nil {
 		return nil, err
@@ -254,8 +568,72 @@ func (s *Session) Delete(
 			return nil, err
 		}
 		switch resp.Type {
-		case protocol.TypeDeleteDone:
-			return &DeleteResult{Count: resp.Count}, nil
+		case protocol.TypeSignatureDone:
+			return &SignatureResult{
+				Dest:  resp.Dest,
+				Size:  resp.Size,
+				Count: resp.Count,
+			}, nil
+		case protocol.TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("remote: %s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type PatchResult struct {
+	Count  int
+	Failed []string
+}
+
+func (s *Session) Patch(
+	dir, src string,
+	opts pack.UnpackOptions,
+) (*PatchResult, error) {
+	return s.PatchStaged(dir, src, "", opts)
+}
+
+// PatchStaged patches like Patch but, when stage is set, leaves
+// the files beside their targets and lists them in stage for
+// Commit, as ExtractStaged does.
+func (s *Session) PatchStaged(
+	dir, src, stage string,
+	opts pack.UnpackOptions,
+) (*PatchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.send(protocol.Request{
+		Cmd:          "patch",
+		Dir:          dir,
+		Src:          src,
+		Compress:     opts.Compress,
+		Times:        opts.Times,
+		DelayUpdates: opts.DelayUpdates,
+		Stage:        stage,
+		Backup:       opts.Backup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case protocol.TypePatchDone:
+			return &PatchResult{
+				Count:  resp.Count,
+				Failed: resp.Failed,
+			}, nil
 		case protocol.TypeError:
 			if resp.Fatal {
 				return nil,
@@ -281,17 +659,34 @@ func (s *Session) Transfer(
 	compress bool,
 	url string,
 	token string,
+) (*TransferResult, error) {
+	return s.TransferWith(
+		dir, pathList, url, token,
+		protocol.TransferOptions{Compress: compress},
+	)
+}
+
+func (s *Session) TransferWith(
+	dir string,
+	pathList []string,
+	url string,
+	token string,
+	opts protocol.TransferOptions,
 ) (*TransferResult, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	err := s.send(protocol.Request{
-		Cmd:      "transfer",
-		Dir:      dir,
-		Paths:    pathList,
-		Compress: compress,
-		URL:      url,
-		Token:    token,
+		Cmd:       "transfer",
+		Dir:       dir,
+		Paths:     pathList,
+		Compress:  opts.Compress,
+		URL:       url,
+		Token:     token,
+		CopyLinks: opts.CopyLinks,
+		Progress:  s.OnProgress != nil,
+		BWLimit:   opts.BWLimit,
+		NoParents: opts.NoParents,
 	})
 	if err != nil {
 		return nil, err
@@ -309,6 +704,90 @@ func (s *Session) Transfer(
 				Size:  resp.Size,
 				Dest:  resp.Dest,
 			}, nil
+		case protocol.TypeProgress:
+			if s.OnProgress != nil {
+				s.OnProgress(resp.Count, resp.Size)
+			}
+		case protocol.TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("remote: %s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type ConcatResult struct {
+	Size int64
+}
+
+func (s *Session) Concat(
+	dest string,
+	parts []string,
+) (*ConcatResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.send(protocol.Request{
+		Cmd:   "concat",
+		Dest:  dest,
+		Paths: parts,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case protocol.TypeConcatDone:
+			return &ConcatResult{Size: resp.Size}, nil
+		case protocol.TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("remote: %s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type DiscardResult struct {
+	Count int
+}
+
+func (s *Session) Discard(
+	pathList []string,
+) (*DiscardResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.send(protocol.Request{
+		Cmd:   "discard",
+		Paths: pathList,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case protocol.TypeDiscardDone:
+			return &DiscardResult{Count: resp.Count}, nil
 		case protocol.TypeError:
 			if resp.Fatal {
 				return nil,
@@ -322,6 +801,85 @@ func (s *Session) Transfer(
 	}
 }
 
+// Backups lists the backup sets of dir under root, or under
+// the default root when it is "", oldest first.
+func (s *Session) Backups(dir, root string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.send(protocol.Request{
+		Cmd:    "backups",
+		Dir:    dir,
+		Backup: &pack.Backup{Root: root},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case protocol.TypeBackups:
+			return resp.Names, nil
+		case protocol.TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("%s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type RestoreResult struct {
+	Count int
+}
+
+// Restore moves the files in a backup set back into dir and
+// removes the set.
+func (s *Session) Restore(
+	dir string,
+	backup pack.Backup,
+) (*RestoreResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.send(protocol.Request{
+		Cmd:    "restore",
+		Dir:    dir,
+		Backup: &backup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case protocol.TypeRestoreDone:
+			return &RestoreResult{Count: resp.Count}, nil
+		case protocol.TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("%s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
 func (s *Session) Quit() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
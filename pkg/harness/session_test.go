@@ -1,19 +1,26 @@
 package harness
 
 import (
+	"bytes"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/paths"
 )
 
 func buildSpryncd(t *testing.T) string {
 	t.Helper()
+	t.Setenv("SPRYNC_STATE_DIR", t.TempDir())
 	bin := filepath.Join(t.TempDir(), "spryncd")
 	cmd := exec.Command(
 		"go", "build", "-o", bin, "./cmd/spryncd",
@@ -85,15 +92,19 @@ func TestManifestExistingDir(t *testing.T) {
 	entries, exists, _, err := s.Manifest(dir, nil)
 	require.NoError(t, err)
 	assert.True(t, exists)
-	assert.Len(t, entries, 3)
+	assert.Len(t, entries, 4)
 
 	pathSet := map[string]bool{}
 	for _, e := range entries {
 		pathSet[e.Path] = true
-		assert.NotEmpty(t, e.Hash)
 		assert.NotZero(t, e.Mode)
+		if e.Dir {
+			continue
+		}
+		assert.NotEmpty(t, e.Hash)
 		assert.NotZero(t, e.Size)
 	}
+	assert.True(t, pathSet["src"])
 	assert.True(t, pathSet["main.go"])
 	assert.True(t, pathSet["src/util.go"])
 	assert.True(t, pathSet["README.md"])
@@ -121,6 +132,118 @@ func TestManifestWithExcludes(t *testing.T) {
 	assert.Equal(t, "main.go", entries[0].Path)
 }
 
+func TestManifestOnly(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"main.go":        "package main",
+		"logs/a.log":     "a",
+		"logs/old/b.log": "b",
+		"src/util.go":    "package src",
+	})
+
+	result, err := s.ManifestWith(dir, pack.WalkOptions{
+		Only: []string{"logs", "main.go", "gone.txt"},
+	})
+	require.NoError(t, err)
+	var got []string
+	for _, e := range result.Entries {
+		got = append(got, e.Path)
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{
+		"logs", "logs/a.log", "logs/old", "logs/old/b.log",
+		"main.go",
+	}, got)
+
+	result, err = s.ManifestWith(dir, pack.WalkOptions{
+		Only: []string{},
+	})
+	require.NoError(t, err)
+	assert.Empty(t, result.Entries)
+
+	_, err = s.ManifestWith(dir, pack.WalkOptions{
+		Only: []string{"../escape"},
+	})
+	assert.Error(t, err)
+}
+
+func TestManifestIgnoreFiles(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		".gitignore":        "*.log\n/tmp/\n",
+		"main.go":           "package main",
+		"debug.log":         "x",
+		"tmp/scratch":       "x",
+		"src/.spryncignore": "!trace.log\n",
+		"src/trace.log":     "x",
+		"src/tmp/keep.go":   "package tmp",
+	})
+
+	local, err := pack.WalkLocal(dir, []string{"*.go"})
+	require.NoError(t, err)
+	entries, _, _, err := s.Manifest(dir, []string{"*.go"})
+	require.NoError(t, err)
+
+	remote := make(pack.Manifest)
+	for _, e := range entries {
+		remote[e.Path] = e
+	}
+	assert.Equal(t, local, remote)
+	assert.Contains(t, remote, "src/trace.log")
+	assert.Contains(t, remote, "src/tmp")
+	assert.NotContains(t, remote, "debug.log")
+	assert.NotContains(t, remote, "tmp")
+	assert.NotContains(t, remote, "main.go")
+}
+
+func TestManifestFilters(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"Cargo.toml":     "[package]",
+		"README.md":      "readme",
+		"src/main.rs":    "fn main() {}",
+		"src/gen/api.rs": "// generated",
+		"docs/a.toml":    "x = 1",
+	})
+
+	opts := pack.WalkOptions{Filters: []paths.FilterRule{
+		{Pattern: "src/gen"},
+		{Include: true, Pattern: "src/"},
+		{Include: true, Pattern: "src/**"},
+		{Include: true, Pattern: "/*.toml"},
+		{Pattern: "*"},
+	}}
+	local, err := pack.BuildManifest(dir, opts)
+	require.NoError(t, err)
+	result, err := s.ManifestWith(dir, opts)
+	require.NoError(t, err)
+
+	var got []string
+	for _, e := range result.Entries {
+		got = append(got, e.Path)
+		assert.Equal(t, local[e.Path], e)
+	}
+	sort.Strings(got)
+	assert.Equal(t,
+		[]string{"Cargo.toml", "src", "src/main.rs"}, got,
+	)
+}
+
 func TestManifestNonexistentDir(t *testing.T) {
 	bin := buildSpryncd(t)
 	s, err := Start(bin)
@@ -229,6 +352,172 @@ func TestExtractReal(t *testing.T) {
 	assert.Equal(t, "package hello", string(got))
 }
 
+func TestExtractDelayUpdates(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	srcDir := t.TempDir()
+	makeTree(t, srcDir, map[string]string{
+		"a.txt": "new a",
+		"b.txt": strings.Repeat("b", 4096),
+	})
+	var buf bytes.Buffer
+	_, err = pack.PackTar(
+		srcDir, []string{"a.txt", "b.txt"}, &buf, false,
+	)
+	require.NoError(t, err)
+
+	tarPath := "/tmp/sprync-delay-test.tar"
+	require.NoError(t, os.WriteFile(
+		tarPath, buf.Bytes()[:2048], 0644,
+	))
+	defer os.Remove(tarPath)
+
+	destDir := t.TempDir()
+	makeTree(t, destDir, map[string]string{"a.txt": "old a"})
+	_, err = s.ExtractWith(destDir, tarPath, pack.UnpackOptions{
+		DelayUpdates: true,
+	})
+	require.Error(t, err)
+
+	got, err := os.ReadFile(filepath.Join(destDir, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "old a", string(got))
+	names, err := os.ReadDir(destDir)
+	require.NoError(t, err)
+	assert.Len(t, names, 1)
+}
+
+func TestExtractStagedCommit(t *testing.T) {
+	bin := buildSpryncd(t)
+	var sessions []*Session
+	for range 2 {
+		s, err := Start(bin)
+		require.NoError(t, err)
+		defer s.Quit()
+		sessions = append(sessions, s)
+	}
+
+	srcDir := t.TempDir()
+	makeTree(t, srcDir, map[string]string{
+		"a.txt":     "new a",
+		"sub/b.txt": "new b",
+	})
+	destDir := t.TempDir()
+	makeTree(t, destDir, map[string]string{"a.txt": "old a"})
+
+	extract := func(i int, p string) string {
+		var buf bytes.Buffer
+		_, err := pack.PackTar(
+			srcDir, []string{p}, &buf, false,
+		)
+		require.NoError(t, err)
+		tarPath := fmt.Sprintf("/tmp/sprync-staged-test-%d.tar", i)
+		require.NoError(t, os.WriteFile(tarPath, buf.Bytes(), 0644))
+		stage := fmt.Sprintf("/tmp/sprync-staged-test-%d.stage", i)
+		_, err = sessions[i].ExtractStaged(
+			destDir, tarPath, stage, pack.UnpackOptions{},
+		)
+		require.NoError(t, err)
+		return stage
+	}
+	stages := []string{extract(0, "a.txt"), extract(1, "sub/b.txt")}
+
+	got, err := os.ReadFile(filepath.Join(destDir, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "old a", string(got))
+
+	result, err := sessions[0].Commit(stages, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Count)
+	got, err = os.ReadFile(filepath.Join(destDir, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "new a", string(got))
+	_, err = os.Stat(stages[0])
+	assert.True(t, os.IsNotExist(err))
+
+	makeTree(t, srcDir, map[string]string{"a.txt": "newer a"})
+	stages = []string{extract(1, "a.txt")}
+	_, err = sessions[0].Commit(stages, true)
+	require.NoError(t, err)
+	got, err = os.ReadFile(filepath.Join(destDir, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "new a", string(got))
+	names, err := os.ReadDir(destDir)
+	require.NoError(t, err)
+	assert.Len(t, names, 2)
+}
+
+func TestDeleteBackupRestore(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"keep.txt":  "keep",
+		"sub/x.txt": "x",
+	})
+	root := t.TempDir()
+	backup := &pack.Backup{Root: root, Name: "1"}
+	result, err := s.DeleteWith(
+		dir, []string{"sub", "sub/x.txt"},
+		pack.DeleteOptions{Backup: backup},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Count)
+	assert.Equal(t, 1, result.Dirs)
+
+	names, err := s.Backups(dir, root)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1"}, names)
+
+	restored, err := s.Restore(dir, *backup)
+	require.NoError(t, err)
+	assert.Equal(t, 1, restored.Count)
+	got, err := os.ReadFile(filepath.Join(dir, "sub/x.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "x", string(got))
+
+	_, err = s.Restore(dir, pack.Backup{Root: "tmp", Name: "1"})
+	assert.Error(t, err)
+}
+
+func TestDeleteProtect(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		".env":      "secret",
+		"build.log": "log",
+		"old.txt":   "old",
+	})
+	list := []string{".env", "build.log", "old.txt"}
+	opts := pack.DeleteOptions{
+		Protect: []string{".env"},
+		Exclude: paths.MatchOptions{Excludes: []string{"*.log"}},
+	}
+	result, err := s.DeleteWith(dir, list, opts)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Count)
+
+	opts.DeleteExcluded = true
+	result, err = s.DeleteWith(dir, list[:2], opts)
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Count)
+
+	_, err = os.Stat(filepath.Join(dir, ".env"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(dir, "build.log"))
+	assert.True(t, os.IsNotExist(err))
+}
+
 func TestDeleteStub(t *testing.T) {
 	bin := buildSpryncd(t)
 	s, err := Start(bin)
@@ -245,6 +534,166 @@ func TestDeleteStub(t *testing.T) {
 	assert.Equal(t, 1, result.Count)
 }
 
+func TestManifestRemoteCache(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"a.go":     "package a",
+		"sub/b.go": "package b",
+	})
+	old := time.Now().Add(-time.Hour)
+	for _, p := range []string{"a.go", "sub/b.go"} {
+		require.NoError(t,
+			os.Chtimes(filepath.Join(dir, p), old, old),
+		)
+	}
+
+	first, err := s.ManifestWith(dir, pack.WalkOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, first.CacheHits)
+	assert.Equal(t, 2, first.CacheMisses)
+
+	second, err := s.ManifestWith(dir, pack.WalkOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, second.CacheHits)
+	assert.Equal(t, 0, second.CacheMisses)
+	assert.ElementsMatch(t, first.Entries, second.Entries)
+
+	forced, err := s.ManifestWith(
+		dir, pack.WalkOptions{Checksum: true},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, 0, forced.CacheHits)
+	assert.Equal(t, 2, forced.CacheMisses)
+}
+
+func TestChmod(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"run.sh":  "#!/bin/sh",
+		"bin/x":   "x",
+		"keep.go": "package keep",
+	})
+
+	result, err := s.Chmod(dir, map[string]int{
+		"run.sh": 0755,
+		"bin":    0700,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Count)
+
+	info, err := os.Stat(filepath.Join(dir, "run.sh"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(dir, "bin"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	_, err = s.Chmod(dir, map[string]int{"../x": 0755})
+	assert.Error(t, err)
+}
+
+func TestCopy(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"old/lib.go": "package lib",
+	})
+
+	result, err := s.Copy(dir, []pack.Copy{
+		{From: "old/lib.go", To: "new/lib.go", Mode: 0644, Rename: true},
+		{From: "old/lib.go", To: "vendor/lib.go", Mode: 0600},
+		{From: "missing.go", To: "gone.go", Mode: 0644},
+	}, false)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Count)
+	assert.Equal(t, []string{"gone.go"}, result.Failed)
+
+	for _, p := range []string{"new/lib.go", "vendor/lib.go"} {
+		data, err := os.ReadFile(filepath.Join(dir, p))
+		require.NoError(t, err)
+		assert.Equal(t, "package lib", string(data))
+	}
+	_, err = os.Stat(filepath.Join(dir, "old/lib.go"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = s.Copy(dir, []pack.Copy{
+		{From: "new/lib.go", To: "../escape.go"},
+	}, false)
+	assert.Error(t, err)
+}
+
+func TestConcatExtractOnly(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{
+		"done.go": "package done",
+		"next.go": "package next",
+	})
+	var buf bytes.Buffer
+	_, err = pack.PackTar(
+		src, []string{"done.go", "next.go"}, &buf, true,
+	)
+	require.NoError(t, err)
+
+	data := buf.Bytes()
+	var parts []string
+	for _, chunk := range [][]byte{
+		data[:len(data)/2], data[len(data)/2:],
+	} {
+		f, err := os.CreateTemp("/tmp", "sprync-part-*")
+		require.NoError(t, err)
+		_, err = f.Write(chunk)
+		f.Close()
+		require.NoError(t, err)
+		parts = append(parts, f.Name())
+	}
+	dest := parts[0] + ".tar.gz"
+	defer os.Remove(dest)
+
+	joined, err := s.Concat(dest, parts)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(data)), joined.Size)
+
+	dst := t.TempDir()
+	result, err := s.ExtractWith(dst, dest, pack.UnpackOptions{
+		Compress: true,
+		Only:     []string{"next.go"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Count)
+	_, err = os.Stat(filepath.Join(dst, "done.go"))
+	assert.True(t, os.IsNotExist(err))
+
+	discarded, err := s.Discard(append(parts, "/tmp/../"+parts[0]))
+	require.NoError(t, err)
+	assert.Equal(t, 2, discarded.Count)
+	for _, p := range parts {
+		_, err := os.Stat(p)
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	_, err = s.Concat("/etc/sprync.tar", parts)
+	assert.Error(t, err)
+}
+
 func TestMultipleCommands(t *testing.T) {
 	bin := buildSpryncd(t)
 	s, err := Start(bin)
@@ -357,7 +806,7 @@ func TestManifestLargeTree(t *testing.T) {
 	entries, exists, _, err := s.Manifest(dir, nil)
 	require.NoError(t, err)
 	assert.True(t, exists)
-	assert.Len(t, entries, len(files))
+	assert.Len(t, entries, len(files)+26)
 }
 
 func TestQuit(t *testing.T) {
@@ -368,3 +817,46 @@ func TestQuit(t *testing.T) {
 	err = s.Quit()
 	assert.NoError(t, err)
 }
+
+func TestProgressUpdates(t *testing.T) {
+	bin := buildSpryncd(t)
+	s, err := Start(bin)
+	require.NoError(t, err)
+	defer s.Quit()
+
+	dir := t.TempDir()
+	files := map[string]string{}
+	for i := range 50 {
+		files[fmt.Sprintf("f%02d.txt", i)] = "data"
+	}
+	makeTree(t, dir, files)
+
+	var lastCount int
+	var lastSize int64
+	s.OnProgress = func(count int, size int64) {
+		assert.GreaterOrEqual(t, count, lastCount)
+		assert.GreaterOrEqual(t, size, lastSize)
+		lastCount, lastSize = count, size
+	}
+
+	entries, exists, _, err := s.Manifest(dir, nil)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Len(t, entries, len(files))
+	assert.LessOrEqual(t, lastCount, len(files))
+
+	tarPath := "/tmp/sprync-progress-test.tar.gz"
+	f, err := os.Create(tarPath)
+	require.NoError(t, err)
+	_, err = pack.PackTar(
+		dir, []string{"f00.txt", "f01.txt"}, f, true,
+	)
+	f.Close()
+	require.NoError(t, err)
+	defer os.Remove(tarPath)
+
+	lastCount, lastSize = 0, 0
+	result, err := s.Extract(t.TempDir(), tarPath, true)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Count)
+}
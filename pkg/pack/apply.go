@@ -0,0 +1,110 @@
+package pack
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/tqbf/sprync/pkg/paths"
+)
+
+func DeleteOrder(paths []string) []string {
+	out := append([]string(nil), paths...)
+	sort.Sort(sort.Reverse(sort.StringSlice(out)))
+	return out
+}
+
+func RemovePath(full string) error {
+	err := os.Remove(full)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func ChmodPath(full string, mode int) error {
+	info, err := os.Lstat(full)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return os.Chmod(full, os.FileMode(mode)&os.ModePerm)
+}
+
+// CopyOrder puts plain copies before renames so that a file
+// which is both copied and renamed is still there to copy.
+func CopyOrder(copies []Copy) []Copy {
+	out := append([]Copy(nil), copies...)
+	sort.SliceStable(out, func(i, j int) bool {
+		return !out[i].Rename && out[j].Rename
+	})
+	return out
+}
+
+func CopyPath(dir string, c Copy, times bool) error {
+	for _, p := range []string{c.From, c.To} {
+		if err := paths.CheckParents(dir, p); err != nil {
+			return err
+		}
+	}
+	src := filepath.Join(dir, c.From)
+	dst := filepath.Join(dir, c.To)
+
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("not a regular file: %s", c.From)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("mkdir parent: %w", err)
+	}
+
+	if c.Rename {
+		err = os.Rename(src, dst)
+	} else {
+		err = copyFile(src, dst)
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(dst, os.FileMode(c.Mode)&os.ModePerm)
+	if err != nil {
+		return err
+	}
+	if times {
+		mtime := time.Unix(c.MTime, 0)
+		return os.Chtimes(dst, mtime, mtime)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := createTemp(filepath.Dir(dst), "copy")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+
+	_, copyErr := io.Copy(out, in)
+	closeErr := out.Close()
+	if copyErr != nil {
+		return copyErr
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(out.Name(), dst)
+}
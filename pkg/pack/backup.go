@@ -0,0 +1,300 @@
+package pack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tqbf/sprync/pkg/paths"
+)
+
+var ErrNoBackup = errors.New("no backup")
+
+// Backup names a backup set: a directory under Root that files
+// are linked or moved into before a transfer replaces or deletes
+// them. A file already in the set is kept, so the set holds what
+// was there before the first change. A nil *Backup saves
+// nothing.
+type Backup struct {
+	Root string `json:"root,omitempty"`
+	Name string `json:"name"`
+}
+
+// NewBackupName names a set after when it was taken, so that
+// names sort oldest first.
+func NewBackupName(now time.Time) string {
+	return now.UTC().Format("20060102-150405.000")
+}
+
+// BackupRootIn returns the default backup root for dir under
+// stateDir.
+func BackupRootIn(stateDir, dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	name := hex.EncodeToString(sum[:16])
+	return filepath.Join(stateDir, "backups", name), nil
+}
+
+// Validate checks that the set is one directory below an
+// absolute root.
+func (b *Backup) Validate() error {
+	if !filepath.IsAbs(b.Root) {
+		return fmt.Errorf("backup root must be absolute: %q", b.Root)
+	}
+	if b.Name == "" || b.Name == "." || b.Name == ".." ||
+		strings.ContainsAny(b.Name, `/\`) {
+		return fmt.Errorf("invalid backup name: %q", b.Name)
+	}
+	return nil
+}
+
+func (b *Backup) path(rel string) string {
+	return filepath.Join(b.Root, b.Name, filepath.FromSlash(rel))
+}
+
+// Save copies rel in dir into the set, leaving it in place. It
+// hard links where it can. A directory is saved with everything
+// in it, for when a file or symlink is about to replace it.
+func (b *Backup) Save(dir, rel string) error {
+	if b == nil {
+		return nil
+	}
+	src := filepath.Join(dir, rel)
+	info, err := os.Lstat(src)
+	if err != nil {
+		return nil
+	}
+	if info.IsDir() {
+		return b.saveDir(dir, rel)
+	}
+	return b.saveEntry(src, rel, info)
+}
+
+func (b *Backup) saveDir(dir, rel string) error {
+	return filepath.WalkDir(filepath.Join(dir, rel), func(
+		p string, d fs.DirEntry, err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		r, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if err := os.MkdirAll(b.path(r), 0755); err != nil {
+				return fmt.Errorf("back up %s: %w", r, err)
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return b.saveEntry(p, r, info)
+	})
+}
+
+func (b *Backup) saveEntry(src, rel string, info fs.FileInfo) error {
+	dst, ok, err := b.reserve(rel)
+	if !ok {
+		return err
+	}
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	if err := copyEntry(src, dst, info); err != nil {
+		return fmt.Errorf("back up %s: %w", rel, err)
+	}
+	return nil
+}
+
+// SaveCopy saves the files that c overwrites or renames away.
+func (b *Backup) SaveCopy(dir string, c Copy) error {
+	if c.Rename {
+		if err := b.Save(dir, c.From); err != nil {
+			return err
+		}
+	}
+	return b.Save(dir, c.To)
+}
+
+// Remove moves rel in dir into the set, in place of deleting it.
+// Directories are recorded in the set but removed only when
+// empty, as RemovePath does.
+func (b *Backup) Remove(dir, rel string) error {
+	if b == nil {
+		return RemovePath(filepath.Join(dir, rel))
+	}
+	src := filepath.Join(dir, rel)
+	info, err := os.Lstat(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if err := os.MkdirAll(b.path(rel), 0755); err != nil {
+			return fmt.Errorf("back up %s: %w", rel, err)
+		}
+		return RemovePath(src)
+	}
+	dst, ok, err := b.reserve(rel)
+	if !ok {
+		if err != nil {
+			return err
+		}
+		return RemovePath(src)
+	}
+	if err := moveEntry(src, dst, info); err != nil {
+		return fmt.Errorf("back up %s: %w", rel, err)
+	}
+	return nil
+}
+
+// reserve returns where rel goes in the set, or false if the set
+// already has it.
+func (b *Backup) reserve(rel string) (string, bool, error) {
+	dst := b.path(rel)
+	if _, err := os.Lstat(dst); err == nil {
+		return "", false, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return "", false, fmt.Errorf("back up %s: %w", rel, err)
+	}
+	return dst, true, nil
+}
+
+func moveEntry(src, dst string, info fs.FileInfo) error {
+	if os.Rename(src, dst) == nil {
+		return nil
+	}
+	if err := copyEntry(src, dst, info); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyEntry copies a file or symlink, for when src and dst are
+// on different filesystems.
+func copyEntry(src, dst string, info fs.FileInfo) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		os.Remove(dst)
+		return os.Symlink(link, dst)
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+		return err
+	}
+	mtime := info.ModTime()
+	return os.Chtimes(dst, mtime, mtime)
+}
+
+// ListBackups returns the names of the sets under root, oldest
+// first.
+func ListBackups(root string) ([]string, error) {
+	ents, err := os.ReadDir(root)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range ents {
+		if e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// LatestBackup returns the newest set under root.
+func LatestBackup(root string) (*Backup, error) {
+	names, err := ListBackups(root)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, ErrNoBackup
+	}
+	return &Backup{Root: root, Name: names[len(names)-1]}, nil
+}
+
+// Restore moves every file in the set back into dir, replacing
+// what is there, and then removes the set. It returns the
+// number of files restored.
+func (b *Backup) Restore(dir string) (int, error) {
+	set := filepath.Join(b.Root, b.Name)
+	if _, err := os.Stat(set); err != nil {
+		if os.IsNotExist(err) {
+			return 0, fmt.Errorf("%s: %w", b.Name, ErrNoBackup)
+		}
+		return 0, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	count := 0
+	err := filepath.WalkDir(set, func(
+		p string, d fs.DirEntry, err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(set, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		if err := paths.CheckParents(dir, rel); err != nil {
+			return err
+		}
+		target := filepath.Join(dir, rel)
+		if d.IsDir() {
+			// A file or symlink may have replaced the directory.
+			cur, err := os.Lstat(target)
+			if err == nil && !cur.IsDir() {
+				if err := os.Remove(target); err != nil {
+					return fmt.Errorf("restore %s: %w", rel, err)
+				}
+			}
+			return os.MkdirAll(target, 0755)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		cur, err := os.Lstat(target)
+		if err == nil && cur.IsDir() {
+			return fmt.Errorf("restore %s: is a directory", rel)
+		}
+		if err := moveEntry(p, target, info); err != nil {
+			return fmt.Errorf("restore %s: %w", rel, err)
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		return count, err
+	}
+	return count, os.RemoveAll(set)
+}
@@ -0,0 +1,173 @@
+package pack
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	cacheVersion = 1
+	cacheAlgo    = "sha256"
+)
+
+// HashCache remembers file hashes keyed on their stat tuple
+// (size, mtime, inode) so unchanged files need not be reread.
+type HashCache struct {
+	path    string
+	written int64
+
+	mu      sync.Mutex
+	entries map[string]cacheEntry
+	seen    map[string]cacheEntry
+	hits    int
+	misses  int
+}
+
+type cacheEntry struct {
+	Size  int64  `json:"size"`
+	MTime int64  `json:"mtime_ns"`
+	Ino   uint64 `json:"ino"`
+	Hash  string `json:"hash"`
+}
+
+type cacheFile struct {
+	Version int                   `json:"version"`
+	Algo    string                `json:"algo"`
+	Written int64                 `json:"written_ns"`
+	Entries map[string]cacheEntry `json:"entries"`
+}
+
+func CachePath(dir string) (string, error) {
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return CachePathIn(filepath.Join(base, "sprync"), dir)
+}
+
+func CachePathIn(stateDir, dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	name := hex.EncodeToString(sum[:16]) + ".json"
+	return filepath.Join(stateDir, "manifests", name), nil
+}
+
+// OpenHashCache loads the cache at path. A missing, unreadable
+// or outdated cache file yields an empty cache.
+func OpenHashCache(path string) *HashCache {
+	c := &HashCache{
+		path:    path,
+		entries: make(map[string]cacheEntry),
+		seen:    make(map[string]cacheEntry),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c
+	}
+	var cf cacheFile
+	if json.Unmarshal(data, &cf) != nil ||
+		cf.Version != cacheVersion ||
+		cf.Algo != cacheAlgo {
+		return c
+	}
+	if cf.Entries != nil {
+		c.entries = cf.Entries
+	}
+	c.written = cf.Written
+	return c
+}
+
+func (c *HashCache) Lookup(
+	rel string, info fs.FileInfo,
+) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[rel]
+	if !ok || e != statEntry(info, e.Hash) {
+		return "", false
+	}
+	// A file modified within timestamp granularity of the
+	// last save could still change without its mtime moving.
+	if e.MTime >= c.written-int64(time.Second) {
+		return "", false
+	}
+	c.seen[rel] = e
+	c.hits++
+	return e.Hash, true
+}
+
+func (c *HashCache) Store(
+	rel string, info fs.FileInfo, hash string,
+) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seen[rel] = statEntry(info, hash)
+	c.misses++
+}
+
+// Stats reports how many files were served from the cache and
+// how many had to be hashed.
+func (c *HashCache) Stats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+// Save writes every entry looked up or stored since the cache
+// was opened; entries for files no longer present are dropped.
+func (c *HashCache) Save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := json.Marshal(cacheFile{
+		Version: cacheVersion,
+		Algo:    cacheAlgo,
+		Written: time.Now().UnixNano(),
+		Entries: c.seen,
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return fmt.Errorf("create cache dir: %w", err)
+	}
+	f, err := os.CreateTemp(
+		filepath.Dir(c.path), filepath.Base(c.path)+".*",
+	)
+	if err != nil {
+		return fmt.Errorf("write cache: %w", err)
+	}
+	_, writeErr := f.Write(data)
+	closeErr := f.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(f.Name(), c.path)
+	}
+	if writeErr != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("write cache: %w", writeErr)
+	}
+	return nil
+}
+
+func statEntry(info fs.FileInfo, hash string) cacheEntry {
+	return cacheEntry{
+		Size:  info.Size(),
+		MTime: info.ModTime().UnixNano(),
+		Ino:   fileIno(info),
+		Hash:  hash,
+	}
+}
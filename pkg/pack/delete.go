@@ -0,0 +1,168 @@
+package pack
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/tqbf/sprync/pkg/paths"
+)
+
+// DeleteOptions say what DeletePaths keeps and where it backs up
+// what it deletes.
+type DeleteOptions struct {
+	Backup *Backup
+	// Protect patterns match paths never to delete.
+	Protect []string
+	// Exclude is the filtering of the walk the deletes came from.
+	// The paths it excludes are kept unless DeleteExcluded is
+	// set.
+	Exclude        paths.MatchOptions
+	DeleteExcluded bool
+}
+
+// DeletePaths deletes paths below dir, deepest first, and returns
+// how many files and directories it deleted. Directories that
+// still hold anything are kept. It keeps the paths opts protect
+// or exclude, and their parents, and passes other failures to
+// onErr.
+func DeletePaths(
+	dir string,
+	list []string,
+	opts DeleteOptions,
+	onErr func(p string, err error),
+) (files, dirs int) {
+	protected := paths.NewMatcher("", paths.MatchOptions{
+		Excludes: opts.Protect,
+	})
+	var excluded *paths.ExcludeMatcher
+	if !opts.DeleteExcluded {
+		excluded = paths.NewMatcher(dir, opts.Exclude)
+	}
+
+	kept := make(map[string]bool)
+	for _, p := range DeleteOrder(list) {
+		if kept[p] || paths.CheckParents(dir, p) != nil {
+			continue
+		}
+		full := filepath.Join(dir, p)
+		info, err := os.Lstat(full)
+		isDir := err == nil && info.IsDir()
+		if protected.MatchPath(p, isDir) ||
+			excluded != nil && excluded.MatchPath(p, isDir) ||
+			isDir && hasEntries(full) {
+			markParents(kept, p)
+			continue
+		}
+		if err := opts.Backup.Remove(dir, p); err != nil {
+			onErr(p, err)
+			continue
+		}
+		if isDir {
+			dirs++
+		} else {
+			files++
+		}
+	}
+	return files, dirs
+}
+
+func hasEntries(dir string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	return err != io.EOF
+}
+
+// emptiedDirs returns the parents of deletes that neither
+// manifest has, as when they cover only some paths, so that
+// deleting them prunes the dirs the deletes leave empty.
+func emptiedDirs(
+	source, target Manifest, deletes []string,
+) []string {
+	if len(deletes) == 0 {
+		return nil
+	}
+	inSource := make(map[string]bool)
+	for p := range source {
+		inSource[p] = true
+		markParents(inSource, p)
+	}
+	seen := make(map[string]bool)
+	var dirs []string
+	for _, p := range deletes {
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			if seen[dir] || inSource[dir] {
+				break
+			}
+			seen[dir] = true
+			if _, ok := target[dir]; !ok {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	return dirs
+}
+
+// DeletesDir reports whether deleting p, planned against target,
+// removes a directory. The deletes target lacks are the parents
+// a diff prunes.
+func DeletesDir(target Manifest, p string) bool {
+	e, ok := target[p]
+	return !ok || e.Dir
+}
+
+// CountDeletes splits deletes, planned against target, into
+// files and directories.
+func CountDeletes(
+	deletes []string, target Manifest,
+) (files, dirs int) {
+	for _, p := range deletes {
+		if DeletesDir(target, p) {
+			dirs++
+		} else {
+			files++
+		}
+	}
+	return files, dirs
+}
+
+// protect drops from d the deletes of target paths that patterns
+// match, and of their parents, and turns renames away from them
+// into copies.
+func protect(d *DiffResult, target Manifest, patterns []string) {
+	if len(patterns) == 0 {
+		return
+	}
+	m := paths.NewExcludeMatcher(patterns)
+	kept := make(map[string]bool)
+	for i, c := range d.Copies {
+		if c.Rename && m.MatchPath(c.From, false) {
+			d.Copies[i].Rename = false
+			markParents(kept, c.From)
+		}
+	}
+	for _, p := range d.Deletes {
+		if m.MatchPath(p, target[p].Dir) {
+			kept[p] = true
+			markParents(kept, p)
+		}
+	}
+	var deletes []string
+	for _, p := range d.Deletes {
+		if !kept[p] {
+			deletes = append(deletes, p)
+		}
+	}
+	d.Deletes = deletes
+}
+
+func markParents(kept map[string]bool, p string) {
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		kept[dir] = true
+	}
+}
@@ -0,0 +1,326 @@
+package pack
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tqbf/sprync/pkg/delta"
+	"github.com/tqbf/sprync/pkg/paths"
+)
+
+type fileSignature struct {
+	Path string
+	Sig  delta.Signature
+}
+
+type deltaHeader struct {
+	Path      string
+	Hash      string
+	Mode      int
+	MTime     int64
+	BlockSize int
+}
+
+// deltaRecord is one element of a delta stream: a header
+// opening a file, an op for the current file, or its end.
+type deltaRecord struct {
+	Header *deltaHeader
+	Op     *delta.Op
+	End    bool
+}
+
+func WriteSignatures(
+	dir string,
+	filePaths []string,
+	w io.Writer,
+) (int, error) {
+	enc := gob.NewEncoder(w)
+	count := 0
+	for _, rel := range filePaths {
+		abs, err := checkedPath(dir, rel)
+		if err != nil {
+			return count, err
+		}
+		sig, err := signFile(abs)
+		if err != nil {
+			return count, fmt.Errorf("sign %s: %w", rel, err)
+		}
+		if sig == nil {
+			continue
+		}
+		err = enc.Encode(fileSignature{Path: rel, Sig: *sig})
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+func signFile(abs string) (*delta.Signature, error) {
+	info, err := os.Lstat(abs)
+	if err != nil || !info.Mode().IsRegular() {
+		return nil, nil
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return delta.Sign(f, info.Size())
+}
+
+func ReadSignatures(
+	r io.Reader,
+) (map[string]*delta.Signature, error) {
+	dec := gob.NewDecoder(r)
+	sigs := make(map[string]*delta.Signature)
+	for {
+		var fs fileSignature
+		err := dec.Decode(&fs)
+		if err == io.EOF {
+			return sigs, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read signatures: %w", err)
+		}
+		sigs[fs.Path] = &fs.Sig
+	}
+}
+
+// PackDelta writes a delta stream that rebuilds each entry in
+// entries from the remote copy described by its signature. It
+// returns the number of literal bytes in the stream.
+func PackDelta(
+	dir string,
+	entries []ManifestEntry,
+	sigs map[string]*delta.Signature,
+	w io.Writer,
+	compress bool,
+) (int64, error) {
+	if compress {
+		gw := gzip.NewWriter(w)
+		defer gw.Close()
+		w = gw
+	}
+	enc := gob.NewEncoder(w)
+
+	var literal int64
+	for _, e := range entries {
+		sig, ok := sigs[e.Path]
+		if !ok {
+			continue
+		}
+		abs, err := checkedPath(dir, e.Path)
+		if err != nil {
+			return literal, err
+		}
+		f, err := os.Open(abs)
+		if err != nil {
+			return literal, fmt.Errorf("open %s: %w", e.Path, err)
+		}
+
+		err = enc.Encode(deltaRecord{Header: &deltaHeader{
+			Path:      e.Path,
+			Hash:      e.Hash,
+			Mode:      e.Mode,
+			MTime:     e.MTime,
+			BlockSize: sig.BlockSize,
+		}})
+		if err == nil {
+			err = delta.Diff(sig, f, func(op delta.Op) error {
+				literal += int64(len(op.Data))
+				return enc.Encode(deltaRecord{Op: &op})
+			})
+		}
+		f.Close()
+		if err != nil {
+			return literal, fmt.Errorf("delta %s: %w", e.Path, err)
+		}
+		if err := enc.Encode(deltaRecord{End: true}); err != nil {
+			return literal, err
+		}
+	}
+	return literal, nil
+}
+
+// ApplyDelta rebuilds files from a delta stream. A file whose
+// result does not match the expected hash is left untouched and
+// reported in failed so the caller can send it whole. It puts
+// files in place as UnpackTarWith does, honouring DelayUpdates
+// and Stage.
+func ApplyDelta(
+	r io.Reader,
+	dir string,
+	opts UnpackOptions,
+) (int, []string, error) {
+	if !opts.DelayUpdates || opts.Stage != nil {
+		return applyDelta(r, dir, opts)
+	}
+	opts.Stage = NewStage()
+	count, failed, err := applyDelta(r, dir, opts)
+	if err != nil {
+		opts.Stage.Abort()
+		return count, failed, err
+	}
+	return count, failed, opts.Stage.Commit()
+}
+
+func applyDelta(
+	r io.Reader,
+	dir string,
+	opts UnpackOptions,
+) (count int, failed []string, err error) {
+	if opts.Compress {
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return 0, nil, fmt.Errorf("gzip reader: %w", err)
+		}
+		defer gr.Close()
+		r = gr
+	}
+	dec := gob.NewDecoder(r)
+
+	for {
+		var rec deltaRecord
+		err := dec.Decode(&rec)
+		if err == io.EOF {
+			return count, failed, nil
+		}
+		if err != nil {
+			return count, failed,
+				fmt.Errorf("read delta: %w", err)
+		}
+		if rec.Header == nil {
+			return count, failed,
+				fmt.Errorf("delta: expected file header")
+		}
+
+		ok, err := applyFile(dec, dir, rec.Header, opts)
+		if err != nil {
+			return count, failed, err
+		}
+		if !ok {
+			failed = append(failed, rec.Header.Path)
+			continue
+		}
+		count++
+	}
+}
+
+func applyFile(
+	dec *gob.Decoder,
+	dir string,
+	hdr *deltaHeader,
+	opts UnpackOptions,
+) (bool, error) {
+	target, err := checkedPath(dir, hdr.Path)
+	if err != nil {
+		return false, err
+	}
+	if err := paths.CheckParents(dir, hdr.Path); err != nil {
+		return false, err
+	}
+
+	info, err := os.Lstat(target)
+	if err != nil || !info.Mode().IsRegular() {
+		return false, skipOps(dec)
+	}
+	base, err := os.Open(target)
+	if err != nil {
+		return false, skipOps(dec)
+	}
+	defer base.Close()
+
+	tmp, err := createTemp(filepath.Dir(target), "delta")
+	if err != nil {
+		return false, fmt.Errorf("create temp: %w", err)
+	}
+	placed := false
+	defer func() {
+		if !placed {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	h := sha256.New()
+	out := io.MultiWriter(tmp, h)
+	var writeErr error
+	for {
+		var rec deltaRecord
+		if err := dec.Decode(&rec); err != nil {
+			tmp.Close()
+			return false, fmt.Errorf("read delta: %w", err)
+		}
+		if rec.End {
+			break
+		}
+		if rec.Op != nil && writeErr == nil {
+			writeErr = delta.Apply(
+				base, hdr.BlockSize, *rec.Op, out,
+			)
+		}
+	}
+	closeErr := tmp.Close()
+	if writeErr != nil {
+		return false, fmt.Errorf("patch %s: %w", hdr.Path, writeErr)
+	}
+	if closeErr != nil {
+		return false, fmt.Errorf("patch %s: %w", hdr.Path, closeErr)
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hdr.Hash {
+		return false, nil
+	}
+
+	err = os.Chmod(tmp.Name(), os.FileMode(hdr.Mode&0777))
+	if err != nil {
+		return false, fmt.Errorf("chmod %s: %w", hdr.Path, err)
+	}
+	if opts.Times {
+		mtime := time.Unix(hdr.MTime, 0)
+		err := os.Chtimes(tmp.Name(), mtime, mtime)
+		if err != nil {
+			return false, fmt.Errorf(
+				"chtimes %s: %w", hdr.Path, err,
+			)
+		}
+	}
+	if err := opts.Backup.Save(dir, hdr.Path); err != nil {
+		return false, err
+	}
+	placed = true
+	if err := place(opts.Stage, tmp.Name(), target); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func skipOps(dec *gob.Decoder) error {
+	for {
+		var rec deltaRecord
+		if err := dec.Decode(&rec); err != nil {
+			return fmt.Errorf("read delta: %w", err)
+		}
+		if rec.End {
+			return nil
+		}
+	}
+}
+
+func checkedPath(dir, rel string) (string, error) {
+	if err := paths.ValidateRelPath(rel); err != nil {
+		return "", fmt.Errorf("invalid path %s: %w", rel, err)
+	}
+	abs := filepath.Join(dir, rel)
+	if !paths.IsWithinDir(dir, abs) {
+		return "", fmt.Errorf("path escapes dir: %s", rel)
+	}
+	return abs, nil
+}
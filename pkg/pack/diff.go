@@ -5,22 +5,62 @@ import "sort"
 type DiffResult struct {
 	Uploads []string
 	Deletes []string
+	Chmods  []string
+	Copies  []Copy
+}
+
+// Copy recreates To on the target from a file already there
+// with the same content. A rename moves From, which would
+// otherwise have been deleted.
+type Copy struct {
+	From   string
+	To     string
+	Mode   int
+	MTime  int64
+	Rename bool
+}
+
+func (d DiffResult) Empty() bool {
+	return len(d.Uploads) == 0 &&
+		len(d.Deletes) == 0 &&
+		len(d.Chmods) == 0 &&
+		len(d.Copies) == 0
+}
+
+type DiffOptions struct {
+	Delete  bool
+	Times   bool
+	Renames bool
+	// Protect patterns match target paths never to delete.
+	Protect []string
 }
 
 func ComputeDiff(
 	local, remote Manifest,
 	deleteEnabled bool,
+) DiffResult {
+	return ComputeDiffWith(
+		local, remote, DiffOptions{Delete: deleteEnabled},
+	)
+}
+
+func ComputeDiffWith(
+	local, remote Manifest,
+	opts DiffOptions,
 ) DiffResult {
 	var result DiffResult
 
 	for path, le := range local {
 		re, exists := remote[path]
-		if !exists || le.Hash != re.Hash {
+		switch {
+		case !exists || contentDiffers(le, re, opts.Times):
 			result.Uploads = append(result.Uploads, path)
+		case le.Mode != re.Mode && !le.IsSymlink():
+			result.Chmods = append(result.Chmods, path)
 		}
 	}
 
-	if deleteEnabled {
+	if opts.Delete {
 		for path := range remote {
 			if _, exists := local[path]; !exists {
 				result.Deletes = append(
@@ -28,9 +68,90 @@ func ComputeDiff(
 				)
 			}
 		}
+		result.Deletes = append(result.Deletes,
+			emptiedDirs(local, remote, result.Deletes)...,
+		)
 	}
 
 	sort.Strings(result.Uploads)
 	sort.Strings(result.Deletes)
+	sort.Strings(result.Chmods)
+	if opts.Renames {
+		detectCopies(local, remote, &result)
+	}
+	protect(&result, remote, opts.Protect)
 	return result
 }
+
+// detectCopies turns uploads of new files whose content already
+// exists on the target into copies, preferring to rename a file
+// that is about to be deleted.
+func detectCopies(local, remote Manifest, result *DiffResult) {
+	remotePaths := make([]string, 0, len(remote))
+	for p := range remote {
+		remotePaths = append(remotePaths, p)
+	}
+	sort.Strings(remotePaths)
+
+	byHash := make(map[string][]string)
+	for _, p := range remotePaths {
+		if e := remote[p]; copyable(e) {
+			byHash[e.Hash] = append(byHash[e.Hash], p)
+		}
+	}
+	deleting := make(map[string]bool, len(result.Deletes))
+	for _, p := range result.Deletes {
+		deleting[p] = true
+	}
+
+	var uploads []string
+	renamed := make(map[string]bool)
+	for _, p := range result.Uploads {
+		le := local[p]
+		_, onRemote := remote[p]
+		srcs := byHash[le.Hash]
+		if onRemote || !copyable(le) || len(srcs) == 0 {
+			uploads = append(uploads, p)
+			continue
+		}
+		c := Copy{
+			From:  srcs[0],
+			To:    p,
+			Mode:  le.Mode,
+			MTime: le.MTime,
+		}
+		for _, src := range srcs {
+			if deleting[src] && !renamed[src] {
+				c.From, c.Rename = src, true
+				renamed[src] = true
+				break
+			}
+		}
+		result.Copies = append(result.Copies, c)
+	}
+	result.Uploads = uploads
+
+	var deletes []string
+	for _, p := range result.Deletes {
+		if !renamed[p] {
+			deletes = append(deletes, p)
+		}
+	}
+	result.Deletes = deletes
+}
+
+func copyable(e ManifestEntry) bool {
+	return !e.Dir && !e.IsSymlink() && e.Size > 0
+}
+
+func contentDiffers(a, b ManifestEntry, times bool) bool {
+	return a.Hash != b.Hash || a.Link != b.Link ||
+		a.Dir != b.Dir || (times && timesDiffer(a, b))
+}
+
+func timesDiffer(a, b ManifestEntry) bool {
+	if a.Dir || a.IsSymlink() {
+		return false
+	}
+	return a.MTime != b.MTime
+}
@@ -5,6 +5,14 @@ type ManifestEntry struct {
 	Hash string `json:"hash"`
 	Mode int    `json:"mode"`
 	Size int64  `json:"size"`
+	Link string `json:"link,omitempty"`
+	Dir  bool   `json:"dir,omitempty"`
+
+	MTime int64 `json:"mtime,omitempty"`
+}
+
+func (e ManifestEntry) IsSymlink() bool {
+	return e.Link != ""
 }
 
 type Manifest map[string]ManifestEntry
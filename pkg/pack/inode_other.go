@@ -0,0 +1,9 @@
+//go:build !unix
+
+package pack
+
+import "io/fs"
+
+func fileIno(info fs.FileInfo) uint64 {
+	return 0
+}
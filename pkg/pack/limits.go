@@ -0,0 +1,58 @@
+package pack
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrDeleteLimit = errors.New("delete limit exceeded")
+
+// DeleteLimits guard against deleting far more than meant, as
+// when the source is the wrong dir or an empty mount. They count
+// files, not the directories that go with them. Zero means no
+// limit.
+type DeleteLimits struct {
+	Max int
+	// MaxPercent is of the files on the target.
+	MaxPercent float64
+}
+
+// CheckDeletes returns an error when diff, computed from source
+// against target, deletes more than limits allow. It always
+// refuses to empty the target because the source is empty.
+func CheckDeletes(
+	diff DiffResult, source, target Manifest, limits DeleteLimits,
+) error {
+	n, _ := CountDeletes(diff.Deletes, target)
+	switch {
+	case len(diff.Deletes) == 0:
+		return nil
+	case len(source) == 0:
+		return fmt.Errorf(
+			"%w: source is empty, refusing to empty the target",
+			ErrDeleteLimit,
+		)
+	case limits.Max > 0 && n > limits.Max:
+		return fmt.Errorf(
+			"%w: %d files to delete, --max-delete is %d",
+			ErrDeleteLimit, n, limits.Max,
+		)
+	}
+	files := 0
+	for _, e := range target {
+		if !e.Dir {
+			files++
+		}
+	}
+	if limits.MaxPercent > 0 && files > 0 {
+		pct := 100 * float64(n) / float64(files)
+		if pct > limits.MaxPercent {
+			return fmt.Errorf(
+				"%w: %d files is %.1f%% of the target, "+
+					"--max-delete-percent is %g",
+				ErrDeleteLimit, n, pct, limits.MaxPercent,
+			)
+		}
+	}
+	return nil
+}
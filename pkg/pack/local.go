@@ -6,11 +6,8 @@ import (
 	"io"
 	"io/fs"
 	"os"
-	"path/filepath"
 	"runtime"
 	"sync"
-
-	"github.com/tqbf/sprync/pkg/paths"
 )
 
 type fileJob struct {
@@ -27,38 +24,65 @@ func WalkLocal(
 	dir string,
 	excludes []string,
 ) (Manifest, error) {
-	matcher := paths.NewExcludeMatcher(excludes)
+	return BuildManifest(dir, WalkOptions{
+		Excludes:    excludes,
+		IgnoreFiles: DefaultIgnoreFiles,
+	})
+}
 
-	var jobs []fileJob
-	err := filepath.WalkDir(
-		dir,
-		func(p string, d fs.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-			rel, err := filepath.Rel(dir, p)
+func BuildManifest(
+	dir string,
+	opts WalkOptions,
+) (Manifest, error) {
+	var (
+		jobs  []fileJob
+		other []ManifestEntry
+	)
+	err := WalkTree(dir, opts,
+		func(rel, abs string, info fs.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			rel = filepath.ToSlash(rel)
-			if rel == "." {
+			if info.IsDir() {
+				other = append(other, ManifestEntry{
+					Path:  rel,
+					Mode:  int(info.Mode().Perm()),
+					Dir:   true,
+					MTime: info.ModTime().Unix(),
+				})
 				return nil
 			}
-			if matcher.Match(rel) {
-				if d.IsDir() {
-					return filepath.SkipDir
+			if info.Mode()&fs.ModeSymlink != 0 {
+				target, err := os.Readlink(abs)
+				if err != nil {
+					return err
 				}
+				other = append(other, ManifestEntry{
+					Path:  rel,
+					Mode:  int(info.Mode().Perm()),
+					Link:  target,
+					MTime: info.ModTime().Unix(),
+				})
 				return nil
 			}
-			if d.IsDir() {
-				return nil
-			}
-			if !d.Type().IsRegular() {
-				return nil
+			if opts.Cache != nil && !opts.Checksum {
+				if hash, ok := opts.Cache.Lookup(rel, info); ok {
+					other = append(other, ManifestEntry{
+						Path:  rel,
+						Hash:  hash,
+						Mode:  int(info.Mode().Perm()),
+						Size:  info.Size(),
+						MTime: info.ModTime().Unix(),
+					})
+					if opts.Progress != nil {
+						opts.Progress(1, info.Size())
+					}
+					return nil
+				}
 			}
 			jobs = append(jobs, fileJob{
 				relPath: rel,
-				absPath: p,
+				absPath: abs,
 			})
 			return nil
 		},
@@ -71,8 +95,12 @@ func WalkLocal(
 	if workers > len(jobs) {
 		workers = len(jobs)
 	}
+	manifest := make(Manifest, len(jobs)+len(other))
+	for _, e := range other {
+		manifest[e.Path] = e
+	}
 	if workers == 0 {
-		return Manifest{}, nil
+		return manifest, nil
 	}
 
 	jobCh := make(chan fileJob, len(jobs))
@@ -83,7 +111,7 @@ func WalkLocal(
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			hashWorker(jobCh, resultCh)
+			hashWorker(jobCh, resultCh, opts.Cache)
 		}()
 	}
 
@@ -92,15 +120,19 @@ func WalkLocal(
 	}
 	close(jobCh)
 
-	wg.Wait()
-	close(resultCh)
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
 
-	manifest := make(Manifest, len(jobs))
 	for r := range resultCh {
 		if r.err != nil {
 			return nil, r.err
 		}
 		manifest[r.entry.Path] = r.entry
+		if opts.Progress != nil {
+			opts.Progress(1, r.entry.Size)
+		}
 	}
 	return manifest, nil
 }
@@ -108,10 +140,14 @@ func WalkLocal(
 func hashWorker(
 	jobs <-chan fileJob,
 	results chan<- hashResult,
+	cache *HashCache,
 ) {
 	buf := make([]byte, 1<<20)
 	for j := range jobs {
-		entry, err := hashFile(j.absPath, j.relPath, buf)
+		entry, info, err := hashFile(j.absPath, j.relPath, buf)
+		if err == nil && cache != nil {
+			cache.Store(j.relPath, info, entry.Hash)
+		}
 		results <- hashResult{entry, err}
 	}
 }
@@ -119,27 +155,28 @@ func hashWorker(
 func hashFile(
 	absPath, relPath string,
 	buf []byte,
-) (ManifestEntry, error) {
+) (ManifestEntry, fs.FileInfo, error) {
 	f, err := os.Open(absPath)
 	if err != nil {
-		return ManifestEntry{}, err
+		return ManifestEntry{}, nil, err
 	}
 	defer f.Close()
 
 	info, err := f.Stat()
 	if err != nil {
-		return ManifestEntry{}, err
+		return ManifestEntry{}, nil, err
 	}
 
 	h := sha256.New()
 	if _, err := io.CopyBuffer(h, f, buf); err != nil {
-		return ManifestEntry{}, err
+		return ManifestEntry{}, nil, err
 	}
 
 	return ManifestEntry{
-		Path: relPath,
-		Hash: hex.EncodeToString(h.Sum(nil)),
-		Mode: int(info.Mode().Perm()),
-		Size: info.Size(),
-	}, nil
+		Path:  relPath,
+		Hash:  hex.EncodeToString(h.Sum(nil)),
+		Mode:  int(info.Mode().Perm()),
+		Size:  info.Size(),
+		MTime: info.ModTime().Unix(),
+	}, info, nil
 }
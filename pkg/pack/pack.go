@@ -13,14 +13,37 @@ import (
 	"github.com/tqbf/sprync/pkg/paths"
 )
 
+// ProgressFunc is called as work completes with the number of
+// files and bytes finished since the previous call.
+type ProgressFunc func(files int, bytes int64)
+
+type PackOptions struct {
+	Compress  bool
+	CopyLinks bool
+	// NoParents leaves out the headers for the parents of
+	// paths, for tarballs unpacked alongside others into the
+	// same dirs.
+	NoParents bool
+	Progress  ProgressFunc
+}
+
 func PackTar(
 	dir string,
 	filePaths []string,
 	w io.Writer,
 	compress bool,
+) (int, error) {
+	return PackTarWith(dir, filePaths, w, PackOptions{Compress: compress})
+}
+
+func PackTarWith(
+	dir string,
+	filePaths []string,
+	w io.Writer,
+	opts PackOptions,
 ) (int, error) {
 	var tw *tar.Writer
-	if compress {
+	if opts.Compress {
 		gw := gzip.NewWriter(w)
 		defer gw.Close()
 		tw = tar.NewWriter(gw)
@@ -29,38 +52,92 @@ func PackTar(
 	}
 	defer tw.Close()
 
-	dirs := collectDirs(filePaths)
+	for _, rel := range filePaths {
+		if err := paths.ValidateRelPath(rel); err != nil {
+			return 0, fmt.Errorf("invalid path %s: %w", rel, err)
+		}
+		abs := filepath.Join(dir, rel)
+		if !paths.IsWithinDir(dir, abs) {
+			return 0, fmt.Errorf("path escapes dir: %s", rel)
+		}
+	}
+
+	var dirs []string
+	if !opts.NoParents {
+		dirs = collectDirs(filePaths)
+	}
 	for _, d := range dirs {
-		err := tw.WriteHeader(&tar.Header{
-			Typeflag: tar.TypeDir,
-			Name:     d + "/",
-			Mode:     0755,
-			ModTime:  time.Time{},
-		})
+		info, err := os.Stat(filepath.Join(dir, d))
 		if err != nil {
-			return 0, fmt.Errorf("write dir header: %w", err)
+			return 0, fmt.Errorf("stat dir %s: %w", d, err)
+		}
+		if err := addDirToTar(tw, d, info); err != nil {
+			return 0, err
 		}
 	}
+	written := make(map[string]bool, len(dirs))
+	for _, d := range dirs {
+		written[d] = true
+	}
 
 	count := 0
 	for _, rel := range filePaths {
-		if err := paths.ValidateRelPath(rel); err != nil {
-			return 0, fmt.Errorf("invalid path %s: %w", rel, err)
-		}
 		abs := filepath.Join(dir, rel)
-		if !paths.IsWithinDir(dir, abs) {
-			return 0, fmt.Errorf("path escapes dir: %s", rel)
+		stat := os.Lstat
+		if opts.CopyLinks {
+			stat = os.Stat
+		}
+		info, err := stat(abs)
+		if err != nil {
+			return 0, fmt.Errorf("stat %s: %w", rel, err)
 		}
 
-		if err := addFileToTar(tw, abs, rel); err != nil {
+		switch {
+		case info.IsDir():
+			if written[rel] {
+				continue
+			}
+			written[rel] = true
+			err = addDirToTar(tw, rel, info)
+		case info.Mode()&os.ModeSymlink != 0:
+			err = addSymlinkToTar(tw, abs, rel, info)
+			count++
+		default:
+			err = addFileToTar(tw, abs, rel)
+			count++
+		}
+		if err != nil {
 			return 0, err
 		}
-		count++
+		if opts.Progress != nil && !info.IsDir() {
+			size := int64(0)
+			if info.Mode().IsRegular() {
+				size = info.Size()
+			}
+			opts.Progress(1, size)
+		}
 	}
 
 	return count, nil
 }
 
+func addDirToTar(
+	tw *tar.Writer,
+	relPath string,
+	info os.FileInfo,
+) error {
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     relPath + "/",
+		Mode:     int64(info.Mode().Perm()),
+		ModTime:  info.ModTime().Truncate(time.Second),
+	})
+	if err != nil {
+		return fmt.Errorf("write dir header: %w", err)
+	}
+	return nil
+}
+
 func addFileToTar(
 	tw *tar.Writer,
 	absPath, relPath string,
@@ -80,7 +157,7 @@ func addFileToTar(
 		Name:    relPath,
 		Mode:    int64(info.Mode().Perm()),
 		Size:    info.Size(),
-		ModTime: time.Time{},
+		ModTime: info.ModTime().Truncate(time.Second),
 	}
 	if err := tw.WriteHeader(hdr); err != nil {
 		return fmt.Errorf("write header %s: %w", relPath, err)
@@ -91,6 +168,28 @@ func addFileToTar(
 	return nil
 }
 
+func addSymlinkToTar(
+	tw *tar.Writer,
+	absPath, relPath string,
+	info os.FileInfo,
+) error {
+	target, err := os.Readlink(absPath)
+	if err != nil {
+		return fmt.Errorf("readlink %s: %w", relPath, err)
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeSymlink,
+		Name:     relPath,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  info.ModTime().Truncate(time.Second),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("write header %s: %w", relPath, err)
+	}
+	return nil
+}
+
 func collectDirs(filePaths []string) []string {
 	seen := make(map[string]bool)
 	var result []string
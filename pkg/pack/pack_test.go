@@ -1,11 +1,20 @@
 package pack
 
 import (
+	"archive/tar"
+	"bytes"
+	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/tqbf/sprync/pkg/paths"
 )
 
 func makeTree(t *testing.T, dir string, files map[string]string) {
@@ -30,9 +39,11 @@ func TestWalkLocal(t *testing.T) {
 		"node_modules", "*.pyc",
 	})
 	assert.NoError(t, err)
-	assert.Len(t, m, 2)
+	assert.Len(t, m, 3)
 	assert.Contains(t, m, "main.go")
 	assert.Contains(t, m, "src/util.go")
+	assert.True(t, m["src"].Dir)
+	assert.NotContains(t, m, "node_modules")
 	assert.NotContains(t, m, "node_modules/a.js")
 	assert.NotContains(t, m, "test.pyc")
 }
@@ -116,3 +127,1214 @@ func TestComputeDiffDisjoint(t *testing.T) {
 	assert.Equal(t, []string{"a.go"}, diff.Uploads)
 	assert.Equal(t, []string{"b.go"}, diff.Deletes)
 }
+
+func TestWalkLocalSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"bin/python3": "#!elf",
+	})
+	assert.NoError(t, os.Symlink(
+		"python3", filepath.Join(dir, "bin/python"),
+	))
+
+	m, err := WalkLocal(dir, nil)
+	assert.NoError(t, err)
+	assert.Len(t, m, 3)
+	assert.True(t, m["bin/python"].IsSymlink())
+	assert.Equal(t, "python3", m["bin/python"].Link)
+	assert.False(t, m["bin/python3"].IsSymlink())
+
+	m, err = BuildManifest(dir, WalkOptions{CopyLinks: true})
+	assert.NoError(t, err)
+	assert.Len(t, m, 3)
+	assert.False(t, m["bin/python"].IsSymlink())
+	assert.Equal(t, m["bin/python3"].Hash, m["bin/python"].Hash)
+}
+
+func TestBuildManifestOnly(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"main.go":       "package main",
+		"src/a.go":      "package src",
+		"src/deep/b.go": "package deep",
+		"src/deep/b.o":  "obj",
+		"other/c.go":    "package other",
+	})
+
+	m, err := BuildManifest(dir, WalkOptions{
+		Excludes: []string{"*.o"},
+		Only:     []string{"main.go", "src/deep", "gone.go"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, m, 3)
+	assert.NotEmpty(t, m["main.go"].Hash)
+	assert.True(t, m["src/deep"].Dir)
+	assert.NotEmpty(t, m["src/deep/b.go"].Hash)
+
+	_, err = BuildManifest(dir, WalkOptions{
+		Only: []string{"../escape"},
+	})
+	assert.Error(t, err)
+}
+
+func TestWalkLocalIgnoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		".gitignore":           "*.log\nbuild/\n",
+		"app.log":              "log",
+		"main.go":              "package main",
+		"build/out":            "bin",
+		"src/.spryncignore":    "!keep.log\n/local.env\n",
+		"src/keep.log":         "keep",
+		"src/drop.log":         "drop",
+		"src/local.env":        "SECRET=1",
+		"src/deep/local.env":   "OK=1",
+		"src/deep/build/stale": "x",
+	})
+
+	m, err := WalkLocal(dir, nil)
+	assert.NoError(t, err)
+	var got []string
+	for p := range m {
+		got = append(got, p)
+	}
+	sort.Strings(got)
+	assert.Equal(t, []string{
+		".gitignore", "main.go", "src", "src/.spryncignore",
+		"src/deep", "src/deep/local.env", "src/keep.log",
+	}, got)
+
+	m, err = BuildManifest(dir, WalkOptions{
+		IgnoreFiles: DefaultIgnoreFiles,
+		Only:        []string{"build", "src/keep.log", "src/drop.log"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, m, 1)
+	assert.Contains(t, m, "src/keep.log")
+
+	m, err = BuildManifest(dir, WalkOptions{})
+	assert.NoError(t, err)
+	assert.Contains(t, m, "app.log")
+}
+
+func TestComputeDiffSymlinks(t *testing.T) {
+	local := Manifest{
+		"same":    {Path: "same", Link: "a"},
+		"retgt":   {Path: "retgt", Link: "new"},
+		"to_file": {Path: "to_file", Hash: "x"},
+	}
+	remote := Manifest{
+		"same":    {Path: "same", Link: "a"},
+		"retgt":   {Path: "retgt", Link: "old"},
+		"to_file": {Path: "to_file", Link: "x"},
+	}
+	diff := ComputeDiff(local, remote, true)
+	assert.Equal(t, []string{"retgt", "to_file"}, diff.Uploads)
+	assert.Nil(t, diff.Deletes)
+}
+
+func TestPackUnpackSymlinks(t *testing.T) {
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{
+		"lib/real.so": "object",
+	})
+	assert.NoError(t, os.Symlink(
+		"real.so", filepath.Join(src, "lib/link.so"),
+	))
+	assert.NoError(t, os.Symlink(
+		"/usr/bin/python3", filepath.Join(src, "python"),
+	))
+
+	var buf bytes.Buffer
+	n, err := PackTar(src,
+		[]string{"lib/link.so", "lib/real.so", "python"},
+		&buf, true,
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	dst := t.TempDir()
+	makeTree(t, dst, map[string]string{
+		"python": "stale regular file",
+	})
+	n, err = UnpackTar(&buf, dst, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	target, err := os.Readlink(filepath.Join(dst, "lib/link.so"))
+	assert.NoError(t, err)
+	assert.Equal(t, "real.so", target)
+	target, err = os.Readlink(filepath.Join(dst, "python"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/usr/bin/python3", target)
+}
+
+func TestPackCopyLinks(t *testing.T) {
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{"real.txt": "content"})
+	assert.NoError(t, os.Symlink(
+		"real.txt", filepath.Join(src, "link.txt"),
+	))
+
+	var buf bytes.Buffer
+	_, err := PackTarWith(src, []string{"link.txt"}, &buf,
+		PackOptions{CopyLinks: true},
+	)
+	assert.NoError(t, err)
+
+	dst := t.TempDir()
+	_, err = UnpackTar(&buf, dst, false)
+	assert.NoError(t, err)
+
+	info, err := os.Lstat(filepath.Join(dst, "link.txt"))
+	assert.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular())
+}
+
+func TestUnpackRefusesWriteThroughSymlink(t *testing.T) {
+	outside := t.TempDir()
+	dst := t.TempDir()
+	assert.NoError(t, os.Symlink(
+		outside, filepath.Join(dst, "escape"),
+	))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	assert.NoError(t, tw.WriteHeader(&tar.Header{
+		Name: "escape/owned.txt", Mode: 0644, Size: 3,
+	}))
+	_, err := tw.Write([]byte("pwn"))
+	assert.NoError(t, err)
+	assert.NoError(t, tw.Close())
+
+	_, err = UnpackTar(&buf, dst, false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "symlink")
+
+	_, err = os.Stat(filepath.Join(outside, "owned.txt"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUnpackReplacesSymlinkWithFile(t *testing.T) {
+	outside := t.TempDir()
+	victim := filepath.Join(outside, "victim.txt")
+	assert.NoError(t, os.WriteFile(victim, []byte("keep"), 0644))
+
+	dst := t.TempDir()
+	assert.NoError(t, os.Symlink(
+		victim, filepath.Join(dst, "file.txt"),
+	))
+
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{"file.txt": "new"})
+	var buf bytes.Buffer
+	_, err := PackTar(src, []string{"file.txt"}, &buf, false)
+	assert.NoError(t, err)
+
+	_, err = UnpackTar(&buf, dst, false)
+	assert.NoError(t, err)
+
+	got, _ := os.ReadFile(victim)
+	assert.Equal(t, "keep", string(got))
+	got, _ = os.ReadFile(filepath.Join(dst, "file.txt"))
+	assert.Equal(t, "new", string(got))
+}
+
+func TestPackUnpackDirs(t *testing.T) {
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{
+		"private/key.pem": "secret",
+	})
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "logs/app"), 0755))
+	assert.NoError(t, os.Chmod(filepath.Join(src, "private"), 0700))
+	assert.NoError(t, os.Chmod(filepath.Join(src, "logs"), 0555))
+	t.Cleanup(func() {
+		os.Chmod(filepath.Join(src, "logs"), 0755)
+	})
+
+	m, err := WalkLocal(src, nil)
+	assert.NoError(t, err)
+	assert.True(t, m["logs/app"].Dir)
+	assert.Equal(t, 0555, m["logs"].Mode)
+
+	var uploads []string
+	for p := range m {
+		uploads = append(uploads, p)
+	}
+	sort.Strings(uploads)
+
+	var buf bytes.Buffer
+	n, err := PackTar(src, uploads, &buf, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	dst := t.TempDir()
+	n, err = UnpackTar(&buf, dst, true)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	t.Cleanup(func() {
+		os.Chmod(filepath.Join(dst, "logs"), 0755)
+	})
+
+	info, err := os.Stat(filepath.Join(dst, "logs/app"))
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+
+	info, err = os.Stat(filepath.Join(dst, "logs"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0555), info.Mode().Perm())
+
+	info, err = os.Stat(filepath.Join(dst, "private"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+}
+
+func TestPackNoParents(t *testing.T) {
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{"ro/sub/a.txt": "a"})
+	assert.NoError(t, os.Chmod(filepath.Join(src, "ro"), 0555))
+	t.Cleanup(func() {
+		os.Chmod(filepath.Join(src, "ro"), 0755)
+	})
+
+	var buf bytes.Buffer
+	_, err := PackTarWith(src, []string{"ro/sub/a.txt"}, &buf,
+		PackOptions{NoParents: true})
+	assert.NoError(t, err)
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+	}
+	assert.Equal(t, []string{"ro/sub/a.txt"}, names)
+}
+
+func TestComputeDiffDirs(t *testing.T) {
+	local := Manifest{
+		"empty":   {Path: "empty", Mode: 0755, Dir: true},
+		"private": {Path: "private", Mode: 0700, Dir: true},
+		"same":    {Path: "same", Mode: 0755, Dir: true},
+	}
+	remote := Manifest{
+		"private": {Path: "private", Mode: 0755, Dir: true},
+		"same":    {Path: "same", Mode: 0755, Dir: true},
+		"stale":   {Path: "stale", Mode: 0755, Dir: true},
+	}
+	diff := ComputeDiff(local, remote, true)
+	assert.Equal(t, []string{"empty"}, diff.Uploads)
+	assert.Equal(t, []string{"stale"}, diff.Deletes)
+	assert.Equal(t, []string{"private"}, diff.Chmods)
+}
+
+func TestDeleteOrder(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"a/b/c.txt": "c",
+		"a/d.txt":   "d",
+	})
+
+	for _, p := range DeleteOrder([]string{
+		"a", "a/b", "a/b/c.txt", "a/d.txt",
+	}) {
+		assert.NoError(t, RemovePath(filepath.Join(dir, p)))
+	}
+	_, err := os.Stat(filepath.Join(dir, "a"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestRemovePathKeepsNonEmptyDir(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"a/node_modules/x.js": "excluded",
+	})
+	assert.Error(t, RemovePath(filepath.Join(dir, "a")))
+	assert.NoError(t, RemovePath(filepath.Join(dir, "missing")))
+
+	_, err := os.Stat(filepath.Join(dir, "a/node_modules/x.js"))
+	assert.NoError(t, err)
+}
+
+func TestPackUnpackTimes(t *testing.T) {
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{
+		"src/main.c": "int main() {}",
+	})
+	old := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.NoError(t, os.Chtimes(
+		filepath.Join(src, "src/main.c"), old, old,
+	))
+	assert.NoError(t, os.Chtimes(
+		filepath.Join(src, "src"), old, old,
+	))
+
+	m, err := WalkLocal(src, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, old.Unix(), m["src/main.c"].MTime)
+
+	var buf bytes.Buffer
+	_, err = PackTar(src, []string{"src", "src/main.c"},
+		&buf, true)
+	assert.NoError(t, err)
+	packed := buf.Bytes()
+
+	dst := t.TempDir()
+	_, err = UnpackTarWith(bytes.NewReader(packed), dst,
+		UnpackOptions{Compress: true, Times: true})
+	assert.NoError(t, err)
+
+	for _, p := range []string{"src", "src/main.c"} {
+		info, err := os.Stat(filepath.Join(dst, p))
+		assert.NoError(t, err)
+		assert.True(t, info.ModTime().Equal(old), p)
+	}
+
+	dst = t.TempDir()
+	_, err = UnpackTar(bytes.NewReader(packed), dst, true)
+	assert.NoError(t, err)
+	info, err := os.Stat(filepath.Join(dst, "src/main.c"))
+	assert.NoError(t, err)
+	assert.False(t, info.ModTime().Equal(old))
+}
+
+func TestPackUnpackSubsecondTimes(t *testing.T) {
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{"a.txt": "a"})
+	mtime := time.Unix(1700000000, 700000000)
+	assert.NoError(t, os.Chtimes(
+		filepath.Join(src, "a.txt"), mtime, mtime,
+	))
+
+	var buf bytes.Buffer
+	_, err := PackTar(src, []string{"a.txt"}, &buf, false)
+	assert.NoError(t, err)
+	dst := t.TempDir()
+	_, err = UnpackTarWith(&buf, dst, UnpackOptions{Times: true})
+	assert.NoError(t, err)
+
+	local, err := WalkLocal(src, nil)
+	assert.NoError(t, err)
+	remote, err := WalkLocal(dst, nil)
+	assert.NoError(t, err)
+	diff := ComputeDiffWith(local, remote, DiffOptions{Times: true})
+	assert.Empty(t, diff.Uploads)
+}
+
+func TestComputeDiffTimes(t *testing.T) {
+	local := Manifest{
+		"a.go": {Path: "a.go", Hash: "x", MTime: 200},
+		"dir":  {Path: "dir", Dir: true, MTime: 200},
+		"ln":   {Path: "ln", Link: "a.go", MTime: 200},
+	}
+	remote := Manifest{
+		"a.go": {Path: "a.go", Hash: "x", MTime: 100},
+		"dir":  {Path: "dir", Dir: true, MTime: 100},
+		"ln":   {Path: "ln", Link: "a.go", MTime: 100},
+	}
+
+	diff := ComputeDiff(local, remote, false)
+	assert.Nil(t, diff.Uploads)
+
+	diff = ComputeDiffWith(local, remote, DiffOptions{Times: true})
+	assert.Equal(t, []string{"a.go"}, diff.Uploads)
+}
+
+func TestComputeDiffModeOnly(t *testing.T) {
+	local := Manifest{
+		"run.sh":  {Path: "run.sh", Hash: "x", Mode: 0755},
+		"edit.sh": {Path: "edit.sh", Hash: "new", Mode: 0755},
+		"link":    {Path: "link", Link: "run.sh", Mode: 0777},
+	}
+	remote := Manifest{
+		"run.sh":  {Path: "run.sh", Hash: "x", Mode: 0644},
+		"edit.sh": {Path: "edit.sh", Hash: "old", Mode: 0644},
+		"link":    {Path: "link", Link: "run.sh", Mode: 0755},
+	}
+	diff := ComputeDiff(local, remote, false)
+	assert.Equal(t, []string{"edit.sh"}, diff.Uploads)
+	assert.Equal(t, []string{"run.sh"}, diff.Chmods)
+	assert.False(t, diff.Empty())
+}
+
+func TestUnpackUpdatesExistingMode(t *testing.T) {
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{"run.sh": "#!/bin/sh"})
+	assert.NoError(t, os.Chmod(filepath.Join(src, "run.sh"), 0755))
+
+	dst := t.TempDir()
+	makeTree(t, dst, map[string]string{"run.sh": "old"})
+	assert.NoError(t, os.Chmod(filepath.Join(dst, "run.sh"), 0600))
+
+	var buf bytes.Buffer
+	_, err := PackTar(src, []string{"run.sh"}, &buf, false)
+	assert.NoError(t, err)
+	_, err = UnpackTar(&buf, dst, false)
+	assert.NoError(t, err)
+
+	info, err := os.Stat(filepath.Join(dst, "run.sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+}
+
+func TestHashCacheSkipsUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{"a.go": "aaaa"})
+	full := filepath.Join(dir, "a.go")
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	assert.NoError(t, os.Chtimes(full, old, old))
+
+	cachePath := filepath.Join(t.TempDir(), "cache.json")
+	opts := WalkOptions{Cache: OpenHashCache(cachePath)}
+	first, err := BuildManifest(dir, opts)
+	assert.NoError(t, err)
+	assert.NoError(t, opts.Cache.Save())
+
+	assert.NoError(t, os.WriteFile(full, []byte("bbbb"), 0644))
+	assert.NoError(t, os.Chtimes(full, old, old))
+
+	opts.Cache = OpenHashCache(cachePath)
+	cached, err := BuildManifest(dir, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, first["a.go"].Hash, cached["a.go"].Hash)
+
+	opts.Checksum = true
+	rehashed, err := BuildManifest(dir, opts)
+	assert.NoError(t, err)
+	assert.NotEqual(t, first["a.go"].Hash, rehashed["a.go"].Hash)
+
+	assert.NoError(t, os.Chtimes(full, old, old.Add(time.Minute)))
+	opts = WalkOptions{Cache: OpenHashCache(cachePath)}
+	changed, err := BuildManifest(dir, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, rehashed["a.go"].Hash, changed["a.go"].Hash)
+}
+
+func TestHashCacheIgnoresOtherVersion(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{"a.go": "aaaa"})
+	full := filepath.Join(dir, "a.go")
+	old := time.Now().Add(-time.Hour)
+	assert.NoError(t, os.Chtimes(full, old, old))
+
+	cachePath := filepath.Join(t.TempDir(), "cache.json")
+	c := OpenHashCache(cachePath)
+	_, err := BuildManifest(dir, WalkOptions{Cache: c})
+	assert.NoError(t, err)
+	assert.NoError(t, c.Save())
+
+	data, err := os.ReadFile(cachePath)
+	assert.NoError(t, err)
+	data = bytes.Replace(
+		data, []byte(`"algo":"sha256"`), []byte(`"algo":"md5"`), 1,
+	)
+	assert.NoError(t, os.WriteFile(cachePath, data, 0600))
+
+	info, err := os.Stat(full)
+	assert.NoError(t, err)
+	_, ok := OpenHashCache(cachePath).Lookup("a.go", info)
+	assert.False(t, ok)
+}
+
+func TestComputeDiffRenames(t *testing.T) {
+	local := Manifest{
+		"new/a.go":  {Path: "new/a.go", Hash: "A", Size: 1, Mode: 0644},
+		"dup.go":    {Path: "dup.go", Hash: "B", Size: 1, Mode: 0755},
+		"keep.go":   {Path: "keep.go", Hash: "B", Size: 1, Mode: 0644},
+		"again.go":  {Path: "again.go", Hash: "A", Size: 1, Mode: 0644},
+		"empty.txt": {Path: "empty.txt", Hash: "E", Mode: 0644},
+		"new":       {Path: "new", Mode: 0755, Dir: true},
+	}
+	remote := Manifest{
+		"old/a.go":  {Path: "old/a.go", Hash: "A", Size: 1, Mode: 0644},
+		"keep.go":   {Path: "keep.go", Hash: "B", Size: 1, Mode: 0644},
+		"other.txt": {Path: "other.txt", Hash: "E", Mode: 0644},
+		"old":       {Path: "old", Mode: 0755, Dir: true},
+	}
+	diff := ComputeDiffWith(local, remote, DiffOptions{
+		Delete:  true,
+		Renames: true,
+	})
+	assert.Equal(t, []string{"empty.txt", "new"}, diff.Uploads)
+	assert.Equal(t, []string{"old", "other.txt"}, diff.Deletes)
+	assert.Equal(t, []Copy{
+		{From: "old/a.go", To: "again.go", Mode: 0644, Rename: true},
+		{From: "keep.go", To: "dup.go", Mode: 0755},
+		{From: "old/a.go", To: "new/a.go", Mode: 0644},
+	}, diff.Copies)
+
+	for i, c := range CopyOrder(diff.Copies) {
+		assert.Equal(t, i == 2, c.Rename)
+	}
+}
+
+func TestCopyPath(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"a.txt": "hello",
+		"b.txt": "moved",
+	})
+
+	assert.NoError(t, CopyPath(dir,
+		Copy{From: "a.txt", To: "sub/a.txt", Mode: 0600}, false,
+	))
+	assert.NoError(t, CopyPath(dir,
+		Copy{From: "b.txt", To: "c.txt", Mode: 0644, Rename: true},
+		false,
+	))
+
+	data, err := os.ReadFile(filepath.Join(dir, "sub/a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	info, err := os.Stat(filepath.Join(dir, "sub/a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	_, err = os.Stat(filepath.Join(dir, "a.txt"))
+	assert.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, "b.txt"))
+	assert.True(t, os.IsNotExist(err))
+	data, err = os.ReadFile(filepath.Join(dir, "c.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "moved", string(data))
+}
+
+func TestPackUnpackProgress(t *testing.T) {
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{
+		"a.txt":     "hello",
+		"sub/b.txt": "world!",
+	})
+	uploads := []string{"a.txt", "sub", "sub/b.txt"}
+
+	var files int
+	var size int64
+	progress := func(n int, b int64) {
+		files += n
+		size += b
+	}
+
+	var buf bytes.Buffer
+	_, err := PackTarWith(src, uploads, &buf, PackOptions{
+		Compress: true,
+		Progress: progress,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, files)
+	assert.Equal(t, int64(11), size)
+
+	files, size = 0, 0
+	_, err = UnpackTarWith(&buf, t.TempDir(), UnpackOptions{
+		Compress: true,
+		Progress: progress,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, files)
+	assert.Equal(t, int64(11), size)
+
+	files, size = 0, 0
+	_, err = BuildManifest(src, WalkOptions{Progress: progress})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, files)
+	assert.Equal(t, int64(11), size)
+}
+
+func TestUnpackOnly(t *testing.T) {
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{
+		"a.txt":     "a",
+		"sub/b.txt": "b",
+	})
+
+	var buf bytes.Buffer
+	_, err := PackTar(
+		src, []string{"a.txt", "sub", "sub/b.txt"}, &buf,
+		false,
+	)
+	assert.NoError(t, err)
+
+	dst := t.TempDir()
+	n, err := UnpackTarWith(&buf, dst, UnpackOptions{
+		Only: []string{"sub/b.txt"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = os.Stat(filepath.Join(dst, "a.txt"))
+	assert.True(t, os.IsNotExist(err))
+	got, err := os.ReadFile(filepath.Join(dst, "sub/b.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(got))
+}
+
+func TestUnpackTruncatedKeepsFiles(t *testing.T) {
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{
+		"a.txt": "new a",
+		"b.txt": strings.Repeat("b", 4096),
+	})
+	var buf bytes.Buffer
+	_, err := PackTar(
+		src, []string{"a.txt", "b.txt"}, &buf, false,
+	)
+	assert.NoError(t, err)
+	cut := buf.Bytes()[:2048]
+
+	for _, delay := range []bool{false, true} {
+		dst := t.TempDir()
+		makeTree(t, dst, map[string]string{
+			"a.txt": "old a",
+			"b.txt": "old b",
+		})
+		_, err := UnpackTarWith(
+			bytes.NewReader(cut), dst,
+			UnpackOptions{DelayUpdates: delay},
+		)
+		assert.Error(t, err)
+
+		want := "new a"
+		if delay {
+			want = "old a"
+		}
+		got, _ := os.ReadFile(filepath.Join(dst, "a.txt"))
+		assert.Equal(t, want, string(got))
+		got, _ = os.ReadFile(filepath.Join(dst, "b.txt"))
+		assert.Equal(t, "old b", string(got))
+
+		names, _ := os.ReadDir(dst)
+		assert.Len(t, names, 2)
+	}
+}
+
+func TestStageSpansTarballs(t *testing.T) {
+	src := t.TempDir()
+	old := strings.Repeat("block of data\n", 1000)
+	makeTree(t, src, map[string]string{
+		"a.txt":     "a",
+		"sub/b.txt": "b",
+		"big.txt":   old + "new tail",
+	})
+	dst := t.TempDir()
+	makeTree(t, dst, map[string]string{"big.txt": old})
+	stage := NewStage()
+	for _, p := range []string{"a.txt", "sub/b.txt"} {
+		var buf bytes.Buffer
+		_, err := PackTar(src, []string{p}, &buf, false)
+		assert.NoError(t, err)
+		_, err = UnpackTarWith(&buf, dst, UnpackOptions{
+			DelayUpdates: true, Stage: stage,
+		})
+		assert.NoError(t, err)
+	}
+
+	var sigBuf, deltaBuf bytes.Buffer
+	_, err := WriteSignatures(dst, []string{"big.txt"}, &sigBuf)
+	assert.NoError(t, err)
+	sigs, err := ReadSignatures(&sigBuf)
+	assert.NoError(t, err)
+	srcM, err := WalkLocal(src, nil)
+	assert.NoError(t, err)
+	_, err = PackDelta(src, []ManifestEntry{srcM["big.txt"]},
+		sigs, &deltaBuf, false,
+	)
+	assert.NoError(t, err)
+	n, failed, err := ApplyDelta(&deltaBuf, dst, UnpackOptions{
+		DelayUpdates: true, Stage: stage,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Empty(t, failed)
+
+	assert.Equal(t, 3, stage.Len())
+	_, err = os.Stat(filepath.Join(dst, "a.txt"))
+	assert.True(t, os.IsNotExist(err))
+	got, err := os.ReadFile(filepath.Join(dst, "big.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, old, string(got))
+
+	assert.NoError(t, stage.Commit())
+	got, err = os.ReadFile(filepath.Join(dst, "sub/b.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "b", string(got))
+	got, err = os.ReadFile(filepath.Join(dst, "big.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, old+"new tail", string(got))
+	assert.Equal(t, 0, stage.Len())
+}
+
+func TestStageSaveLoad(t *testing.T) {
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{"ro/a.txt": "a"})
+	assert.NoError(t, os.Chmod(filepath.Join(src, "ro"), 0555))
+	t.Cleanup(func() {
+		os.Chmod(filepath.Join(src, "ro"), 0755)
+	})
+	var buf bytes.Buffer
+	_, err := PackTar(src, []string{"ro", "ro/a.txt"}, &buf,
+		false)
+	assert.NoError(t, err)
+
+	dst := t.TempDir()
+	t.Cleanup(func() {
+		os.Chmod(filepath.Join(dst, "ro"), 0755)
+	})
+	stage := NewStage()
+	_, err = UnpackTarWith(&buf, dst, UnpackOptions{Stage: stage})
+	assert.NoError(t, err)
+	saved := filepath.Join(t.TempDir(), "stage.json")
+	assert.NoError(t, stage.Save(saved))
+
+	loaded := NewStage()
+	assert.NoError(t, loaded.Load(saved))
+	assert.Equal(t, 1, loaded.Len())
+	assert.NoError(t, loaded.Commit())
+	got, err := os.ReadFile(filepath.Join(dst, "ro/a.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(got))
+	info, err := os.Stat(filepath.Join(dst, "ro"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0555), info.Mode().Perm())
+}
+
+func TestTempFiles(t *testing.T) {
+	dead := exec.Command("true")
+	assert.NoError(t, dead.Run())
+	stale := fmt.Sprintf(
+		".sprync-extract-%d-0123456789abcdef", dead.Process.Pid,
+	)
+	live := fmt.Sprintf(
+		".sprync-delta-%d-fedcba9876543210", os.Getpid(),
+	)
+	notes := ".sprync-notes-1-x"
+	lookalike := fmt.Sprintf(".sprync-extract-%d-1", dead.Process.Pid)
+
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"a.txt":   "a",
+		stale:     "stale",
+		live:      "live",
+		notes:     "mine",
+		lookalike: "mine too",
+	})
+	m, err := WalkLocal(dir, nil)
+	assert.NoError(t, err)
+	assert.Len(t, m, 3)
+	assert.Contains(t, m, notes)
+	assert.Contains(t, m, lookalike)
+
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{"b.txt": "b"})
+	var buf bytes.Buffer
+	_, err = PackTar(src, []string{"b.txt"}, &buf, false)
+	assert.NoError(t, err)
+	_, err = UnpackTar(&buf, dir, false)
+	assert.NoError(t, err)
+
+	_, err = os.Stat(filepath.Join(dir, stale))
+	assert.True(t, os.IsNotExist(err))
+	for _, p := range []string{live, notes, lookalike} {
+		_, err = os.Stat(filepath.Join(dir, p))
+		assert.NoError(t, err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"a.txt":     "old a",
+		"sub/b.txt": "old b",
+	})
+	b := &Backup{Root: t.TempDir(), Name: NewBackupName(time.Now())}
+	assert.NoError(t, b.Validate())
+
+	assert.NoError(t, b.Save(dir, "a.txt"))
+	assert.NoError(t, os.Remove(filepath.Join(dir, "a.txt")))
+	makeTree(t, dir, map[string]string{"a.txt": "new a"})
+	assert.NoError(t, b.Save(dir, "a.txt"))
+	assert.NoError(t, b.Remove(dir, "sub/b.txt"))
+	assert.NoError(t, b.Remove(dir, "sub"))
+	_, err := os.Stat(filepath.Join(dir, "sub"))
+	assert.True(t, os.IsNotExist(err))
+
+	latest, err := LatestBackup(b.Root)
+	assert.NoError(t, err)
+	assert.Equal(t, b.Name, latest.Name)
+
+	n, err := latest.Restore(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	got, _ := os.ReadFile(filepath.Join(dir, "a.txt"))
+	assert.Equal(t, "old a", string(got))
+	got, _ = os.ReadFile(filepath.Join(dir, "sub/b.txt"))
+	assert.Equal(t, "old b", string(got))
+
+	_, err = LatestBackup(b.Root)
+	assert.ErrorIs(t, err, ErrNoBackup)
+}
+
+func TestBackupDirReplacedBySymlink(t *testing.T) {
+	src := t.TempDir()
+	assert.NoError(t, os.Symlink(
+		"static", filepath.Join(src, "assets"),
+	))
+	var buf bytes.Buffer
+	_, err := PackTar(src, []string{"assets"}, &buf, false)
+	assert.NoError(t, err)
+
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"assets/logo.png":     "png",
+		"assets/css/site.css": "body {}",
+	})
+	b := &Backup{Root: t.TempDir(), Name: NewBackupName(time.Now())}
+	_, err = UnpackTarWith(&buf, dir, UnpackOptions{
+		Backup: b, Delete: &DeleteOptions{},
+	})
+	assert.NoError(t, err)
+	target, err := os.Readlink(filepath.Join(dir, "assets"))
+	assert.NoError(t, err)
+	assert.Equal(t, "static", target)
+
+	n, err := b.Restore(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	info, err := os.Lstat(filepath.Join(dir, "assets"))
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	got, _ := os.ReadFile(filepath.Join(dir, "assets/css/site.css"))
+	assert.Equal(t, "body {}", string(got))
+
+	assert.NoError(t, b.Save(dir, "assets"))
+	got, _ = os.ReadFile(b.path("assets/logo.png"))
+	assert.Equal(t, "png", string(got))
+}
+
+func TestBackupValidate(t *testing.T) {
+	for _, b := range []Backup{
+		{Root: "rel", Name: "x"},
+		{Root: "/abs", Name: ""},
+		{Root: "/abs", Name: ".."},
+		{Root: "/abs", Name: "a/b"},
+	} {
+		assert.Error(t, b.Validate(), b)
+	}
+}
+
+func TestUnpackBackup(t *testing.T) {
+	src := t.TempDir()
+	makeTree(t, src, map[string]string{"a.txt": "new"})
+	var buf bytes.Buffer
+	_, err := PackTar(src, []string{"a.txt"}, &buf, false)
+	assert.NoError(t, err)
+
+	dst := t.TempDir()
+	makeTree(t, dst, map[string]string{"a.txt": "old"})
+	b := &Backup{Root: t.TempDir(), Name: "1"}
+	_, err = UnpackTarWith(&buf, dst, UnpackOptions{Backup: b})
+	assert.NoError(t, err)
+
+	got, _ := os.ReadFile(filepath.Join(b.Root, "1", "a.txt"))
+	assert.Equal(t, "old", string(got))
+	got, _ = os.ReadFile(filepath.Join(dst, "a.txt"))
+	assert.Equal(t, "new", string(got))
+}
+
+func TestCheckDeletes(t *testing.T) {
+	target := Manifest{}
+	for _, p := range []string{"a", "b", "c", "d"} {
+		target[p] = ManifestEntry{Path: p, Hash: p}
+	}
+	source := Manifest{"a": target["a"]}
+	diff := ComputeDiff(source, target, true)
+	assert.Len(t, diff.Deletes, 3)
+
+	assert.NoError(t, CheckDeletes(
+		diff, source, target, DeleteLimits{},
+	))
+	assert.NoError(t, CheckDeletes(
+		diff, source, target, DeleteLimits{Max: 3},
+	))
+	assert.ErrorIs(t, CheckDeletes(
+		diff, source, target, DeleteLimits{Max: 2},
+	), ErrDeleteLimit)
+	assert.ErrorIs(t, CheckDeletes(
+		diff, source, target, DeleteLimits{MaxPercent: 50},
+	), ErrDeleteLimit)
+	assert.NoError(t, CheckDeletes(
+		diff, source, target, DeleteLimits{MaxPercent: 75},
+	))
+
+	dirs := Manifest{
+		"a":     target["a"],
+		"d":     {Path: "d", Dir: true},
+		"d/e":   {Path: "d/e", Dir: true},
+		"d/e/f": {Path: "d/e/f", Hash: "f"},
+	}
+	diff = ComputeDiff(source, dirs, true)
+	assert.Len(t, diff.Deletes, 3)
+	assert.NoError(t, CheckDeletes(
+		diff, source, dirs, DeleteLimits{Max: 1},
+	))
+	assert.NoError(t, CheckDeletes(
+		diff, source, dirs, DeleteLimits{MaxPercent: 50},
+	))
+
+	empty := ComputeDiff(Manifest{}, target, true)
+	assert.ErrorIs(t, CheckDeletes(
+		empty, Manifest{}, target, DeleteLimits{},
+	), ErrDeleteLimit)
+	assert.NoError(t, CheckDeletes(
+		DiffResult{}, Manifest{}, Manifest{}, DeleteLimits{},
+	))
+}
+
+func TestComputeDiffProtect(t *testing.T) {
+	remote := Manifest{
+		".env":        {Path: ".env", Hash: "e", Size: 1},
+		"data":        {Path: "data", Dir: true},
+		"data/db":     {Path: "data/db", Hash: "d", Size: 1},
+		"old.txt":     {Path: "old.txt", Hash: "o", Size: 1},
+		"cfg":         {Path: "cfg", Dir: true},
+		"cfg/app.yml": {Path: "cfg/app.yml", Hash: "a", Size: 1},
+		"cfg/x.yml":   {Path: "cfg/x.yml", Hash: "x", Size: 1},
+	}
+	local := Manifest{
+		"new.txt": {Path: "new.txt", Hash: "a", Size: 1},
+	}
+	diff := ComputeDiffWith(local, remote, DiffOptions{
+		Delete:  true,
+		Renames: true,
+		Protect: []string{"/.env", "data/", "cfg/app.yml"},
+	})
+	assert.Equal(t, []string{"cfg/x.yml", "old.txt"}, diff.Deletes)
+	assert.Len(t, diff.Copies, 1)
+	assert.Equal(t, "cfg/app.yml", diff.Copies[0].From)
+	assert.False(t, diff.Copies[0].Rename)
+}
+
+func TestDeletePaths(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		".env":        "secret",
+		"data/db":     "db",
+		"a.log":       "log",
+		"gone.txt":    "gone",
+		"sub/keep.go": "keep",
+		"sub/x.txt":   "x",
+	})
+	list := []string{
+		".env", "data", "data/db", "a.log", "gone.txt",
+		"sub", "sub/keep.go", "sub/x.txt",
+	}
+	opts := DeleteOptions{
+		Protect: []string{".env", "data/", "keep.go"},
+		Exclude: paths.MatchOptions{Excludes: []string{"*.log"}},
+	}
+	var errs []string
+	files, dirs := DeletePaths(dir, list, opts,
+		func(p string, err error) {
+			errs = append(errs, p)
+		},
+	)
+	assert.Equal(t, 2, files)
+	assert.Equal(t, 0, dirs)
+	assert.Empty(t, errs)
+	for _, p := range []string{".env", "data/db", "a.log", "sub/keep.go"} {
+		_, err := os.Stat(filepath.Join(dir, p))
+		assert.NoError(t, err, p)
+	}
+
+	opts.DeleteExcluded = true
+	files, _ = DeletePaths(dir, []string{"a.log"}, opts, nil)
+	assert.Equal(t, 1, files)
+}
+
+func TestDeletePathsPrunesDirs(t *testing.T) {
+	dir := t.TempDir()
+	makeTree(t, dir, map[string]string{
+		"gen/a/x.txt":  "x",
+		"gen/b/y.txt":  "y",
+		"logs/old.txt": "old",
+		"logs/run.log": "log",
+	})
+	list := []string{
+		"gen", "gen/a", "gen/a/x.txt", "gen/b", "gen/b/y.txt",
+		"logs", "logs/old.txt",
+	}
+	var errs []string
+	files, dirs := DeletePaths(dir, list, DeleteOptions{},
+		func(p string, err error) {
+			errs = append(errs, p)
+		},
+	)
+	assert.Equal(t, 3, files)
+	assert.Equal(t, 3, dirs)
+	assert.Empty(t, errs)
+	_, err := os.Stat(filepath.Join(dir, "gen"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "logs/run.log"))
+	assert.NoError(t, err)
+}
+
+func TestComputeDiffEmptiedDirs(t *testing.T) {
+	local := Manifest{
+		"src/main.go": {Path: "src/main.go", Hash: "a", Mode: 0644},
+	}
+	remote := Manifest{
+		"src/main.go": {Path: "src/main.go", Hash: "a", Mode: 0644},
+		"src/old.go":  {Path: "src/old.go", Hash: "b", Mode: 0644},
+		"gen/a/x.go":  {Path: "gen/a/x.go", Hash: "c", Mode: 0644},
+		"gen/b":       {Path: "gen/b", Mode: 0755, Dir: true},
+		"gen/b/y.go":  {Path: "gen/b/y.go", Hash: "d", Mode: 0644},
+	}
+	diff := ComputeDiffWith(local, remote, DiffOptions{
+		Delete: true,
+	})
+	assert.Equal(t, []string{
+		"gen", "gen/a", "gen/a/x.go", "gen/b", "gen/b/y.go",
+		"src/old.go",
+	}, diff.Deletes)
+
+	diff = ComputeDiffWith(local, remote, DiffOptions{})
+	assert.Empty(t, diff.Deletes)
+}
+
+func TestComputeSync(t *testing.T) {
+	base := Manifest{
+		"same.go":   {Path: "same.go", Hash: "a", Mode: 0644},
+		"local.go":  {Path: "local.go", Hash: "b", Mode: 0644},
+		"remote.go": {Path: "remote.go", Hash: "c", Mode: 0644},
+		"gone.go":   {Path: "gone.go", Hash: "d", Mode: 0644},
+		"both.go":   {Path: "both.go", Hash: "e", Mode: 0644},
+		"run.sh":    {Path: "run.sh", Hash: "f", Mode: 0644},
+	}
+	local := Manifest{
+		"same.go":   {Path: "same.go", Hash: "a", Mode: 0644},
+		"local.go":  {Path: "local.go", Hash: "b2", Mode: 0644},
+		"remote.go": {Path: "remote.go", Hash: "c", Mode: 0644},
+		"both.go":   {Path: "both.go", Hash: "e2", Mode: 0644},
+		"run.sh":    {Path: "run.sh", Hash: "f", Mode: 0755},
+		"new.go":    {Path: "new.go", Hash: "g", Mode: 0644},
+	}
+	remote := Manifest{
+		"same.go":   {Path: "same.go", Hash: "a", Mode: 0644},
+		"local.go":  {Path: "local.go", Hash: "b", Mode: 0644},
+		"remote.go": {Path: "remote.go", Hash: "c2", Mode: 0644},
+		"gone.go":   {Path: "gone.go", Hash: "d", Mode: 0644},
+		"both.go":   {Path: "both.go", Hash: "e3", Mode: 0644},
+		"run.sh":    {Path: "run.sh", Hash: "f", Mode: 0644},
+		"new.go":    {Path: "new.go", Hash: "g", Mode: 0644},
+	}
+
+	result := ComputeSync(base, local, remote, SyncOptions{})
+	assert.Equal(t, []string{"local.go"}, result.Push.Uploads)
+	assert.Equal(t, []string{"gone.go"}, result.Push.Deletes)
+	assert.Equal(t, []string{"run.sh"}, result.Push.Chmods)
+	assert.Equal(t, []string{"remote.go"}, result.Pull.Uploads)
+	assert.Nil(t, result.Pull.Deletes)
+	assert.Equal(t,
+		[]Conflict{{Path: "both.go"}}, result.Conflicts,
+	)
+}
+
+func TestComputeSyncPrefer(t *testing.T) {
+	backup := ManifestEntry{
+		Path: "a.sync-conflict-remote.txt", Hash: "x",
+	}
+	base := Manifest{
+		"a.txt":     {Path: "a.txt", Hash: "a", MTime: 100},
+		"b.txt":     {Path: "b.txt", Hash: "b", MTime: 100},
+		backup.Path: backup,
+	}
+	local := Manifest{
+		"a.txt":     {Path: "a.txt", Hash: "a2", MTime: 300},
+		backup.Path: backup,
+	}
+	remote := Manifest{
+		"a.txt":     {Path: "a.txt", Hash: "a3", MTime: 200},
+		"b.txt":     {Path: "b.txt", Hash: "b3", MTime: 200},
+		backup.Path: backup,
+	}
+
+	result := ComputeSync(base, local, remote,
+		SyncOptions{Prefer: PreferLocal},
+	)
+	assert.Equal(t, []string{"a.txt"}, result.Push.Uploads)
+	assert.Equal(t, []string{"b.txt"}, result.Push.Deletes)
+	assert.Equal(t, []Conflict{
+		{
+			Path: "a.txt", Winner: PreferLocal,
+			Backup: "a.sync-conflict-remote-2.txt",
+		},
+		{
+			Path: "b.txt", Winner: PreferLocal,
+			Backup: "b.sync-conflict-remote.txt",
+		},
+	}, result.Conflicts)
+
+	result = ComputeSync(base, local, remote,
+		SyncOptions{Prefer: PreferRemote},
+	)
+	assert.Equal(t,
+		[]string{"a.txt", "b.txt"}, result.Pull.Uploads,
+	)
+	assert.Equal(t,
+		"a.sync-conflict-local.txt", result.Conflicts[0].Backup,
+	)
+	assert.Empty(t, result.Conflicts[1].Backup)
+
+	result = ComputeSync(base, local, remote,
+		SyncOptions{Prefer: PreferNewer},
+	)
+	assert.Equal(t, []string{"a.txt"}, result.Push.Uploads)
+	assert.Equal(t, []string{"b.txt"}, result.Pull.Uploads)
+}
+
+func TestComputeSyncKeepsParents(t *testing.T) {
+	base := Manifest{
+		"lib":      {Path: "lib", Dir: true, Mode: 0755},
+		"lib/a.go": {Path: "lib/a.go", Hash: "a"},
+		"old":      {Path: "old", Dir: true, Mode: 0755},
+		"old/b.go": {Path: "old/b.go", Hash: "b"},
+	}
+	local := Manifest{}
+	remote := Manifest{
+		"lib":      {Path: "lib", Dir: true, Mode: 0755},
+		"lib/a.go": {Path: "lib/a.go", Hash: "a"},
+		"lib/c.go": {Path: "lib/c.go", Hash: "c"},
+		"old":      {Path: "old", Dir: true, Mode: 0755},
+		"old/b.go": {Path: "old/b.go", Hash: "b"},
+	}
+
+	result := ComputeSync(base, local, remote, SyncOptions{})
+	assert.Equal(t,
+		[]string{"lib/a.go", "old", "old/b.go"},
+		result.Push.Deletes,
+	)
+	assert.Equal(t, []string{"lib/c.go"}, result.Pull.Uploads)
+}
+
+func TestSyncBase(t *testing.T) {
+	base := Manifest{
+		"a.go": {Path: "a.go", Hash: "a"},
+		"b.go": {Path: "b.go", Hash: "b"},
+		"c.go": {Path: "c.go", Hash: "c"},
+	}
+	local := Manifest{
+		"a.go": {Path: "a.go", Hash: "a2"},
+		"b.go": {Path: "b.go", Hash: "b2"},
+	}
+	remote := Manifest{
+		"a.go": {Path: "a.go", Hash: "a2"},
+		"b.go": {Path: "b.go", Hash: "b3"},
+	}
+
+	next := SyncBase(base, local, remote, false)
+	assert.Equal(t, Manifest{
+		"a.go": {Path: "a.go", Hash: "a2"},
+		"b.go": {Path: "b.go", Hash: "b"},
+	}, next)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package pack
+
+// processAlive cannot tell here, so no temp file is ever
+// taken for stale.
+func processAlive(pid int) bool {
+	return true
+}
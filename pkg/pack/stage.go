@@ -0,0 +1,159 @@
+package pack
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Stage holds files extracted beside their targets until Commit
+// renames them all into place, so readers never see a batch half
+// applied. It also holds back the modes of the directories they
+// go in, which might otherwise refuse the renames. It is safe
+// for concurrent use.
+type Stage struct {
+	mu    sync.Mutex
+	files []stagedFile
+	dirs  []dirMode
+}
+
+type stagedFile struct {
+	Tmp    string `json:"tmp"`
+	Target string `json:"target"`
+}
+
+// dirMode is the mode, and with --times the mtime, a directory
+// gets once everything inside it has been written.
+type dirMode struct {
+	Path  string      `json:"path"`
+	Mode  os.FileMode `json:"mode"`
+	MTime time.Time   `json:"mtime,omitempty"`
+}
+
+func NewStage() *Stage {
+	return &Stage{}
+}
+
+func (s *Stage) add(tmp, target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = append(s.files, stagedFile{tmp, target})
+}
+
+func (s *Stage) addDirs(dirs []dirMode) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dirs = append(s.dirs, dirs...)
+}
+
+// Len returns the number of files waiting to be committed.
+func (s *Stage) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.files)
+}
+
+// Save writes what s holds to path, so that another process can
+// Load and commit it.
+func (s *Stage) Save(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := json.Marshal(savedStage{s.files, s.dirs})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// Load adds what Save wrote to path to s.
+func (s *Stage) Load(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var saved savedStage
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("read stage %s: %w", path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files = append(s.files, saved.Files...)
+	s.dirs = append(s.dirs, saved.Dirs...)
+	return nil
+}
+
+type savedStage struct {
+	Files []stagedFile `json:"files"`
+	Dirs  []dirMode    `json:"dirs,omitempty"`
+}
+
+// Commit renames every staged file into place, then sets the
+// staged directory modes. On failure the files not yet renamed
+// are removed.
+func (s *Stage) Commit() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, f := range s.files {
+		if err := replaceWith(f.Tmp, f.Target); err != nil {
+			s.files = s.files[i:]
+			s.abort()
+			return err
+		}
+	}
+	dirs := s.dirs
+	s.files, s.dirs = nil, nil
+	return applyDirModes(dirs)
+}
+
+// Abort removes every staged file, leaving the targets as they
+// were.
+func (s *Stage) Abort() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.abort()
+}
+
+func (s *Stage) abort() {
+	for _, f := range s.files {
+		os.Remove(f.Tmp)
+	}
+	s.files, s.dirs = nil, nil
+}
+
+// applyDirModes sets the modes of dirs, children before their
+// parents.
+func applyDirModes(dirs []dirMode) error {
+	sort.SliceStable(dirs, func(i, j int) bool {
+		return dirs[i].Path > dirs[j].Path
+	})
+	for _, d := range dirs {
+		if err := os.Chmod(d.Path, d.Mode); err != nil {
+			return fmt.Errorf("chmod dir: %w", err)
+		}
+		if d.MTime.IsZero() {
+			continue
+		}
+		if err := os.Chtimes(d.Path, d.MTime, d.MTime); err != nil {
+			return fmt.Errorf("chtimes dir: %w", err)
+		}
+	}
+	return nil
+}
+
+// replaceWith renames tmp over target, which rename only refuses
+// when target is a directory. It removes a directory only once
+// it is empty, which clearDir sees to.
+func replaceWith(tmp, target string) error {
+	if info, err := os.Lstat(target); err == nil && info.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return fmt.Errorf("replace %s: %w", target, err)
+		}
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return fmt.Errorf("rename %s: %w", target, err)
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package pack
+
+import (
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Sides of a two-way sync, as accepted by SyncOptions.Prefer.
+const (
+	PreferLocal  = "local"
+	PreferRemote = "remote"
+	PreferNewer  = "newer"
+)
+
+type SyncOptions struct {
+	Times   bool
+	Renames bool
+	// Prefer resolves conflicts in favour of PreferLocal,
+	// PreferRemote or, by mtime, PreferNewer. Empty leaves
+	// them alone.
+	Prefer string
+	// Protect patterns match paths never to delete on either
+	// side.
+	Protect []string
+}
+
+// SyncResult is a three-way comparison of two trees against the
+// base they were last synced to. Push carries local changes to
+// the remote, Pull remote changes to the local side.
+type SyncResult struct {
+	Push      DiffResult
+	Pull      DiffResult
+	Conflicts []Conflict
+}
+
+// Conflict is a path changed differently on both sides. Winner is
+// the side whose version is kept, empty when unresolved. Backup,
+// if set, is where the losing side saves its own version first.
+type Conflict struct {
+	Path   string
+	Winner string
+	Backup string
+}
+
+func ComputeSync(
+	base, local, remote Manifest,
+	opts SyncOptions,
+) SyncResult {
+	all := make(map[string]bool, len(local))
+	for _, m := range []Manifest{base, local, remote} {
+		for p := range m {
+			all[p] = true
+		}
+	}
+
+	var result SyncResult
+	times := opts.Times
+	for p := range all {
+		b, inBase := base[p]
+		l, inLocal := local[p]
+		r, inRemote := remote[p]
+		push := func() {
+			addChange(&result.Push, p, l, inLocal, r, inRemote, times)
+		}
+		pull := func() {
+			addChange(&result.Pull, p, r, inRemote, l, inLocal, times)
+		}
+
+		switch {
+		case sameState(l, inLocal, r, inRemote, times):
+		case sameState(b, inBase, r, inRemote, times):
+			push()
+		case sameState(b, inBase, l, inLocal, times):
+			pull()
+		default:
+			c := resolve(p, local, remote, opts.Prefer)
+			switch c.Winner {
+			case PreferLocal:
+				push()
+			case PreferRemote:
+				pull()
+			}
+			result.Conflicts = append(result.Conflicts, c)
+		}
+	}
+
+	keepParents(&result.Push, remote)
+	keepParents(&result.Pull, local)
+	for _, d := range []*DiffResult{&result.Push, &result.Pull} {
+		sort.Strings(d.Uploads)
+		sort.Strings(d.Deletes)
+		sort.Strings(d.Chmods)
+	}
+	sort.Slice(result.Conflicts, func(i, j int) bool {
+		return result.Conflicts[i].Path < result.Conflicts[j].Path
+	})
+	if opts.Renames {
+		detectCopies(local, remote, &result.Push)
+		detectCopies(remote, local, &result.Pull)
+	}
+	protect(&result.Push, remote, opts.Protect)
+	protect(&result.Pull, local, opts.Protect)
+	return result
+}
+
+// SyncBase returns the base for the next sync, given both sides
+// as they are after this one: what they agree on, and the old
+// base entry for whatever they still disagree on.
+func SyncBase(base, local, remote Manifest, times bool) Manifest {
+	next := make(Manifest, len(local))
+	for p, l := range local {
+		if r, ok := remote[p]; ok && sameEntry(l, r, times) {
+			next[p] = l
+		}
+	}
+	for p, b := range base {
+		l, inLocal := local[p]
+		r, inRemote := remote[p]
+		if !sameState(l, inLocal, r, inRemote, times) {
+			next[p] = b
+		}
+	}
+	return next
+}
+
+func resolve(
+	p string, local, remote Manifest, prefer string,
+) Conflict {
+	l, inLocal := local[p]
+	r, inRemote := remote[p]
+	c := Conflict{Path: p}
+	switch prefer {
+	case PreferLocal, PreferRemote:
+		c.Winner = prefer
+	case PreferNewer:
+		// A deletion has no time, so the edit on the other side
+		// is the newer change.
+		switch {
+		case !inLocal || inRemote && r.MTime > l.MTime:
+			c.Winner = PreferRemote
+		case !inRemote || l.MTime > r.MTime:
+			c.Winner = PreferLocal
+		}
+	}
+
+	loser, inLoser, side := r, inRemote, PreferRemote
+	if c.Winner == PreferRemote {
+		loser, inLoser, side = l, inLocal, PreferLocal
+	}
+	if c.Winner != "" && inLoser &&
+		!loser.Dir && !loser.IsSymlink() {
+		c.Backup = conflictPath(p, side, local, remote)
+	}
+	return c
+}
+
+// conflictPath names the copy of p kept from side, as
+// "name.sync-conflict-side.ext", numbered if that is taken.
+func conflictPath(p, side string, taken ...Manifest) string {
+	ext := path.Ext(p)
+	if strings.HasPrefix(path.Base(p), ".") &&
+		len(ext) == len(path.Base(p)) {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(p, ext) + ".sync-conflict-" + side
+	name := stem + ext
+	for n := 2; ; n++ {
+		free := true
+		for _, m := range taken {
+			if _, ok := m[name]; ok {
+				free = false
+			}
+		}
+		if free {
+			return name
+		}
+		name = stem + "-" + strconv.Itoa(n) + ext
+	}
+}
+
+// addChange records in d what brings dst to src.
+func addChange(
+	d *DiffResult,
+	p string,
+	src ManifestEntry, inSrc bool,
+	dst ManifestEntry, inDst bool,
+	times bool,
+) {
+	switch {
+	case !inSrc:
+		if inDst {
+			d.Deletes = append(d.Deletes, p)
+		}
+	case !inDst || contentDiffers(src, dst, times):
+		d.Uploads = append(d.Uploads, p)
+	case src.Mode != dst.Mode && !src.IsSymlink():
+		d.Chmods = append(d.Chmods, p)
+	}
+}
+
+// keepParents drops deletes of directories that will still hold
+// something on the target.
+func keepParents(d *DiffResult, target Manifest) {
+	if len(d.Deletes) == 0 {
+		return
+	}
+	deleting := make(map[string]bool, len(d.Deletes))
+	for _, p := range d.Deletes {
+		deleting[p] = true
+	}
+	kept := make(map[string]bool)
+	keep := func(p string) {
+		for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+			kept[dir] = true
+		}
+	}
+	for p := range target {
+		if !deleting[p] {
+			keep(p)
+		}
+	}
+	for _, p := range d.Uploads {
+		keep(p)
+	}
+
+	var deletes []string
+	for _, p := range d.Deletes {
+		if !kept[p] {
+			deletes = append(deletes, p)
+		}
+	}
+	d.Deletes = deletes
+}
+
+func sameState(
+	a ManifestEntry, inA bool,
+	b ManifestEntry, inB bool,
+	times bool,
+) bool {
+	if !inA || !inB {
+		return inA == inB
+	}
+	return sameEntry(a, b, times)
+}
+
+func sameEntry(a, b ManifestEntry, times bool) bool {
+	return !contentDiffers(a, b, times) &&
+		(a.Mode == b.Mode || a.IsSymlink())
+}
@@ -0,0 +1,93 @@
+package pack
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// TempPrefix starts the names of the temp files sprync writes
+// inside the trees it syncs. Walks and watches skip them.
+const TempPrefix = ".sprync-"
+
+// tempKinds are the kinds of temp file createTemp makes, and
+// tempRandLen the length of the hex suffix it gives them. A name
+// must match both to be taken for one, so that user files that
+// merely look alike are synced and never swept.
+var tempKinds = []string{"extract", "delta", "copy"}
+
+const tempRandLen = 16
+
+// IsTempName reports whether name is that of a temp file made by
+// sprync.
+func IsTempName(name string) bool {
+	_, ok := tempOwner(name)
+	return ok
+}
+
+// createTemp creates a temp file of kind in dir, named after the
+// running process so that others can tell when it is stale.
+func createTemp(dir, kind string) (*os.File, error) {
+	if !slices.Contains(tempKinds, kind) {
+		return nil, fmt.Errorf("unknown temp kind %q", kind)
+	}
+	for {
+		var b [tempRandLen / 2]byte
+		rand.Read(b[:])
+		name := fmt.Sprintf("%s%s-%d-%s",
+			TempPrefix, kind, os.Getpid(), hex.EncodeToString(b[:]),
+		)
+		f, err := os.OpenFile(filepath.Join(dir, name),
+			os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600,
+		)
+		if !errors.Is(err, fs.ErrExist) {
+			return f, err
+		}
+	}
+}
+
+// removeStaleTemps removes the temp files in dir left by
+// processes that are no longer running.
+func removeStaleTemps(dir string) {
+	ents, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range ents {
+		pid, ok := tempOwner(e.Name())
+		if !ok || pid == os.Getpid() || processAlive(pid) {
+			continue
+		}
+		os.Remove(filepath.Join(dir, e.Name()))
+	}
+}
+
+// tempOwner returns the pid in a name made by createTemp.
+func tempOwner(name string) (int, bool) {
+	rest, ok := strings.CutPrefix(name, TempPrefix)
+	if !ok {
+		return 0, false
+	}
+	parts := strings.Split(rest, "-")
+	if len(parts) != 3 || !slices.Contains(tempKinds, parts[0]) ||
+		!isTempRand(parts[2]) {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(parts[1])
+	return pid, err == nil && pid > 0
+}
+
+func isTempRand(s string) bool {
+	if len(s) != tempRandLen {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil && strings.ToLower(s) == s
+}
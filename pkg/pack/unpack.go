@@ -5,22 +5,80 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/tqbf/sprync/pkg/paths"
 )
 
+type UnpackOptions struct {
+	Compress bool
+	Times    bool
+	Progress ProgressFunc
+
+	// Only, when non-nil, limits extraction to these paths.
+	// Resumed transfers use it to skip entries that an earlier
+	// attempt already extracted.
+	Only []string
+
+	// DelayUpdates leaves every file beside its target until the
+	// whole tarball has extracted, then renames them all into
+	// place. Stage, if set, collects them and the directory
+	// modes instead, for the caller to commit once several
+	// tarballs are done.
+	DelayUpdates bool
+	Stage        *Stage
+
+	// Backup, if set, keeps the files that extraction replaces.
+	Backup *Backup
+
+	// Delete, if set, lets a file or symlink replace a directory
+	// that is not empty, once its entries are deleted as
+	// DeletePaths would delete them, into Backup. Without it,
+	// or when it keeps any, extraction fails rather than lose
+	// files the tarball never mentioned, as rsync does without
+	// --force.
+	Delete *DeleteOptions
+}
+
 func UnpackTar(
 	r io.Reader,
 	dir string,
 	compress bool,
+) (int, error) {
+	return UnpackTarWith(r, dir, UnpackOptions{Compress: compress})
+}
+
+func UnpackTarWith(
+	r io.Reader,
+	dir string,
+	opts UnpackOptions,
+) (int, error) {
+	if !opts.DelayUpdates || opts.Stage != nil {
+		return unpackTar(r, dir, opts)
+	}
+	opts.Stage = NewStage()
+	count, err := unpackTar(r, dir, opts)
+	if err != nil {
+		opts.Stage.Abort()
+		return count, err
+	}
+	return count, opts.Stage.Commit()
+}
+
+func unpackTar(
+	r io.Reader,
+	dir string,
+	opts UnpackOptions,
 ) (int, error) {
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return 0, fmt.Errorf("create dir: %w", err)
 	}
 
 	var tr *tar.Reader
-	if compress {
+	if opts.Compress {
 		gr, err := gzip.NewReader(r)
 		if err != nil {
 			return 0, fmt.Errorf("gzip reader: %w", err)
@@ -31,6 +89,16 @@ func UnpackTar(
 		tr = tar.NewReader(r)
 	}
 
+	var only map[string]bool
+	if opts.Only != nil {
+		only = make(map[string]bool, len(opts.Only))
+		for _, p := range opts.Only {
+			only[p] = true
+		}
+	}
+
+	var dirs []dirMode
+	swept := make(map[string]bool)
 	count := 0
 	for {
 		hdr, err := tr.Next()
@@ -52,48 +120,243 @@ func UnpackTar(
 				"path escapes dir: %s", name,
 			)
 		}
+		if only != nil && !only[name] {
+			continue
+		}
+
+		if err := paths.CheckParents(dir, name); err != nil {
+			return count, err
+		}
+		if parent := filepath.Dir(target); !swept[parent] {
+			swept[parent] = true
+			removeStaleTemps(parent)
+		}
 
 		switch hdr.Typeflag {
 		case tar.TypeDir:
+			if err := clearFile(opts.Backup, dir, name); err != nil {
+				return count, err
+			}
 			if err := os.MkdirAll(target, 0755); err != nil {
 				return count, fmt.Errorf(
 					"mkdir %s: %w", name, err,
 				)
 			}
+			d := dirMode{
+				Path: target,
+				Mode: os.FileMode(hdr.Mode & 0777),
+			}
+			if opts.Times {
+				d.MTime = hdr.ModTime
+			}
+			dirs = append(dirs, d)
 		case tar.TypeReg:
-			if err := extractFile(tr, target, hdr); err != nil {
+			if err := clearDir(dir, name, opts); err != nil {
+				return count, err
+			}
+			tmp, err := extractFile(tr, target, hdr, opts.Times)
+			if err != nil {
+				return count, err
+			}
+			if err := keep(opts.Backup, dir, name, tmp); err != nil {
+				return count, err
+			}
+			if err := place(opts.Stage, tmp, target); err != nil {
+				return count, err
+			}
+			count++
+			if opts.Progress != nil {
+				opts.Progress(1, hdr.Size)
+			}
+		case tar.TypeSymlink:
+			if err := clearDir(dir, name, opts); err != nil {
+				return count, err
+			}
+			tmp, err := extractSymlink(target, hdr)
+			if err != nil {
+				return count, err
+			}
+			if err := keep(opts.Backup, dir, name, tmp); err != nil {
+				return count, err
+			}
+			if err := place(opts.Stage, tmp, target); err != nil {
 				return count, err
 			}
 			count++
+			if opts.Progress != nil {
+				opts.Progress(1, 0)
+			}
 		}
 	}
-	return count, nil
+
+	if opts.Stage != nil {
+		opts.Stage.addDirs(dirs)
+		return count, nil
+	}
+	return count, applyDirModes(dirs)
 }
 
+// keep backs up name before tmp replaces it.
+func keep(b *Backup, dir, name, tmp string) error {
+	if tmp == "" {
+		return nil
+	}
+	if err := b.Save(dir, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// place renames tmp over target, or leaves it for stage to.
+func place(stage *Stage, tmp, target string) error {
+	switch {
+	case tmp == "":
+		return nil
+	case stage != nil:
+		stage.add(tmp, target)
+		return nil
+	}
+	if err := replaceWith(tmp, target); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// extractFile writes the file to a temp file beside target, so
+// readers of target never see it half written, and returns its
+// path.
 func extractFile(
-	tr *tar.Reader, target string, hdr *tar.Header,
-) error {
+	tr *tar.Reader, target string, hdr *tar.Header, times bool,
+) (string, error) {
 	parent := filepath.Dir(target)
 	if err := os.MkdirAll(parent, 0755); err != nil {
-		return fmt.Errorf("mkdir parent: %w", err)
+		return "", fmt.Errorf("mkdir parent: %w", err)
 	}
 
-	f, err := os.OpenFile(
-		target,
-		os.O_CREATE|os.O_WRONLY|os.O_TRUNC,
-		os.FileMode(hdr.Mode&0777),
-	)
+	f, err := createTemp(parent, "extract")
 	if err != nil {
-		return fmt.Errorf("create %s: %w", hdr.Name, err)
+		return "", fmt.Errorf("create %s: %w", hdr.Name, err)
 	}
+	tmp := f.Name()
 
 	_, copyErr := io.Copy(f, tr)
 	closeErr := f.Close()
-	if copyErr != nil {
-		return fmt.Errorf("write %s: %w", hdr.Name, copyErr)
+	switch {
+	case copyErr != nil:
+		err = fmt.Errorf("write %s: %w", hdr.Name, copyErr)
+	case closeErr != nil:
+		err = fmt.Errorf("close %s: %w", hdr.Name, closeErr)
+	default:
+		err = os.Chmod(tmp, os.FileMode(hdr.Mode&0777))
+		if err != nil {
+			err = fmt.Errorf("chmod %s: %w", hdr.Name, err)
+		}
+	}
+	if err == nil && times {
+		err = os.Chtimes(tmp, hdr.ModTime, hdr.ModTime)
+		if err != nil {
+			err = fmt.Errorf("chtimes %s: %w", hdr.Name, err)
+		}
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// extractSymlink creates the link beside target and returns its
+// path, or "" when target already is that link.
+func extractSymlink(
+	target string, hdr *tar.Header,
+) (string, error) {
+	parent := filepath.Dir(target)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return "", fmt.Errorf("mkdir parent: %w", err)
+	}
+
+	if info, err := os.Lstat(target); err == nil &&
+		info.Mode()&os.ModeSymlink != 0 &&
+		readlinkEquals(target, hdr.Linkname) {
+		return "", nil
+	}
+
+	f, err := createTemp(parent, "extract")
+	if err != nil {
+		return "", fmt.Errorf("symlink %s: %w", hdr.Name, err)
+	}
+	tmp := f.Name()
+	f.Close()
+	os.Remove(tmp)
+	if err := os.Symlink(hdr.Linkname, tmp); err != nil {
+		return "", fmt.Errorf("symlink %s: %w", hdr.Name, err)
+	}
+	return tmp, nil
+}
+
+func readlinkEquals(target, linkname string) bool {
+	cur, err := os.Readlink(target)
+	return err == nil && cur == linkname
+}
+
+// clearFile moves the file or symlink at name into b, or
+// removes it, for a directory to take its place.
+func clearFile(b *Backup, dir, name string) error {
+	info, err := os.Lstat(filepath.Join(dir, name))
+	if err != nil || info.IsDir() {
+		return nil
+	}
+	return b.Remove(dir, name)
+}
+
+// clearDir deletes the entries of the directory at name, as
+// opts.Delete says, for a file or symlink to take its place.
+func clearDir(dir, name string, opts UnpackOptions) error {
+	target := filepath.Join(dir, name)
+	info, err := os.Lstat(target)
+	if err != nil || !info.IsDir() || !hasEntries(target) {
+		return nil
 	}
-	if closeErr != nil {
-		return fmt.Errorf("close %s: %w", hdr.Name, closeErr)
+	if opts.Delete == nil {
+		return fmt.Errorf(
+			"replace %s: directory is not empty and deletes are off",
+			name,
+		)
+	}
+
+	var entries []string
+	err = filepath.WalkDir(target, func(
+		p string, d fs.DirEntry, err error,
+	) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err == nil && rel != name {
+			entries = append(entries, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("replace %s: %w", name, err)
+	}
+
+	del := *opts.Delete
+	del.Backup = opts.Backup
+	DeletePaths(dir, entries, del, func(p string, e error) {
+		if err == nil {
+			err = fmt.Errorf("delete %s: %w", p, e)
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("replace %s: %w", name, err)
+	}
+	if hasEntries(target) {
+		return fmt.Errorf(
+			"replace %s: directory still holds kept files", name,
+		)
 	}
 	return nil
 }
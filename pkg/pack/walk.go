@@ -0,0 +1,191 @@
+package pack
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/tqbf/sprync/pkg/paths"
+)
+
+// DefaultIgnoreFiles are the per-directory ignore files that
+// sprync reads unless told otherwise.
+var DefaultIgnoreFiles = []string{".gitignore", ".spryncignore"}
+
+type WalkOptions struct {
+	// Filters are checked first, in order. Excludes are
+	// gitignore-style patterns, which override those in the
+	// IgnoreFiles found in each directory.
+	Filters     []paths.FilterRule
+	Excludes    []string
+	IgnoreFiles []string
+	CopyLinks   bool
+
+	// Cache, when set, supplies hashes for files whose stat
+	// tuple is unchanged. Checksum forces every file to be
+	// rehashed while still refreshing the cache.
+	Cache    *HashCache
+	Checksum bool
+
+	// Only, when non-nil, limits the walk to these paths and
+	// everything below them. Paths that no longer exist are
+	// skipped.
+	Only []string
+
+	Progress ProgressFunc
+}
+
+// WalkFunc sees every directory, regular file and symlink (or,
+// with CopyLinks, its referent) below the root, parents before
+// children. Returning an error aborts the walk.
+type WalkFunc func(
+	rel, abs string, info fs.FileInfo, err error,
+) error
+
+func WalkTree(
+	dir string,
+	opts WalkOptions,
+	fn WalkFunc,
+) error {
+	w := &walker{
+		matcher: paths.NewMatcher(dir, paths.MatchOptions{
+			Filters:     opts.Filters,
+			Excludes:    opts.Excludes,
+			IgnoreFiles: opts.IgnoreFiles,
+		}),
+		copyLinks: opts.CopyLinks,
+		fn:        fn,
+		active:    make(map[string]bool),
+	}
+	if w.copyLinks {
+		if real, err := filepath.EvalSymlinks(dir); err == nil {
+			w.active[real] = true
+		}
+	}
+	if opts.Only != nil {
+		return w.walkOnly(dir, opts.Only)
+	}
+	return w.walk(dir, "")
+}
+
+type walker struct {
+	matcher   *paths.ExcludeMatcher
+	copyLinks bool
+	fn        WalkFunc
+	active    map[string]bool
+}
+
+func (w *walker) walk(abs, rel string) error {
+	ents, err := os.ReadDir(abs)
+	if err != nil {
+		if rel == "" {
+			return err
+		}
+		return w.fn(rel, abs, nil, err)
+	}
+
+	for _, d := range ents {
+		childRel := path.Join(rel, d.Name())
+		childAbs := filepath.Join(abs, d.Name())
+
+		if IsTempName(d.Name()) ||
+			w.matcher.MatchEntry(childRel, d.IsDir()) {
+			continue
+		}
+
+		info, err := d.Info()
+		if err == nil && w.copyLinks &&
+			info.Mode()&fs.ModeSymlink != 0 {
+			info, err = os.Stat(childAbs)
+		}
+		if err != nil {
+			if err := w.fn(childRel, childAbs, nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch {
+		case info.IsDir():
+			err := w.walkSubdir(childAbs, childRel, info)
+			if err != nil {
+				return err
+			}
+		case info.Mode().IsRegular(),
+			info.Mode()&fs.ModeSymlink != 0:
+			if err := w.fn(childRel, childAbs, info, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *walker) walkOnly(dir string, only []string) error {
+	for _, rel := range only {
+		if err := paths.ValidateRelPath(rel); err != nil {
+			return err
+		}
+		abs := filepath.Join(dir, filepath.FromSlash(rel))
+		info, err := os.Lstat(abs)
+		isDir := err == nil && info.IsDir()
+		if err == nil && w.copyLinks &&
+			info.Mode()&fs.ModeSymlink != 0 {
+			info, err = os.Stat(abs)
+		}
+		if errors.Is(err, fs.ErrNotExist) ||
+			IsTempName(path.Base(rel)) ||
+			w.matcher.MatchPath(rel, isDir) {
+			continue
+		}
+		if err != nil {
+			if err := w.fn(rel, abs, nil, err); err != nil {
+				return err
+			}
+			continue
+		}
+
+		switch {
+		case info.IsDir():
+			if err := w.walkSubdir(abs, rel, info); err != nil {
+				return err
+			}
+		case info.Mode().IsRegular(),
+			info.Mode()&fs.ModeSymlink != 0:
+			if err := w.fn(rel, abs, info, nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *walker) walkSubdir(
+	abs, rel string, info fs.FileInfo,
+) error {
+	if !w.copyLinks {
+		if err := w.fn(rel, abs, info, nil); err != nil {
+			return err
+		}
+		return w.walk(abs, rel)
+	}
+
+	real, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return w.fn(rel, abs, nil, err)
+	}
+	if w.active[real] {
+		return w.fn(rel, abs, nil,
+			fmt.Errorf("symlink loop at %s", rel),
+		)
+	}
+	if err := w.fn(rel, abs, info, nil); err != nil {
+		return err
+	}
+	w.active[real] = true
+	defer delete(w.active, real)
+	return w.walk(abs, rel)
+}
@@ -1,86 +1,258 @@
 package paths
 
 import (
+	"os"
+	"path"
 	"path/filepath"
 	"strings"
 )
 
+// ExcludeMatcher decides which paths below a root are excluded.
+// A chain of filter rules goes first, and the first that matches
+// decides. Failing that, the patterns given up front and then
+// those read from ignore files, loaded from each directory as
+// paths below it are matched, decide with gitignore semantics.
 type ExcludeMatcher struct {
-	patterns []string
+	root        string
+	ignoreFiles []string
+	filters     []rule
+	patterns    []rule
+	dirs        map[string][]rule
+}
+
+// MatchOptions say what a matcher excludes: Filters, checked in
+// order with the first match deciding, then Excludes and the
+// patterns in IgnoreFiles, with gitignore semantics.
+type MatchOptions struct {
+	Filters     []FilterRule
+	Excludes    []string
+	IgnoreFiles []string
+}
+
+// rule is one parsed gitignore pattern. Anchored patterns match
+// the path below base segment by segment; others match only the
+// last segment, at any depth.
+type rule struct {
+	base     string
+	segs     []string
+	negate   bool
+	dirOnly  bool
+	anchored bool
 }
 
 func NewExcludeMatcher(patterns []string) *ExcludeMatcher {
-	return &ExcludeMatcher{patterns: patterns}
+	return NewMatcher("", MatchOptions{Excludes: patterns})
 }
 
-func (m *ExcludeMatcher) Match(relPath string) bool {
-	for _, pat := range m.patterns {
-		if matchPattern(pat, relPath) {
-			return true
+// NewMatcher returns a matcher for the tree at root, which it
+// reads opts.IgnoreFiles, such as .gitignore, from.
+func NewMatcher(root string, opts MatchOptions) *ExcludeMatcher {
+	m := &ExcludeMatcher{
+		root:        root,
+		ignoreFiles: opts.IgnoreFiles,
+		dirs:        make(map[string][]rule),
+	}
+	for _, f := range opts.Filters {
+		if r, ok := parseRule("", f.Pattern); ok {
+			r.negate = r.negate != f.Include
+			m.filters = append(m.filters, r)
 		}
 	}
-	return false
+	for _, p := range opts.Excludes {
+		if r, ok := parseRule("", p); ok {
+			m.patterns = append(m.patterns, r)
+		}
+	}
+	return m
 }
 
-func matchPattern(pattern, relPath string) bool {
-	pattern = strings.TrimSuffix(pattern, "/")
-	if strings.Contains(pattern, "/") {
-		return matchPathPattern(pattern, relPath)
-	}
+// Match reports whether relPath or one of its parents is
+// excluded, taking relPath to be a directory where it matters.
+func (m *ExcludeMatcher) Match(relPath string) bool {
+	return m.MatchPath(relPath, true)
+}
+
+// MatchPath reports whether relPath or one of its parents is
+// excluded.
+func (m *ExcludeMatcher) MatchPath(relPath string, isDir bool) bool {
 	parts := strings.Split(relPath, "/")
-	for _, part := range parts {
-		if matched, _ := filepath.Match(pattern, part); matched {
+	for i := 1; i < len(parts); i++ {
+		if m.MatchEntry(strings.Join(parts[:i], "/"), true) {
 			return true
 		}
 	}
-	if strings.Contains(pattern, "**") {
-		return matchDoublestar(pattern, relPath)
+	return m.MatchEntry(relPath, isDir)
+}
+
+// MatchEntry reports whether relPath is excluded, assuming its
+// parents are not, as when walking the tree top down.
+func (m *ExcludeMatcher) MatchEntry(relPath string, isDir bool) bool {
+	for _, r := range m.filters {
+		if r.match(relPath, isDir) {
+			return !r.negate
+		}
+	}
+	if excluded, ok := decide(m.patterns, relPath, isDir); ok {
+		return excluded
+	}
+	dir := relPath
+	for dir != "" {
+		dir = parentDir(dir)
+		rules := m.load(dir)
+		if excluded, ok := decide(rules, relPath, isDir); ok {
+			return excluded
+		}
 	}
 	return false
 }
 
-func matchPathPattern(pattern, relPath string) bool {
-	if strings.Contains(pattern, "**") {
-		return matchDoublestar(pattern, relPath)
+// decide returns the verdict of the last rule matching relPath.
+func decide(rules []rule, relPath string, isDir bool) (bool, bool) {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].match(relPath, isDir) {
+			return !rules[i].negate, true
+		}
 	}
-	matched, _ := filepath.Match(pattern, relPath)
-	return matched
+	return false, false
 }
 
-func matchDoublestar(pattern, relPath string) bool {
-	parts := strings.Split(pattern, "**")
-	if len(parts) != 2 {
-		return false
+func (m *ExcludeMatcher) load(dir string) []rule {
+	if m.root == "" || len(m.ignoreFiles) == 0 {
+		return nil
+	}
+	if rules, ok := m.dirs[dir]; ok {
+		return rules
+	}
+	var rules []rule
+	for _, name := range m.ignoreFiles {
+		file := filepath.Join(
+			m.root, filepath.FromSlash(dir), name,
+		)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if r, ok := parseRule(dir, line); ok {
+				rules = append(rules, r)
+			}
+		}
 	}
-	prefix := strings.TrimSuffix(parts[0], "/")
-	suffix := strings.TrimPrefix(parts[1], "/")
+	m.dirs[dir] = rules
+	return rules
+}
 
-	if prefix == "" && suffix == "" {
-		return true
+func parentDir(p string) string {
+	dir := path.Dir(p)
+	if dir == "." {
+		return ""
 	}
-	if prefix == "" {
-		return matchSuffix(suffix, relPath)
+	return dir
+}
+
+func parseRule(base, line string) (rule, bool) {
+	line = strings.TrimSuffix(line, "\r")
+	line = trimTrailingSpaces(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule{}, false
+	}
+
+	r := rule{base: base}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimLeft(line, "/")
+	}
+	if line == "" {
+		return rule{}, false
+	}
+
+	for _, seg := range strings.Split(line, "/") {
+		if seg == "**" && len(r.segs) > 0 &&
+			r.segs[len(r.segs)-1] == "**" {
+			continue
+		}
+		r.segs = append(r.segs, globSegment(seg))
+	}
+	return r, true
+}
+
+// trimTrailingSpaces drops trailing spaces unless escaped with a
+// backslash.
+func trimTrailingSpaces(line string) string {
+	trimmed := strings.TrimRight(line, " ")
+	if strings.HasSuffix(trimmed, `\`) && len(trimmed) < len(line) {
+		return trimmed + " "
 	}
-	if suffix == "" {
-		return strings.HasPrefix(relPath, prefix+"/") ||
-			relPath == prefix
+	return trimmed
+}
+
+// globSegment turns gitignore's "[!...]" into path.Match's
+// "[^...]".
+func globSegment(seg string) string {
+	var b strings.Builder
+	for i := 0; i < len(seg); i++ {
+		b.WriteByte(seg[i])
+		switch {
+		case seg[i] == '\\' && i+1 < len(seg):
+			i++
+			b.WriteByte(seg[i])
+		case seg[i] == '[' && i+1 < len(seg) && seg[i+1] == '!':
+			b.WriteByte('^')
+			i++
+		}
 	}
-	if !strings.HasPrefix(relPath, prefix+"/") {
+	return b.String()
+}
+
+func (r rule) match(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
 		return false
 	}
-	return matchSuffix(
-		suffix,
-		strings.TrimPrefix(relPath, prefix+"/"),
-	)
+	if r.base != "" {
+		if !strings.HasPrefix(relPath, r.base+"/") {
+			return false
+		}
+		relPath = relPath[len(r.base)+1:]
+	}
+	if !r.anchored {
+		ok, _ := path.Match(r.segs[0], path.Base(relPath))
+		return ok
+	}
+	return matchSegments(r.segs, strings.Split(relPath, "/"))
 }
 
-func matchSuffix(suffix, relPath string) bool {
-	parts := strings.Split(relPath, "/")
-	for i := range parts {
-		tail := strings.Join(parts[i:], "/")
-		if matched, _ := filepath.Match(suffix, tail); matched {
-			return true
+// matchSegments matches a path segment by segment. "**" matches
+// any number of segments, but at the end at least one: "dir/**"
+// is everything inside dir, not dir itself.
+func matchSegments(segs, parts []string) bool {
+	for len(segs) > 0 {
+		if segs[0] == "**" {
+			rest := segs[1:]
+			if len(rest) == 0 {
+				return len(parts) > 0
+			}
+			for i := range len(parts) + 1 {
+				if matchSegments(rest, parts[i:]) {
+					return true
+				}
+			}
+			return false
 		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(segs[0], parts[0]); !ok {
+			return false
+		}
+		segs, parts = segs[1:], parts[1:]
 	}
-	return false
+	return len(parts) == 0
 }
@@ -1,6 +1,8 @@
 package paths
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -117,3 +119,86 @@ func TestExcludeDotfiles(t *testing.T) {
 	assert.False(t, m.Match("env"))
 	assert.False(t, m.Match("dotenv.go"))
 }
+
+func TestExcludeNegation(t *testing.T) {
+	m := NewExcludeMatcher([]string{"*.log", "!keep.log"})
+	assert.True(t, m.Match("debug.log"))
+	assert.False(t, m.Match("keep.log"))
+	assert.False(t, m.Match("logs/keep.log"))
+
+	m = NewExcludeMatcher([]string{"build/", "!build/keep.txt"})
+	assert.True(t, m.MatchPath("build/keep.txt", false))
+}
+
+func TestExcludeAnchored(t *testing.T) {
+	m := NewExcludeMatcher([]string{"/TODO", "a/*/c"})
+	assert.True(t, m.Match("TODO"))
+	assert.False(t, m.Match("src/TODO"))
+	assert.True(t, m.Match("a/b/c"))
+	assert.False(t, m.Match("x/a/b/c"))
+	assert.False(t, m.Match("a/b/b/c"))
+}
+
+func TestExcludeDirOnly(t *testing.T) {
+	m := NewExcludeMatcher([]string{"cache/"})
+	assert.True(t, m.MatchPath("cache", true))
+	assert.False(t, m.MatchPath("cache", false))
+	assert.True(t, m.MatchPath("src/cache/x.go", false))
+	assert.False(t, m.MatchPath("src/cache", false))
+}
+
+func TestExcludeMultipleDoublestar(t *testing.T) {
+	m := NewExcludeMatcher([]string{"**/gen/**/*.go"})
+	assert.True(t, m.Match("gen/a.go"))
+	assert.True(t, m.Match("src/gen/x/y/a.go"))
+	assert.False(t, m.Match("src/gen.go"))
+
+	m = NewExcludeMatcher([]string{"out/**"})
+	assert.False(t, m.MatchPath("out", true))
+	assert.True(t, m.Match("out/a"))
+}
+
+func TestExcludeClassesAndEscapes(t *testing.T) {
+	m := NewExcludeMatcher([]string{
+		"[!a]*.tmp", `\#notes`, `\!bang`, "trail\\ ",
+	})
+	assert.True(t, m.Match("b.tmp"))
+	assert.False(t, m.Match("a.tmp"))
+	assert.True(t, m.Match("#notes"))
+	assert.True(t, m.Match("!bang"))
+	assert.True(t, m.Match("trail "))
+	assert.False(t, m.Match("trail"))
+
+	m = NewExcludeMatcher([]string{"# comment", "", "   "})
+	assert.False(t, m.Match("# comment"))
+}
+
+func TestIgnoreFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(rel, body string) {
+		p := filepath.Join(dir, rel)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		assert.NoError(t, os.WriteFile(p, []byte(body), 0644))
+	}
+	write(".gitignore", "*.log\n/dist\n")
+	write("src/.gitignore", "!trace.log\n/gen\n")
+	write("src/.spryncignore", "secret.txt\n")
+
+	m := NewMatcher(dir, MatchOptions{
+		Excludes:    []string{"*.bak"},
+		IgnoreFiles: []string{".gitignore", ".spryncignore"},
+	})
+	assert.True(t, m.MatchPath("app.log", false))
+	assert.True(t, m.MatchPath("dist", true))
+	assert.False(t, m.MatchPath("src/dist", true))
+	assert.False(t, m.MatchPath("src/trace.log", false))
+	assert.True(t, m.MatchPath("src/other.log", false))
+	assert.True(t, m.MatchPath("src/gen/x.go", false))
+	assert.False(t, m.MatchPath("gen", true))
+	assert.True(t, m.MatchPath("src/secret.txt", false))
+	assert.False(t, m.MatchPath("secret.txt", false))
+	assert.True(t, m.MatchPath("src/a.bak", false))
+
+	m = NewMatcher(dir, MatchOptions{})
+	assert.False(t, m.MatchPath("app.log", false))
+}
@@ -0,0 +1,72 @@
+package paths
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// FilterRule is one --include or --exclude rule. A chain of them
+// is checked in order and the first whose pattern matches
+// decides.
+type FilterRule struct {
+	Include bool   `json:"include,omitempty"`
+	Pattern string `json:"pattern"`
+}
+
+// ParseFilters reads rsync-style filter rules, one per line:
+// "+ pattern" or "include pattern", "- pattern" or "exclude
+// pattern". Blank lines and lines starting with # or ; are
+// skipped.
+func ParseFilters(r io.Reader) ([]FilterRule, error) {
+	var rules []FilterRule
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if strings.TrimSpace(line) == "" ||
+			strings.HasPrefix(line, "#") ||
+			strings.HasPrefix(line, ";") {
+			continue
+		}
+		kind, pattern, ok := strings.Cut(line, " ")
+		if !ok || pattern == "" {
+			return nil, fmt.Errorf("line %d: want \"+ pattern\" "+
+				"or \"- pattern\"", n)
+		}
+		switch kind {
+		case "+", "include":
+			rules = append(rules, FilterRule{
+				Include: true, Pattern: pattern,
+			})
+		case "-", "exclude":
+			rules = append(rules, FilterRule{Pattern: pattern})
+		default:
+			return nil, fmt.Errorf(
+				"line %d: unknown rule %q", n, kind,
+			)
+		}
+	}
+	return rules, sc.Err()
+}
+
+// ParseFileList reads paths relative to the synced dir, one per
+// line, as for --files-from. Blank lines and lines starting with
+// # are skipped.
+func ParseFileList(r io.Reader) ([]string, error) {
+	list := []string{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := path.Clean(line)
+		if err := ValidateRelPath(p); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		list = append(list, p)
+	}
+	return list, sc.Err()
+}
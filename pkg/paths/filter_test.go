@@ -0,0 +1,75 @@
+package paths
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterFirstMatchWins(t *testing.T) {
+	// Only src/ and *.toml, but not src/gen.
+	m := NewMatcher("", MatchOptions{Filters: []FilterRule{
+		{Pattern: "src/gen"},
+		{Include: true, Pattern: "src/"},
+		{Include: true, Pattern: "src/**"},
+		{Include: true, Pattern: "*.toml"},
+		{Pattern: "*"},
+	}})
+	assert.False(t, m.MatchPath("src", true))
+	assert.False(t, m.MatchPath("src/main.go", false))
+	assert.False(t, m.MatchPath("src/lib/util.go", false))
+	assert.True(t, m.MatchPath("src/gen", true))
+	assert.True(t, m.MatchPath("src/gen/api.go", false))
+	assert.False(t, m.MatchPath("Cargo.toml", false))
+	assert.True(t, m.MatchPath("README.md", false))
+	assert.True(t, m.MatchPath("docs", true))
+}
+
+func TestFilterBeforeExcludes(t *testing.T) {
+	m := NewMatcher("", MatchOptions{
+		Filters:  []FilterRule{{Include: true, Pattern: "keep.log"}},
+		Excludes: []string{"*.log"},
+	})
+	assert.False(t, m.Match("keep.log"))
+	assert.True(t, m.Match("other.log"))
+}
+
+func TestParseFilters(t *testing.T) {
+	rules, err := ParseFilters(strings.NewReader(`
+# comment
+; also a comment
++ src/
+include *.toml
+- /target
+exclude *.tmp
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, []FilterRule{
+		{Include: true, Pattern: "src/"},
+		{Include: true, Pattern: "*.toml"},
+		{Pattern: "/target"},
+		{Pattern: "*.tmp"},
+	}, rules)
+
+	_, err = ParseFilters(strings.NewReader("* oops\n"))
+	assert.Error(t, err)
+	_, err = ParseFilters(strings.NewReader("+\n"))
+	assert.Error(t, err)
+}
+
+func TestParseFileList(t *testing.T) {
+	list, err := ParseFileList(strings.NewReader(
+		"./src/main.go\n\n# skip\ndocs/\n",
+	))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"src/main.go", "docs"}, list)
+
+	list, err = ParseFileList(strings.NewReader(""))
+	assert.NoError(t, err)
+	assert.NotNil(t, list)
+	assert.Empty(t, list)
+
+	_, err = ParseFileList(strings.NewReader("../etc/passwd\n"))
+	assert.Error(t, err)
+}
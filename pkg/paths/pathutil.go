@@ -2,6 +2,7 @@ package paths
 
 import (
 	"fmt"
+	"os"
 	"path"
 	"path/filepath"
 	"strings"
@@ -44,3 +45,19 @@ func IsWithinDir(dir, full string) bool {
 		!strings.HasPrefix(rel, "../") &&
 		!filepath.IsAbs(rel)
 }
+
+func CheckParents(dir, rel string) error {
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	cur := dir
+	for _, p := range parts[:len(parts)-1] {
+		cur = filepath.Join(cur, p)
+		info, err := os.Lstat(cur)
+		if err != nil {
+			return nil
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("path crosses symlink: %s", rel)
+		}
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package paths
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -74,3 +76,17 @@ func TestIsWithinDir(t *testing.T) {
 		"/tmp/ab/c",
 	))
 }
+
+func TestCheckParents(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "a/b"), 0755))
+	assert.NoError(t, os.Symlink(
+		t.TempDir(), filepath.Join(dir, "a/link"),
+	))
+
+	assert.NoError(t, CheckParents(dir, "a/b/file.txt"))
+	assert.NoError(t, CheckParents(dir, "a/link"))
+	assert.NoError(t, CheckParents(dir, "missing/x/y"))
+	assert.Error(t, CheckParents(dir, "a/link/file.txt"))
+	assert.Error(t, CheckParents(dir, "a/link/deep/file.txt"))
+}
@@ -3,31 +3,98 @@ package protocol
 import (
 	"encoding/json"
 	"fmt"
+
+	"github.com/tqbf/sprync/pkg/pack"
+	"github.com/tqbf/sprync/pkg/paths"
 )
 
 type Request struct {
 	Cmd      string   `json:"cmd"`
 	Dir      string   `json:"dir,omitempty"`
 	Excludes []string `json:"excludes,omitempty"`
-	Paths    []string `json:"paths,omitempty"`
+	// Paths is sent even when empty, since an empty Only means
+	// no paths where a missing one means all of them.
+	Paths    []string `json:"paths"`
 	Dest     string   `json:"dest,omitempty"`
 	Src      string   `json:"src,omitempty"`
 	Compress bool     `json:"compress,omitempty"`
 	URL      string   `json:"url,omitempty"`
 	Token    string   `json:"token,omitempty"`
+
+	// Filters is the include/exclude rule chain a manifest
+	// checks before Excludes. IgnoreFiles name the
+	// per-directory ignore files it honours after them.
+	Filters     []paths.FilterRule `json:"filters,omitempty"`
+	IgnoreFiles []string           `json:"ignore_files,omitempty"`
+
+	CopyLinks bool `json:"copy_links,omitempty"`
+	Times     bool `json:"times,omitempty"`
+	Checksum  bool `json:"checksum,omitempty"`
+	Progress  bool `json:"progress,omitempty"`
+	Keep      bool `json:"keep,omitempty"`
+	NoParents bool `json:"no_parents,omitempty"`
+
+	// DelayUpdates makes an extract or patch rename files into
+	// place only once all of them are written.
+	DelayUpdates bool `json:"delay_updates,omitempty"`
+
+	// Stage, a file under /tmp, makes extract and patch leave
+	// their files staged and list them there instead, for a
+	// commit to put in place together with other stages. Abort
+	// makes the commit remove them.
+	Stage string `json:"stage,omitempty"`
+	Abort bool   `json:"abort,omitempty"`
+
+	// Backup names the set that extract, patch, copy and delete
+	// keep the files they replace or delete in. A set without a
+	// root goes under spryncd's state dir.
+	Backup *pack.Backup `json:"backup,omitempty"`
+
+	// Protect patterns match paths a delete must keep. So must
+	// it keep those Filters, Excludes and IgnoreFiles exclude,
+	// unless DeleteExcluded is set. Delete lets extract delete
+	// the same way what a directory holds, so that a file or
+	// symlink can replace it.
+	Protect        []string `json:"protect,omitempty"`
+	DeleteExcluded bool     `json:"delete_excluded,omitempty"`
+	Delete         bool     `json:"delete,omitempty"`
+
+	// BWLimit caps a transfer upload in bytes per second.
+	BWLimit int64 `json:"bwlimit,omitempty"`
+
+	Modes  map[string]int `json:"modes,omitempty"`
+	Copies []CopyOp       `json:"copies,omitempty"`
+}
+
+type CopyOp struct {
+	From   string `json:"from"`
+	To     string `json:"to"`
+	Mode   int    `json:"mode"`
+	MTime  int64  `json:"mtime,omitempty"`
+	Rename bool   `json:"rename,omitempty"`
 }
 
 type ResponseType string
 
 const (
-	TypeReady        ResponseType = "ready"
-	TypeEntry        ResponseType = "entry"
-	TypeManifestDone ResponseType = "manifest_done"
-	TypePackDone     ResponseType = "pack_done"
-	TypeExtractDone  ResponseType = "extract_done"
-	TypeDeleteDone   ResponseType = "delete_done"
-	TypeTransferDone ResponseType = "transfer_done"
-	TypeError        ResponseType = "error"
+	TypeReady         ResponseType = "ready"
+	TypeEntry         ResponseType = "entry"
+	TypeManifestDone  ResponseType = "manifest_done"
+	TypePackDone      ResponseType = "pack_done"
+	TypeExtractDone   ResponseType = "extract_done"
+	TypeDeleteDone    ResponseType = "delete_done"
+	TypeChmodDone     ResponseType = "chmod_done"
+	TypeCopyDone      ResponseType = "copy_done"
+	TypeSignatureDone ResponseType = "signature_done"
+	TypePatchDone     ResponseType = "patch_done"
+	TypeTransferDone  ResponseType = "transfer_done"
+	TypeConcatDone    ResponseType = "concat_done"
+	TypeDiscardDone   ResponseType = "discard_done"
+	TypeCommitDone    ResponseType = "commit_done"
+	TypeBackups       ResponseType = "backups"
+	TypeRestoreDone   ResponseType = "restore_done"
+	TypeProgress      ResponseType = "progress"
+	TypeError         ResponseType = "error"
 )
 
 type Response struct {
@@ -39,12 +106,22 @@ type Response struct {
 	Hash string `json:"hash,omitempty"`
 	Mode int    `json:"mode,omitempty"`
 	Size int64  `json:"size,omitempty"`
+	Link string `json:"link,omitempty"`
+
+	IsDir bool  `json:"is_dir,omitempty"`
+	MTime int64 `json:"mtime,omitempty"`
 
 	Count     int   `json:"count,omitempty"`
+	Dirs      int   `json:"dirs,omitempty"`
 	Exists    *bool `json:"exists,omitempty"`
 	ElapsedMs int64 `json:"elapsed_ms,omitempty"`
 
-	Dest string `json:"dest,omitempty"`
+	CacheHits   int `json:"cache_hits,omitempty"`
+	CacheMisses int `json:"cache_misses,omitempty"`
+
+	Dest   string   `json:"dest,omitempty"`
+	Failed []string `json:"failed,omitempty"`
+	Names  []string `json:"names,omitempty"`
 
 	Message string `json:"message,omitempty"`
 	Fatal   bool   `json:"fatal,omitempty"`
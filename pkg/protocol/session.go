@@ -18,14 +18,20 @@ import (
 )
 
 type Session struct {
-	client     *spriteapi.Client
-	sprite     string
-	conn       *WSConn
-	scanner    *bufio.Scanner
-	mu         sync.Mutex
-	remoteBin  string
-	Version    string
-	PID        int
+	client    *spriteapi.Client
+	sprite    string
+	conn      *WSConn
+	scanner   *bufio.Scanner
+	mu        sync.Mutex
+	remoteBin string
+	forked    bool
+	Version   string
+	PID       int
+
+	// OnProgress, when set, asks spryncd for progress updates
+	// during manifest, extract and transfer and receives the
+	// running file and byte counts.
+	OnProgress func(count int, bytes int64)
 }
 
 func OpenSession(
@@ -42,7 +48,27 @@ func OpenSession(
 	if err != nil {
 		return nil, err
 	}
+	return startSession(ctx, client, sprite, remoteBin)
+}
+
+// Fork starts another spryncd on the same sprite from the binary
+// this session already uploaded, for running commands in
+// parallel. The binary stays until the original session closes.
+func (s *Session) Fork(ctx context.Context) (*Session, error) {
+	fork, err := startSession(ctx, s.client, s.sprite, s.remoteBin)
+	if err != nil {
+		return nil, err
+	}
+	fork.forked = true
+	return fork, nil
+}
 
+func startSession(
+	ctx context.Context,
+	client *spriteapi.Client,
+	sprite string,
+	remoteBin string,
+) (*Session, error) {
 	ws, err := client.ExecWebSocket(
 		ctx, sprite, []string{remoteBin}, true,
 	)
@@ -112,23 +138,52 @@ func (s *Session) Manifest(
 	dir string,
 	excludes []string,
 ) ([]pack.ManifestEntry, bool, time.Duration, error) {
+	res, err := s.ManifestWith(dir, pack.WalkOptions{
+		Excludes:    excludes,
+		IgnoreFiles: pack.DefaultIgnoreFiles,
+	})
+	if err != nil {
+		return nil, false, 0, err
+	}
+	return res.Entries, res.Exists, res.Elapsed, nil
+}
+
+type ManifestResult struct {
+	Entries []pack.ManifestEntry
+	Exists  bool
+	Elapsed time.Duration
+
+	CacheHits   int
+	CacheMisses int
+}
+
+func (s *Session) ManifestWith(
+	dir string,
+	opts pack.WalkOptions,
+) (*ManifestResult, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	err := s.sendCmd(Request{
-		Cmd:      "manifest",
-		Dir:      dir,
-		Excludes: excludes,
+		Cmd:         "manifest",
+		Dir:         dir,
+		Filters:     opts.Filters,
+		Excludes:    opts.Excludes,
+		IgnoreFiles: opts.IgnoreFiles,
+		Paths:       opts.Only,
+		CopyLinks:   opts.CopyLinks,
+		Checksum:    opts.Checksum,
+		Progress:    s.OnProgress != nil,
 	})
 	if err != nil {
-		return nil, false, 0, err
+		return nil, err
 	}
 
 	var entries []pack.ManifestEntry
 	for {
 		resp, err := s.readResponse()
 		if err != nil {
-			return nil, false, 0, err
+			return nil, err
 		}
 		switch resp.Type {
 		case TypeEntry:
@@ -137,20 +192,32 @@ func (s *Session) Manifest(
 				Hash: resp.Hash,
 				Mode: resp.Mode,
 				Size: resp.Size,
+				Link: resp.Link,
+				Dir:  resp.IsDir,
+
+				MTime: resp.MTime,
 			})
 		case TypeManifestDone:
-			exists := resp.Exists != nil && *resp.Exists
-			elapsed := time.Duration(
-				resp.ElapsedMs,
-			) * time.Millisecond
-			return entries, exists, elapsed, nil
+			return &ManifestResult{
+				Entries: entries,
+				Exists:  resp.Exists != nil && *resp.Exists,
+				Elapsed: time.Duration(
+					resp.ElapsedMs,
+				) * time.Millisecond,
+				CacheHits:   resp.CacheHits,
+				CacheMisses: resp.CacheMisses,
+			}, nil
+		case TypeProgress:
+			if s.OnProgress != nil {
+				s.OnProgress(resp.Count, resp.Size)
+			}
 		case TypeError:
 			if resp.Fatal {
-				return nil, false, 0,
+				return nil,
 					fmt.Errorf("%s", resp.Message)
 			}
 		default:
-			return nil, false, 0, fmt.Errorf(
+			return nil, fmt.Errorf(
 				"unexpected response: %s", resp.Type,
 			)
 		}
@@ -167,26 +234,78 @@ func (s *Session) Pack(
 	dir string,
 	paths []string,
 	compress bool,
+) (*PackResult, error) {
+	return s.PackWith(dir, paths, PackOptions{Compress: compress})
+}
+
+type PackOptions struct {
+	Compress  bool
+	CopyLinks bool
+	// NoParents leaves the parents of paths out of the tarball.
+	NoParents bool
+}
+
+func (s *Session) PackWith(
+	dir string,
+	paths []string,
+	opts PackOptions,
 ) (*PackResult, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	var ext string
-	if compress {
+	if opts.Compress {
 		ext = ".tar.gz"
 	} else {
 		ext = ".tar"
 	}
-	dest := tmpPath(ext)
+	return s.pack(Request{
+		Cmd:       "pack",
+		Dir:       dir,
+		Paths:     paths,
+		Dest:      tmpPath(ext),
+		Compress:  opts.Compress,
+		CopyLinks: opts.CopyLinks,
+		NoParents: opts.NoParents,
+	})
+}
 
-	err := s.sendCmd(Request{
-		Cmd:      "pack",
-		Dir:      dir,
-		Paths:    paths,
-		Dest:     dest,
-		Compress: compress,
+// PackTo packs into dest and asks spryncd to leave it in place
+// when the session ends, so an interrupted download can resume.
+func (s *Session) PackTo(
+	dir string,
+	paths []string,
+	dest string,
+	compress bool,
+) (*PackResult, error) {
+	return s.PackToWith(
+		dir, paths, dest, PackOptions{Compress: compress},
+	)
+}
+
+func (s *Session) PackToWith(
+	dir string,
+	paths []string,
+	dest string,
+	opts PackOptions,
+) (*PackResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.pack(Request{
+		Cmd:       "pack",
+		Dir:       dir,
+		Paths:     paths,
+		Dest:      dest,
+		Compress:  opts.Compress,
+		CopyLinks: opts.CopyLinks,
+		Keep:      true,
+		NoParents: opts.NoParents,
 	})
-	if err != nil {
+}
+
+func (s *Session) pack(req Request) (*PackResult, error) {
+	if err := s.sendCmd(req); err != nil {
 		return nil, err
 	}
 
@@ -223,14 +342,93 @@ func (s *Session) Extract(
 	dir, src string,
 	compress bool,
 ) (*ExtractResult, error) {
+	return s.ExtractWith(
+		dir, src, pack.UnpackOptions{Compress: compress},
+	)
+}
+
+func (s *Session) ExtractWith(
+	dir, src string,
+	opts pack.UnpackOptions,
+) (*ExtractResult, error) {
+	return s.ExtractStaged(dir, src, "", opts)
+}
+
+// ExtractStaged extracts like ExtractWith but, when stage is
+// set, leaves the files beside their targets and lists them in
+// stage, a file under /tmp, for Commit.
+func (s *Session) ExtractStaged(
+	dir, src, stage string,
+	opts pack.UnpackOptions,
+) (*ExtractResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	req := Request{
+		Cmd:          "extract",
+		Dir:          dir,
+		Src:          src,
+		Compress:     opts.Compress,
+		Times:        opts.Times,
+		Paths:        opts.Only,
+		Progress:     s.OnProgress != nil,
+		DelayUpdates: opts.DelayUpdates,
+		Stage:        stage,
+		Backup:       opts.Backup,
+	}
+	if d := opts.Delete; d != nil {
+		req.Delete = true
+		req.Protect = d.Protect
+		req.Filters = d.Exclude.Filters
+		req.Excludes = d.Exclude.Excludes
+		req.IgnoreFiles = d.Exclude.IgnoreFiles
+		req.DeleteExcluded = d.DeleteExcluded
+	}
+	if err := s.sendCmd(req); err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case TypeExtractDone:
+			return &ExtractResult{Count: resp.Count}, nil
+		case TypeProgress:
+			if s.OnProgress != nil {
+				s.OnProgress(resp.Count, resp.Size)
+			}
+		case TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("%s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type CommitResult struct {
+	Count int
+}
+
+// Commit puts the files of every stage in place together, or
+// with abort removes them, and then removes the stages.
+func (s *Session) Commit(
+	stages []string, abort bool,
+) (*CommitResult, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	err := s.sendCmd(Request{
-		Cmd:      "extract",
-		Dir:      dir,
-		Src:      src,
-		Compress: compress,
+		Cmd:   "commit",
+		Paths: stages,
+		Abort: abort,
 	})
 	if err != nil {
 		return nil, err
@@ -242,8 +440,8 @@ func (s *Session) Extract(
 			return nil, err
 		}
 		switch resp.Type {
-		case TypeExtractDone:
-			return &ExtractResult{Count: resp.Count}, nil
+		case TypeCommitDone:
+			return &CommitResult{Count: resp.Count}, nil
 		case TypeError:
 			if resp.Fatal {
 				return nil,
@@ -257,21 +455,197 @@ func (s *Session) Extract(
 	}
 }
 
+// DeleteResult counts the files deleted in Count and the empty
+// directories removed in Dirs.
 type DeleteResult struct {
 	Count int
+	Dirs  int
 }
 
 func (s *Session) Delete(
 	dir string,
 	paths []string,
 ) (*DeleteResult, error) {
+	return s.DeleteWith(dir, paths, pack.DeleteOptions{})
+}
+
+func (s *Session) DeleteWith(
+	dir string,
+	paths []string,
+	opts pack.DeleteOptions,
+) (*DeleteResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.sendCmd(Request{
+		Cmd:            "delete",
+		Dir:            dir,
+		Paths:          paths,
+		Backup:         opts.Backup,
+		Protect:        opts.Protect,
+		Filters:        opts.Exclude.Filters,
+		Excludes:       opts.Exclude.Excludes,
+		IgnoreFiles:    opts.Exclude.IgnoreFiles,
+		DeleteExcluded: opts.DeleteExcluded,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case TypeDeleteDone:
+			return &DeleteResult{
+				Count: resp.Count,
+				Dirs:  resp.Dirs,
+			}, nil
+		case TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("%s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type ChmodResult struct {
+	Count int
+}
+
+func (s *Session) Chmod(
+	dir string,
+	modes map[string]int,
+) (*ChmodResult, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	err := s.sendCmd(Request{
-		Cmd:   "delete",
+		Cmd:   "chmod",
+		Dir:   dir,
+		Modes: modes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case TypeChmodDone:
+			return &ChmodResult{Count: resp.Count}, nil
+		case TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("%s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type CopyResult struct {
+	Count  int
+	Failed []string
+}
+
+func (s *Session) Copy(
+	dir string,
+	copies []pack.Copy,
+	times bool,
+) (*CopyResult, error) {
+	return s.CopyWith(dir, copies, times, nil)
+}
+
+// CopyWith copies files below dir, first saving into backup the
+// files it overwrites or renames away.
+func (s *Session) CopyWith(
+	dir string,
+	copies []pack.Copy,
+	times bool,
+	backup *pack.Backup,
+) (*CopyResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ops := make([]CopyOp, 0, len(copies))
+	for _, c := range copies {
+		ops = append(ops, CopyOp{
+			From:   c.From,
+			To:     c.To,
+			Mode:   c.Mode,
+			MTime:  c.MTime,
+			Rename: c.Rename,
+		})
+	}
+	err := s.sendCmd(Request{
+		Cmd:    "copy",
+		Dir:    dir,
+		Copies: ops,
+		Times:  times,
+		Backup: backup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case TypeCopyDone:
+			return &CopyResult{
+				Count:  resp.Count,
+				Failed: resp.Failed,
+			}, nil
+		case TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("%s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type SignatureResult struct {
+	Dest  string
+	Size  int64
+	Count int
+}
+
+func (s *Session) Signature(
+	dir string,
+	paths []string,
+) (*SignatureResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dest := tmpPath(".sig")
+
+	err := s.sendCmd(Request{
+		Cmd:   "signature",
 		Dir:   dir,
 		Paths: paths,
+		Dest:  dest,
 	})
 	if err != nil {
 		return nil, err
@@ -283,8 +657,72 @@ func (s *Session) Delete(
 			return nil, err
 		}
 		switch resp.Type {
-		case TypeDeleteDone:
-			return &DeleteResult{Count: resp.Count}, nil
+		case TypeSignatureDone:
+			return &SignatureResult{
+				Dest:  resp.Dest,
+				Size:  resp.Size,
+				Count: resp.Count,
+			}, nil
+		case TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("%s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type PatchResult struct {
+	Count  int
+	Failed []string
+}
+
+func (s *Session) Patch(
+	dir, src string,
+	opts pack.UnpackOptions,
+) (*PatchResult, error) {
+	return s.PatchStaged(dir, src, "", opts)
+}
+
+// PatchStaged patches like Patch but, when stage is set, leaves
+// the files beside their targets and lists them in stage for
+// Commit, as ExtractStaged does.
+func (s *Session) PatchStaged(
+	dir, src, stage string,
+	opts pack.UnpackOptions,
+) (*PatchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.sendCmd(Request{
+		Cmd:          "patch",
+		Dir:          dir,
+		Src:          src,
+		Compress:     opts.Compress,
+		Times:        opts.Times,
+		DelayUpdates: opts.DelayUpdates,
+		Stage:        stage,
+		Backup:       opts.Backup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case TypePatchDone:
+			return &PatchResult{
+				Count:  resp.Count,
+				Failed: resp.Failed,
+			}, nil
 		case TypeError:
 			if resp.Fatal {
 				return nil,
@@ -304,23 +742,50 @@ type TransferResult struct {
 	Dest  string
 }
 
+type TransferOptions struct {
+	Compress  bool
+	CopyLinks bool
+	// BWLimit caps the upload in bytes per second; 0 means no
+	// limit.
+	BWLimit int64
+	// NoParents leaves the parents of paths out of the tarball.
+	NoParents bool
+}
+
 func (s *Session) Transfer(
 	dir string,
 	paths []string,
 	compress bool,
 	destURL string,
 	token string,
+) (*TransferResult, error) {
+	return s.TransferWith(
+		dir, paths, destURL, token,
+		TransferOptions{Compress: compress},
+	)
+}
+
+func (s *Session) TransferWith(
+	dir string,
+	paths []string,
+	destURL string,
+	token string,
+	opts TransferOptions,
 ) (*TransferResult, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	err := s.sendCmd(Request{
-		Cmd:      "transfer",
-		Dir:      dir,
-		Paths:    paths,
-		Compress: compress,
-		URL:      destURL,
-		Token:    token,
+		Cmd:       "transfer",
+		Dir:       dir,
+		Paths:     paths,
+		Compress:  opts.Compress,
+		URL:       destURL,
+		Token:     token,
+		CopyLinks: opts.CopyLinks,
+		Progress:  s.OnProgress != nil,
+		BWLimit:   opts.BWLimit,
+		NoParents: opts.NoParents,
 	})
 	if err != nil {
 		return nil, err
@@ -338,6 +803,173 @@ func (s *Session) Transfer(
 				Size:  resp.Size,
 				Dest:  resp.Dest,
 			}, nil
+		case TypeProgress:
+			if s.OnProgress != nil {
+				s.OnProgress(resp.Count, resp.Size)
+			}
+		case TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("%s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type ConcatResult struct {
+	Size int64
+}
+
+// Concat joins parts, in order, into dest. The parts are left in
+// place; callers remove them with Discard.
+func (s *Session) Concat(
+	dest string,
+	parts []string,
+) (*ConcatResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.sendCmd(Request{
+		Cmd:   "concat",
+		Dest:  dest,
+		Paths: parts,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case TypeConcatDone:
+			return &ConcatResult{Size: resp.Size}, nil
+		case TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("%s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type DiscardResult struct {
+	Count int
+}
+
+// Discard removes temporary files under /tmp on the sprite.
+// Files that are already gone are not an error.
+func (s *Session) Discard(
+	paths []string,
+) (*DiscardResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.sendCmd(Request{
+		Cmd:   "discard",
+		Paths: paths,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case TypeDiscardDone:
+			return &DiscardResult{Count: resp.Count}, nil
+		case TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("%s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+// Backups lists the backup sets of dir under root, or under
+// the default root when it is "", oldest first.
+func (s *Session) Backups(dir, root string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.sendCmd(Request{
+		Cmd:    "backups",
+		Dir:    dir,
+		Backup: &pack.Backup{Root: root},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case TypeBackups:
+			return resp.Names, nil
+		case TypeError:
+			if resp.Fatal {
+				return nil,
+					fmt.Errorf("%s", resp.Message)
+			}
+		default:
+			return nil, fmt.Errorf(
+				"unexpected response: %s", resp.Type,
+			)
+		}
+	}
+}
+
+type RestoreResult struct {
+	Count int
+}
+
+// Restore moves the files in a backup set back into dir and
+// removes the set.
+func (s *Session) Restore(
+	dir string,
+	backup pack.Backup,
+) (*RestoreResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.sendCmd(Request{
+		Cmd:    "restore",
+		Dir:    dir,
+		Backup: &backup,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		resp, err := s.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Type {
+		case TypeRestoreDone:
+			return &RestoreResult{Count: resp.Count}, nil
 		case TypeError:
 			if resp.Fatal {
 				return nil,
@@ -370,6 +1002,9 @@ func (s *Session) Close(ctx context.Context) error {
 	}
 
 	closeErr := s.conn.Close()
+	if s.forked {
+		return closeErr
+	}
 
 	s.client.ExecHTTP(
 		ctx, s.sprite,
@@ -3,17 +3,23 @@ package spriteapi
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strings"
+
+	"github.com/tqbf/sprync/pkg/throttle"
 )
 
 type Client struct {
 	BaseURL    string
 	Token      string
 	HTTPClient *http.Client
+	// Limiter, if set, caps the rate of file uploads and
+	// downloads.
+	Limiter *throttle.Limiter
 }
 
 func New(baseURL, token string) *Client {
@@ -104,7 +110,7 @@ func (c *Client) FSWrite(
 		q.Encode(),
 	)
 	req, err := http.NewRequestWithContext(
-		ctx, "PUT", u, body,
+		ctx, "PUT", u, c.Limiter.Reader(body),
 	)
 	if err != nil {
 		return err
@@ -158,7 +164,48 @@ func (c *Client) FSRead(
 	if err != nil {
 		return nil, err
 	}
-	return resp.Body, nil
+	return c.Limiter.ReadCloser(resp.Body), nil
+}
+
+// FSReadFrom reads path starting at offset using a Range
+// request. Servers that ignore Range send the whole file, so the
+// returned offset is where the body actually starts.
+func (c *Client) FSReadFrom(
+	ctx context.Context,
+	sprite, path string,
+	offset int64,
+) (io.ReadCloser, int64, error) {
+	q := url.Values{}
+	q.Set("path", path)
+
+	u := fmt.Sprintf("%s?%s",
+		c.spriteURL(sprite, "/fs/read"),
+		q.Encode(),
+	)
+	req, err := http.NewRequestWithContext(
+		ctx, "GET", u, nil,
+	)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		offset = 0
+	}
+	return c.Limiter.ReadCloser(resp.Body), offset, nil
+}
+
+// IsNotFound reports whether err is a 404 from the API.
+func IsNotFound(err error) bool {
+	var apiErr *apiError
+	return errors.As(err, &apiErr) &&
+		apiErr.StatusCode == http.StatusNotFound
 }
 
 type SpriteInfo struct {
@@ -0,0 +1,102 @@
+package spriteapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+)
+
+// FSEvent is a change reported by /fs/watch. Event is one of
+// write, create, remove, rename or chmod.
+type FSEvent struct {
+	Event     string `json:"event"`
+	Path      string `json:"path"`
+	Timestamp string `json:"timestamp"`
+	Size      int64  `json:"size"`
+	IsDir     bool   `json:"isDir"`
+}
+
+type watchMessage struct {
+	Type       string   `json:"type"`
+	Paths      []string `json:"paths,omitempty"`
+	Recursive  bool     `json:"recursive,omitempty"`
+	WorkingDir string   `json:"workingDir,omitempty"`
+	Message    string   `json:"message,omitempty"`
+
+	FSEvent
+}
+
+// FSWatcher streams filesystem events from a sprite.
+type FSWatcher struct {
+	conn *websocket.Conn
+}
+
+// FSWatch subscribes to changes below paths on the sprite and
+// returns once the subscription is confirmed.
+func (c *Client) FSWatch(
+	ctx context.Context,
+	sprite string,
+	paths []string,
+	recursive bool,
+) (*FSWatcher, error) {
+	conn, err := c.dialWS(ctx, c.spriteURL(sprite, "/fs/watch"))
+	if err != nil {
+		return nil, err
+	}
+	w := &FSWatcher{conn: conn}
+	err = wsjson.Write(ctx, conn, watchMessage{
+		Type:       "subscribe",
+		Paths:      paths,
+		Recursive:  recursive,
+		WorkingDir: "/",
+	})
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	for {
+		msg, err := w.read(ctx)
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+		if msg.Type == "subscribed" {
+			return w, nil
+		}
+	}
+}
+
+// Next blocks until the next event arrives.
+func (w *FSWatcher) Next(ctx context.Context) (*FSEvent, error) {
+	for {
+		msg, err := w.read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if msg.Type == "event" {
+			return &msg.FSEvent, nil
+		}
+	}
+}
+
+func (w *FSWatcher) read(ctx context.Context) (*watchMessage, error) {
+	_, data, err := w.conn.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var msg watchMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, fmt.Errorf("watch message: %w", err)
+	}
+	if msg.Type == "error" {
+		return nil, fmt.Errorf("watch %s: %s", msg.Path, msg.Message)
+	}
+	return &msg, nil
+}
+
+func (w *FSWatcher) Close() error {
+	return w.conn.Close(websocket.StatusNormalClosure, "")
+}
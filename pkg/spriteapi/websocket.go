@@ -28,8 +28,12 @@ func (c *Client) ExecWebSocket(
 		c.spriteURL(sprite, "/exec"),
 		q.Encode(),
 	)
-	wsURL := httpToWS(httpURL)
+	return c.dialWS(ctx, httpURL)
+}
 
+func (c *Client) dialWS(
+	ctx context.Context, httpURL string,
+) (*websocket.Conn, error) {
 	opts := &websocket.DialOptions{
 		HTTPHeader: http.Header{
 			"Authorization": []string{
@@ -38,7 +42,7 @@ func (c *Client) ExecWebSocket(
 		},
 	}
 
-	conn, _, err := websocket.Dial(ctx, wsURL, opts)
+	conn, _, err := websocket.Dial(ctx, httpToWS(httpURL), opts)
 	if err != nil {
 		return nil, err
 	}
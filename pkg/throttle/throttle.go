@@ -0,0 +1,111 @@
+package throttle
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter caps the combined rate, in bytes per second, of every
+// reader it wraps. A nil Limiter does not limit anything.
+type Limiter struct {
+	rate int64
+	mu   sync.Mutex
+	next time.Time
+}
+
+// New returns a Limiter for rate bytes per second, or nil when
+// rate is not positive.
+func New(rate int64) *Limiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &Limiter{rate: rate}
+}
+
+// Rate returns the limit in bytes per second, or 0 for none.
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.rate
+}
+
+// Wait blocks until n more bytes fit within the rate.
+func (l *Limiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(
+		time.Duration(n) * time.Second / time.Duration(l.rate),
+	)
+	until := l.next
+	l.mu.Unlock()
+	time.Sleep(time.Until(until))
+}
+
+// Reader returns r limited by l.
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+	return &reader{r: r, l: l}
+}
+
+// ReadCloser returns rc limited by l.
+func (l *Limiter) ReadCloser(rc io.ReadCloser) io.ReadCloser {
+	if l == nil {
+		return rc
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{l.Reader(rc), rc}
+}
+
+type reader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.l.rate {
+		p = p[:r.l.rate]
+	}
+	n, err := r.r.Read(p)
+	r.l.Wait(n)
+	return n, err
+}
+
+// ParseRate parses a rate such as "500K" or "1.5M": bytes per
+// second with an optional K, M or G suffix in powers of 1024.
+func ParseRate(s string) (int64, error) {
+	num := strings.TrimSpace(s)
+	mult := float64(1)
+	if num != "" {
+		switch strings.ToUpper(num[len(num)-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			num = num[:len(num)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return int64(v * mult), nil
+}
@@ -0,0 +1,71 @@
+package throttle
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRate(t *testing.T) {
+	cases := map[string]int64{
+		"0":     0,
+		"100":   100,
+		"500K":  500 << 10,
+		"500k":  500 << 10,
+		"1.5M":  3 << 19,
+		"2G":    2 << 30,
+		" 64K ": 64 << 10,
+	}
+	for in, want := range cases {
+		got, err := ParseRate(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, want, got, in)
+	}
+
+	for _, in := range []string{"", "K", "fast", "-1M", "10X"} {
+		_, err := ParseRate(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	assert.Nil(t, New(0))
+	assert.Zero(t, l.Rate())
+
+	r := bytes.NewReader([]byte("hello"))
+	assert.Same(t, r, l.Reader(r))
+}
+
+func TestReaderRate(t *testing.T) {
+	l := New(200 << 10)
+	data := make([]byte, 100<<10)
+
+	start := time.Now()
+	got, err := io.ReadAll(l.Reader(bytes.NewReader(data)))
+	require.NoError(t, err)
+	assert.Equal(t, len(data), len(got))
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}
+
+func TestReadersShareRate(t *testing.T) {
+	l := New(200 << 10)
+	data := make([]byte, 50<<10)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			io.Copy(io.Discard, l.Reader(bytes.NewReader(data)))
+		}()
+	}
+	wg.Wait()
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+}